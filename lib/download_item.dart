@@ -13,6 +13,8 @@ class DownloadItem {
   DownloadStatus status;
   String? tempStatus; // Para estados transitorios en UI (pausing, resuming)
   String? error;
+  int? queuePosition; // Posición en la cola del servidor (null si no espera)
+  int? etaSeconds; // ETA calculada por el servidor (-1 si no se puede estimar)
   final DateTime startTime;
   String? checksum; // Añadir campo para guardar el SHA
   List<String> logs = []; // Añadir logs de la descarga
@@ -89,17 +91,24 @@ class DownloadItem {
   }
 
   String get eta {
+    // El servidor ya suaviza la ETA; el cálculo local queda para servidores
+    // antiguos que no la envían
+    if (etaSeconds != null) {
+      if (etaSeconds! < 0) return '--:--:--';
+      return _formatDuration(Duration(seconds: etaSeconds!));
+    }
+
     if (currentSpeed <= 0 || !currentSpeed.isFinite) return '--:--:--';
 
     final remaining = totalBytes - downloadedBytes;
     if (remaining <= 0) return '00:00:00';
 
     // More responsive ETA calculation
-    final etaSeconds = remaining / currentSpeed;
-    if (!etaSeconds.isFinite || etaSeconds <= 0) return '--:--:--';
+    final estimate = remaining / currentSpeed;
+    if (!estimate.isFinite || estimate <= 0) return '--:--:--';
 
     // Store ETA in history for smoothing
-    _etaHistory.add(etaSeconds);
+    _etaHistory.add(estimate);
     if (_etaHistory.length > 8) {
       // Using implicit max length instead of const
       _etaHistory.removeAt(0);
@@ -110,14 +119,16 @@ class DownloadItem {
       // Use 0.3/0.7 ratio for more responsive updates
       _lastEta =
           _lastEta == 0
-              ? etaSeconds
-              : (_lastEta * (1 - _etaAlpha) + etaSeconds * _etaAlpha);
+              ? estimate
+              : (_lastEta * (1 - _etaAlpha) + estimate * _etaAlpha);
     } else {
-      _lastEta = etaSeconds;
+      _lastEta = estimate;
     }
 
-    final duration = Duration(seconds: _lastEta.round());
+    return _formatDuration(Duration(seconds: _lastEta.round()));
+  }
 
+  static String _formatDuration(Duration duration) {
     // Formatear sin exceder 99:59:59
     int hours = duration.inHours.clamp(0, 99);
     int minutes = (duration.inMinutes % 60).clamp(0, 59);
@@ -247,12 +258,33 @@ class DownloadItem {
     chunks[chunkInfo.id] = chunkInfo;
   }
 
+  // Texto para una descarga en cola: "Waiting (3rd in line)"
+  String _waitingText(int position) {
+    final mod100 = position % 100;
+    var suffix = 'th';
+    if (mod100 < 11 || mod100 > 13) {
+      switch (position % 10) {
+        case 1:
+          suffix = 'st';
+          break;
+        case 2:
+          suffix = 'nd';
+          break;
+        case 3:
+          suffix = 'rd';
+          break;
+      }
+    }
+    return 'Waiting ($position$suffix in line)';
+  }
+
   // Agregar un helper para detectar estados transitorios
   bool get isInTransition => tempStatus != null;
 
   String get statusDisplay {
     if (tempStatus == 'pausing') return 'Pausing...';
     if (tempStatus == 'resuming') return 'Resuming...';
+    if (queuePosition != null) return _waitingText(queuePosition!);
 
     switch (status) {
       case DownloadStatus.queued:
@@ -271,6 +303,7 @@ class DownloadItem {
   String get statusText {
     if (tempStatus == 'pausing') return 'Pausing...';
     if (tempStatus == 'resuming') return 'Resuming...';
+    if (queuePosition != null) return _waitingText(queuePosition!);
 
     switch (status) {
       case DownloadStatus.queued:
@@ -15,6 +15,7 @@ class ChunkInfo {
   final int progress;
   final double speed;
   final int completed;
+  final double? percent; // 0-100, enviado por el servidor
 
   ChunkInfo({
     required this.id,
@@ -24,6 +25,7 @@ class ChunkInfo {
     this.progress = 0,
     this.speed = 0.0,
     this.completed = 0,
+    this.percent,
   });
 
   factory ChunkInfo.fromJson(Map<String, dynamic> json) {
@@ -35,11 +37,16 @@ class ChunkInfo {
       progress: json['progress'] as int? ?? 0,
       speed: (json['speed'] as num?)?.toDouble() ?? 0.0,
       completed: json['completed'] as int? ?? 0,
+      percent: (json['percent'] as num?)?.toDouble(),
     );
   }
 
-  double get progressPercentage =>
-      end > start ? progress / (end - start + 1) : 0.0;
+  // Servidores antiguos no envían percent: calcularlo a partir de los bytes
+  double get progressPercentage => percent != null
+      ? percent! / 100
+      : end > start
+          ? progress / (end - start + 1)
+          : 0.0;
 }
 
 // Extension para añadir funcionalidad de chunks a DownloadItem
@@ -178,6 +185,9 @@ class DownloadService {
               _handleErrorMessage(data);
               break;
             case 'log':
+            case 'queued':
+            case 'resolved_url':
+            case 'chunk_validation_failed':
               _handleLogMessage(data);
               break;
             case 'cancel_confirmed':
@@ -189,12 +199,19 @@ class DownloadService {
             case 'chunk_init':
               _handleChunkInit(data);
               break;
+            case 'chunks_init':
+              _handleChunksInit(data);
+              break;
             case 'chunk_progress':
               _handleChunkProgress(data);
               break;
             case 'pong':
               _logger.fine('Pong received from server');
               break;
+            case 'download_accepted':
+              _logger.fine(
+                  'Download accepted: ${data['url']} (id ${data['download_id']})');
+              break;
             case 'pause_confirmed':
               _handlePauseConfirmation(data);
               break;
@@ -210,6 +227,14 @@ class DownloadService {
             case 'merge_start':
               _handleMergeStart(data);
               break;
+            case 'active_downloads':
+              _logger.info(
+                'Server reports ${(data['downloads'] as List).length} active downloads',
+              );
+              break;
+            case 'subscribed':
+            case 'unsubscribed':
+              break;
             default:
               _logger.warning('Unknown message type: ${data['type']}');
           }
@@ -225,6 +250,9 @@ class DownloadService {
 
   // Manejar reconexión y recuperar descargas en progreso
   void _onReconnected() {
+    // Pedir el estado de las descargas del servidor para reconstruir la vista
+    _connector.send({'type': 'list_active'});
+
     // Intentar resumir descargas en curso
     for (final item in _downloads.values) {
       if (item.status == DownloadStatus.downloading ||
@@ -403,6 +431,15 @@ class DownloadService {
         final totalBytes = data['totalBytes'] ?? 0;
         final status = data['status']?.toString() ?? "downloading";
 
+        // Queued on the server: only the queue position changes
+        if (status == "queued") {
+          item.queuePosition = data['queue_position'] as int?;
+          _downloadController.add(item);
+          return;
+        }
+        item.queuePosition = null;
+        item.etaSeconds = data['eta_seconds'] as int?;
+
         // Update progress and bytes
         item.downloadedBytes = newBytes;
         item.totalBytes = totalBytes;
@@ -531,7 +568,8 @@ class DownloadService {
       return;
     }
 
-    if (message == "✅ Download completed successfully") {
+    // The server appends the saved file name, which may be numbered
+    if (message.startsWith("✅ Download completed successfully")) {
       _logger.info('Download completed for $url');
       item.addLog(message);
       item.status = DownloadStatus.completed;
@@ -562,6 +600,7 @@ class DownloadService {
     _logger.info('- Implementation: ${data['implementation']}');
     _logger.info('- Features: ${data['features']}');
     _logger.info('- Chunks supported: ${data['chunks_supported']}');
+    _logger.info('- Protocol version: ${data['protocol_version'] ?? 0}');
     final chunksSupported = data['chunks_supported'] as bool? ?? false;
     if (chunksSupported) {
       _logger.info('✅ Server supports chunked downloads');
@@ -588,6 +627,24 @@ class DownloadService {
     _downloadController.add(item);
   }
 
+  void _handleChunksInit(Map<String, dynamic> data) {
+    final url = data['url'] as String;
+    final chunks = data['chunks'] as List<dynamic>;
+    if (_recentlyCancelled.contains(url)) {
+      _logger.info('Ignoring chunks init for cancelled download: $url');
+      return;
+    }
+
+    final item = _downloads[url];
+    if (item == null) return;
+
+    for (final chunkData in chunks) {
+      item.updateChunk(ChunkInfo.fromJson(chunkData as Map<String, dynamic>));
+    }
+
+    _downloadController.add(item);
+  }
+
   void _handleChunkProgress(Map<String, dynamic> data) {
     final url = data['url'] as String;
     final chunkData = data['chunk'] as Map<String, dynamic>;
@@ -804,6 +861,12 @@ class DownloadService {
 
     final item = _downloads[url];
     if (item != null) {
+      // El servidor envía el tamaño final tras el merge
+      final totalBytes = data['total_bytes'];
+      if (totalBytes is num && totalBytes > 0) {
+        item.totalBytes = totalBytes.toInt();
+      }
+
       // Force completion state
       item.progress = 1.0;
       item.downloadedBytes = item.totalBytes;
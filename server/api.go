@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tiempo que se conserva el resultado de una descarga REST ya terminada
+const finishedJobRetention = time.Hour
+
+// downloadJob es el estado de una descarga iniciada con POST /downloads. Se
+// alimenta de los mismos eventos que reciben los clientes WebSocket y SSE
+type downloadJob struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	Status        DownloadStatus `json:"status"`
+	BytesReceived int64          `json:"bytesReceived"`
+	TotalBytes    int64          `json:"totalBytes"`
+	Speed         float64        `json:"speed"`
+	QueuePosition int            `json:"queue_position,omitempty"`
+	SavePath      string         `json:"save_path,omitempty"`
+	Checksum      string         `json:"checksum,omitempty"`
+	Error         string         `json:"error,omitempty"`
+	ErrorCode     string         `json:"error_code,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt"`
+	FinishedAt    *time.Time     `json:"finishedAt,omitempty"`
+
+	mu sync.RWMutex
+}
+
+// jobStore guarda las descargas REST por id
+type jobStore struct {
+	mu   sync.RWMutex
+	jobs map[string]*downloadJob
+}
+
+var downloadJobs = &jobStore{jobs: make(map[string]*downloadJob)}
+
+// Add guarda un trabajo y aprovecha para descartar los terminados hace tiempo
+func (s *jobStore) Add(job *downloadJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, old := range s.jobs {
+		old.mu.RLock()
+		expired := old.FinishedAt != nil && time.Since(*old.FinishedAt) > finishedJobRetention
+		old.mu.RUnlock()
+		if expired {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = job
+}
+
+// Get devuelve el trabajo con ese id
+func (s *jobStore) Get(id string) (*downloadJob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, exists := s.jobs[id]
+	return job, exists
+}
+
+// newDownloadID genera un identificador aleatorio para una descarga
+func newDownloadID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// track actualiza el trabajo con los eventos de su descarga hasta que termina
+func (job *downloadJob) track(ch chan sseEvent) {
+	defer events.Unsubscribe(ch)
+
+	for evt := range ch {
+		var event struct {
+			Status        DownloadStatus `json:"status"`
+			BytesReceived int64          `json:"bytesReceived"`
+			TotalBytes    int64          `json:"totalBytes"`
+			Speed         float64        `json:"speed"`
+			Message       string         `json:"message"`
+			ErrorCode     string         `json:"error_code"`
+			Checksum      string         `json:"checksum"`
+			SavePath      string         `json:"save_path"`
+			QueuePosition int            `json:"queue_position"`
+		}
+		if err := json.Unmarshal(evt.data, &event); err != nil {
+			continue
+		}
+
+		job.mu.Lock()
+		finished := false
+		switch evt.eventType {
+		case "progress":
+			job.Status = event.Status
+			job.QueuePosition = event.QueuePosition
+			job.BytesReceived = event.BytesReceived
+			job.TotalBytes = event.TotalBytes
+			job.Speed = event.Speed
+			finished = event.Status == StatusFailed || event.Status == StatusCanceled
+		case "error":
+			job.Status = StatusFailed
+			job.Error = event.Message
+			job.ErrorCode = event.ErrorCode
+			finished = true
+		case "download_complete":
+			job.SavePath = event.SavePath
+		case "checksum_result":
+			job.Checksum = event.Checksum
+			job.SavePath = event.SavePath
+			finished = true
+		}
+		if finished {
+			now := time.Now()
+			job.FinishedAt = &now
+		}
+		job.mu.Unlock()
+
+		if finished {
+			return
+		}
+	}
+}
+
+// writeJSON responde con un cuerpo JSON y el código indicado
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
+
+// writeJSONError responde con {"error": message}
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// downloadSummary describe una descarga registrada en GET /downloads
+type downloadSummary struct {
+	ID         string          `json:"download_id"`
+	URL        string          `json:"url"`
+	Filename   string          `json:"filename,omitempty"`
+	Size       int64           `json:"size"`
+	Downloaded int64           `json:"downloaded"`
+	Paused     bool            `json:"paused"`
+	Status     DownloadStatus  `json:"status"`
+	Chunked    bool            `json:"chunked"`
+	Chunks     []ChunkProgress `json:"chunks,omitempty"`
+}
+
+// handleDownloads atiende /downloads: GET lista las descargas registradas y
+// POST inicia una nueva
+func handleDownloads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleListDownloads(w, r)
+	case http.MethodPost:
+		handleStartDownload(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// statusSnapshot es la respuesta de GET /status
+type statusSnapshot struct {
+	ID            string          `json:"download_id"`
+	URL           string          `json:"url"`
+	Status        DownloadStatus  `json:"status"`
+	BytesReceived int64           `json:"bytesReceived"`
+	TotalBytes    int64           `json:"totalBytes"`
+	Speed         float64         `json:"speed"`
+	ETASeconds    int64           `json:"eta_seconds"`
+	Chunks        []ChunkProgress `json:"chunks,omitempty"`
+}
+
+// handleListDownloads devuelve el estado de todas las descargas registradas,
+// con el detalle de cada chunk en las descargas por chunks
+func handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	entries := registry.Entries()
+	summaries := make([]downloadSummary, 0, len(entries))
+
+	for _, entry := range entries {
+		summary := downloadSummary{
+			ID:     entry.ID,
+			URL:    entry.URL,
+			Paused: entry.Paused,
+			Status: StatusDownloading,
+		}
+		if entry.Paused {
+			summary.Status = StatusPaused
+		}
+
+		if download := entry.Download; download != nil {
+			summary.Chunked = true
+			summary.Downloaded, summary.Size = download.GetProgress()
+
+			download.RLock()
+			summary.Filename = download.Filename
+			summary.Status = download.Status
+			download.RUnlock()
+			summary.Chunks = download.ChunkStates()
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"downloads": summaries,
+	})
+}
+
+// handleStartDownload atiende POST /downloads, que inicia una descarga por
+// chunks con el mismo cuerpo que start_download ({"url": ..., "ranges": ...})
+// y devuelve su id. El progreso se sigue por GET /downloads/{id} o /events.
+// Solo acepta JSON de orígenes locales, y download_dir y temp_dir deben
+// quedar dentro del directorio de descargas configurado
+func handleStartDownload(w http.ResponseWriter, r *http.Request) {
+	if !allowedOrigin(r) {
+		writeJSONError(w, http.StatusForbidden, "origin not allowed")
+		return
+	}
+	if !isJSONRequest(r) {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+
+	var msg map[string]interface{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&msg); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	raw, _ := msg["url"].(string)
+	url, err := normalizeDownloadURL(raw)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts, err := parseDownloadOptions(msg)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid download options: "+err.Error())
+		return
+	}
+	if opts.DownloadDir, err = confineDownloadDir(opts.DownloadDir); err != nil {
+		writeJSONError(w, http.StatusForbidden, "download_dir: "+err.Error())
+		return
+	}
+	if opts.TempDir, err = confineDownloadDir(opts.TempDir); err != nil {
+		writeJSONError(w, http.StatusForbidden, "temp_dir: "+err.Error())
+		return
+	}
+	dest := downloadDestination(opts.DownloadDir, opts.Filename)
+	if findDuplicate(url, dest) != "" {
+		writeJSONError(w, http.StatusConflict, "this URL is already being downloaded to the same destination")
+		return
+	}
+
+	job := &downloadJob{
+		ID:        newDownloadID(),
+		URL:       url,
+		Status:    StatusStarting,
+		CreatedAt: time.Now(),
+	}
+
+	// El id del trabajo es también el de la descarga. Suscribirse antes de
+	// arrancar para no perder los primeros eventos
+	downloadIDs.Bind(job.ID, url, dest)
+	ch := events.Subscribe(job.ID)
+	go job.track(ch)
+
+	log.Printf("REST download request %s for: %s", job.ID, url)
+	if err := downloadSlots.Submit(job.ID, nil, func() { startChunkedDownload(nil, job.ID, url, opts) }); err != nil {
+		// Sin más envíos al canal tras darlo de baja, cerrarlo termina track
+		events.Unsubscribe(ch)
+		close(ch)
+		downloadIDs.Expire(job.ID)
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	downloadJobs.Add(job)
+
+	status := StatusStarting
+	if downloadSlots.IsQueued(job.ID) {
+		status = StatusQueued
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"id":     job.ID,
+		"url":    url,
+		"status": status,
+	})
+}
+
+// handleStart atiende POST /start, alias de POST /downloads para clientes
+// sin WebSocket que siguen la descarga por GET /events (curl, EventSource).
+// Pasa por las mismas comprobaciones de origen, Content-Type y directorio
+func handleStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handleStartDownload(w, r)
+}
+
+// handleStatus atiende GET /status?download_id= (o ?url= si solo hay una
+// descarga de esa URL), una foto del estado de una descarga para scripts que
+// no pueden mantener un socket abierto. Las descargas de una sola conexión
+// solo informan del estado, igual que sendDownloadSnapshot
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("url") == "" && query.Get("download_id") == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing download_id or url")
+		return
+	}
+	id, err := resolveDownload(map[string]interface{}{
+		"url":         query.Get("url"),
+		"download_id": query.Get("download_id"),
+	})
+	if err == errDownloadNotFound {
+		writeJSONError(w, http.StatusNotFound, "download not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	snapshot := statusSnapshot{ID: id, URL: downloadIDs.URL(id), Status: StatusDownloading, ETASeconds: -1}
+	paused, tracked := registry.IsPaused(id)
+	switch {
+	case tracked:
+		if paused {
+			snapshot.Status = StatusPaused
+		}
+	case downloadSlots.IsQueued(id):
+		snapshot.Status = StatusQueued
+	default:
+		writeJSONError(w, http.StatusNotFound, "download not found")
+		return
+	}
+
+	if download, chunked := registry.Get(id); chunked {
+		snapshot.BytesReceived, snapshot.TotalBytes = download.GetProgress()
+		snapshot.Status = download.CurrentStatus()
+		snapshot.Speed = download.Speed()
+		snapshot.ETASeconds = estimateETA(id, snapshot.BytesReceived, snapshot.TotalBytes, snapshot.Status)
+		snapshot.Chunks = download.ChunkStates()
+	}
+
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleDownloadStatus atiende GET /downloads/{id}
+func handleDownloadStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/downloads/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSONError(w, http.StatusNotFound, "download not found")
+		return
+	}
+
+	job, exists := downloadJobs.Get(id)
+	if !exists {
+		writeJSONError(w, http.StatusNotFound, "download not found")
+		return
+	}
+
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	writeJSON(w, http.StatusOK, job)
+}
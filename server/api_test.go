@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:3000", true},
+		{"http://127.0.0.1:8080", true},
+		{"http://[::1]:8080", true},
+		{"http://catchme.lan:8080", true}, // El propio servidor
+		{"https://evil.example", false},
+		{"http://localhost.evil.example", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://catchme.lan:8080/start", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := allowedOrigin(r); got != tt.want {
+				t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfineDownloadDir(t *testing.T) {
+	base := t.TempDir()
+	saved := downloadDirectory
+	downloadDirectory = base
+	defer func() { downloadDirectory = saved }()
+
+	tests := []struct {
+		name     string
+		override string
+		want     string
+		wantErr  bool
+	}{
+		{"empty keeps default", "", "", false},
+		{"base itself", base, base, false},
+		{"absolute subdirectory", filepath.Join(base, "videos"), filepath.Join(base, "videos"), false},
+		{"relative subdirectory", "videos/2024", filepath.Join(base, "videos", "2024"), false},
+		{"outside base", filepath.Dir(base), "", true},
+		{"relative escape", "../outside", "", true},
+		{"system directory", "/etc", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := confineDownloadDir(tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("confineDownloadDir(%q) error = %v, wantErr %v", tt.override, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("confineDownloadDir(%q) = %q, want %q", tt.override, got, tt.want)
+			}
+		})
+	}
+}
+
+// POST /start y POST /downloads rechazan lo que una página web podría
+// enviar entre orígenes antes de iniciar ninguna descarga
+func TestStartRejectsUntrustedRequests(t *testing.T) {
+	saved := downloadDirectory
+	downloadDirectory = t.TempDir()
+	defer func() { downloadDirectory = saved }()
+
+	body := `{"url": "http://example.com/file.zip", "download_dir": "/etc", "filename": "passwd", "overwrite": true}`
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		origin      string
+		body        string
+		want        int
+	}{
+		{"GET not allowed", http.MethodGet, "", "", "", http.StatusMethodNotAllowed},
+		{"text/plain body", http.MethodPost, "text/plain", "", body, http.StatusUnsupportedMediaType},
+		{"form body", http.MethodPost, "application/x-www-form-urlencoded", "", body, http.StatusUnsupportedMediaType},
+		{"foreign origin", http.MethodPost, "application/json", "https://evil.example", body, http.StatusForbidden},
+		{"download_dir outside base", http.MethodPost, "application/json", "", body, http.StatusForbidden},
+		{"invalid JSON", http.MethodPost, "application/json; charset=utf-8", "", "{", http.StatusBadRequest},
+	}
+
+	handlers := map[string]http.HandlerFunc{"/start": handleStart, "/downloads": handleDownloads}
+	for path, handler := range handlers {
+		for _, tt := range tests {
+			if tt.method == http.MethodGet && path == "/downloads" {
+				continue // GET /downloads lista las descargas
+			}
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				r := httptest.NewRequest(tt.method, "http://localhost:8080"+path, strings.NewReader(tt.body))
+				if tt.contentType != "" {
+					r.Header.Set("Content-Type", tt.contentType)
+				}
+				if tt.origin != "" {
+					r.Header.Set("Origin", tt.origin)
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+				if w.Code != tt.want {
+					t.Errorf("status = %d, want %d (body %s)", w.Code, tt.want, w.Body.String())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"catchme/server/download"
+)
+
+// Ajustar en caliente el número de chunks simultáneos (--auto-concurrency).
+// Desactivado por defecto: cada descarga usa siempre MaxConcurrentChunks
+var autoConcurrency = false
+
+const (
+	// Intervalo entre muestras de velocidad del ajuste de concurrencia
+	concurrencyTuneInterval = 3 * time.Second
+	// Muestras promediadas antes de decidir; tras cada cambio se vuelve a
+	// llenar la ventana para medir ya con la nueva concurrencia
+	concurrencyTuneWindow = 3
+	// Por debajo de esta fracción de la velocidad de la ventana anterior se
+	// considera congestión y se reduce la concurrencia
+	congestionDropRatio = 0.7
+	// A partir de esta fracción de la velocidad previa a la congestión se
+	// considera recuperada y se prueba con un chunk más
+	congestionRecoverRatio = 0.9
+	// Olvido por ventana de esa velocidad de referencia, para volver a probar
+	// aunque la red se haya vuelto más lenta por otros motivos
+	congestionReferenceDecay = 0.9
+)
+
+// addConcurrency añade a un evento progress la concurrencia actual de la
+// descarga: concurrency es el límite de chunks simultáneos (cambia con
+// --auto-concurrency) y active_chunks los que se están descargando
+func addConcurrency(event map[string]interface{}, download *ChunkedDownload) {
+	limit, active := download.Concurrency()
+	event["concurrency"] = limit
+	event["active_chunks"] = active
+}
+
+// startConcurrencyTuner ajusta los huecos de slots según la velocidad total
+// de la descarga. Si la velocidad media de una ventana cae claramente respecto
+// a la anterior hay congestión (demasiados chunks compitiendo) y se quita un
+// cuarto de los huecos; cuando vuelve a la de antes de la congestión se añade
+// uno, sin pasar de MaxConcurrentChunks. Con un límite de velocidad activo no
+// se toca nada: la velocidad la marca el límite, no la red. Devuelve la
+// función que lo detiene
+func startConcurrencyTuner(safeConn *SafeConn, download *ChunkedDownload, slots *download.ChunkSlots) (stop func()) {
+	done := make(chan struct{})
+	if !autoConcurrency {
+		return func() { close(done) }
+	}
+
+	go func() {
+		ticker := time.NewTicker(concurrencyTuneInterval)
+		defer ticker.Stop()
+
+		last, _ := download.GetProgress()
+		lastAt := time.Now()
+		var window []float64
+		previous := 0.0  // Media de la ventana anterior
+		reference := 0.0 // Velocidad sana, antes de la última congestión
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			downloaded, _ := download.GetProgress()
+			now := time.Now()
+			sample := float64(downloaded-last) / now.Sub(lastAt).Seconds()
+			last, lastAt = downloaded, now
+
+			limit, active := slots.Usage()
+			// Solo se mide con la concurrencia en uso: pausada, limitada o al
+			// final (sin chunks esperando) la velocidad no dice nada de ella
+			if download.IsPaused() || download.CurrentStatus() != StatusDownloading ||
+				download.Limiter.Rate() > 0 || globalRateLimiter.Rate() > 0 ||
+				active < limit || !download.HasPendingChunks() {
+				window = window[:0]
+				continue
+			}
+
+			window = append(window, sample)
+			if len(window) < concurrencyTuneWindow {
+				continue
+			}
+			speed := 0.0
+			for _, s := range window {
+				speed += s
+			}
+			speed /= float64(len(window))
+			window = window[:0]
+
+			newLimit := limit
+			switch {
+			case previous > 0 && speed < previous*congestionDropRatio && limit > 1:
+				newLimit = limit - max(limit/4, 1)
+				reference = max(reference, previous)
+			case limit >= download.MaxConcurrentChunks:
+				reference = speed
+			case speed >= reference*congestionRecoverRatio:
+				newLimit = limit + 1
+			default:
+				reference *= congestionReferenceDecay
+			}
+			previous = speed
+			if newLimit == limit {
+				continue
+			}
+
+			slots.SetLimit(newLimit)
+			log.Printf("Chunk concurrency for %s: %d -> %d (%.0f B/s)", download.URL, limit, newLimit, speed)
+			sendMessage(safeConn, "log", download.ID, fmt.Sprintf("Adjusted concurrent chunks from %d to %d (%s/s)",
+				limit, newLimit, formatBytes(int64(speed))))
+		}
+	}()
+	return func() { close(done) }
+}
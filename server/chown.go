@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Propietario que se asigna a los archivos descargados y a los directorios
+// creados (--chown user:group). -1 deja el valor sin cambiar
+var (
+	chownUID = -1
+	chownGID = -1
+)
+
+// parseChownSpec resuelve "user[:group]" (nombres o IDs numéricos) a uid/gid
+func parseChownSpec(spec string) (int, int, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	uid := -1
+	if userPart != "" {
+		if id, err := strconv.Atoi(userPart); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(userPart)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unknown user %q: %v", userPart, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+			// Sin grupo explícito usar el grupo principal del usuario
+			if !hasGroup {
+				groupPart = u.Gid
+			}
+		}
+	}
+
+	gid := -1
+	if groupPart != "" {
+		if id, err := strconv.Atoi(groupPart); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(groupPart)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unknown group %q: %v", groupPart, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
+	if uid < 0 && gid < 0 {
+		return -1, -1, fmt.Errorf("empty owner specification %q", spec)
+	}
+	return uid, gid, nil
+}
+
+// chownEnabled indica si hay que ajustar la propiedad de los archivos
+func chownEnabled() bool {
+	return chownUID >= 0 || chownGID >= 0
+}
+
+// makeDownloadDir crea el directorio de descargas y, si no existía, le asigna
+// el propietario configurado junto con los directorios padre que se crearon
+func makeDownloadDir(dir string) error {
+	// Buscar el primer ancestro existente para saber qué directorios son nuevos
+	var created []string
+	for current := filepath.Clean(dir); ; current = filepath.Dir(current) {
+		if _, err := os.Stat(current); err == nil {
+			break
+		}
+		created = append(created, current)
+		if parent := filepath.Dir(current); parent == current {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	applyOwnership(created...)
+	return nil
+}
+
+// applyOwnership asigna el propietario configurado a las rutas indicadas. Sin
+// privilegios suficientes (o en Windows) solo registra un aviso
+func applyOwnership(paths ...string) {
+	if !chownEnabled() {
+		return
+	}
+
+	if runtime.GOOS == "windows" {
+		log.Printf("Warning: --chown is not supported on Windows, leaving ownership unchanged")
+		return
+	}
+
+	for _, path := range paths {
+		if err := os.Chown(path, chownUID, chownGID); err != nil {
+			if os.IsPermission(err) {
+				log.Printf("Warning: insufficient privileges to change owner of %s (run as root): %v", path, err)
+			} else {
+				log.Printf("Warning: failed to change owner of %s: %v", path, err)
+			}
+		}
+	}
+}
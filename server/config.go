@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// fileConfig es el contenido del archivo JSON de --config. Cada campo
+// equivale al flag del mismo nombre (max_downloads -> --max-downloads) y los
+// ausentes conservan el valor por defecto. Un booleano a false no desactiva
+// nada: solo equivale a no pasar el flag
+type fileConfig struct {
+	Port                *int    `json:"port"`
+	DownloadDir         *string `json:"download_dir"`
+	TempDir             *string `json:"temp_dir"`
+	MaxDownloads        *int    `json:"max_downloads"`
+	MaxChecksums        *int    `json:"max_checksums"`
+	MergeConcurrency    *int    `json:"merge_concurrency"`
+	ReadBuffer          *int    `json:"read_buffer"`
+	TCPRcvbuf           *int    `json:"tcp_rcvbuf"`
+	RotateEdges         *int    `json:"rotate_edges"`
+	DirectWrite         *bool   `json:"direct_write"`
+	AutoConcurrency     *bool   `json:"auto_concurrency"`
+	IndividualChunkInit *bool   `json:"individual_chunk_init"`
+	NoUIDelays          *bool   `json:"no_ui_delays"`
+	RetryStrategy       *string `json:"retry_strategy"`
+	RetryBase           *string `json:"retry_base"`
+	RetryMax            *string `json:"retry_max"`
+	RetryJitter         *bool   `json:"retry_jitter"`
+	MaxRetries          *int    `json:"max_retries"`
+	HeadRetries         *int    `json:"head_retries"`
+	UserAgent           *string `json:"user_agent"`
+	ChunkTimeout        *string `json:"chunk_timeout"`
+	StuckTimeout        *string `json:"stuck_timeout"`
+	MaxRate             *int64  `json:"max_rate"`
+	HTTP1               *bool   `json:"http1"`
+	InsecureSkipVerify  *bool   `json:"insecure_skip_verify"`
+	CACert              *string `json:"ca_cert"`
+	Proxy               *string `json:"proxy"`
+	LogFormat           *string `json:"log_format"`
+	LogMaxSize          *int64  `json:"log_max_size"`
+	LogMaxFiles         *int    `json:"log_max_files"`
+	WebhookURL          *string `json:"webhook_url"`
+	Chown               *string `json:"chown"`
+	Notify              *bool   `json:"notify"`
+}
+
+// loadConfigFile lee el archivo de configuración. Si no existe se devuelve
+// una configuración vacía (valores por defecto)
+func loadConfigFile(path string) (*fileConfig, error) {
+	cfg := &fileConfig{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Config file %s not found, using defaults", path)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded config file %s", path)
+	return cfg, nil
+}
+
+// args convierte la configuración en los flags equivalentes, para validarla
+// con el mismo código que la línea de comandos
+func (c *fileConfig) args() []string {
+	var args []string
+	value := reflect.ValueOf(c).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.IsNil() {
+			continue
+		}
+		name := "--" + strings.ReplaceAll(value.Type().Field(i).Tag.Get("json"), "_", "-")
+		if enabled, ok := field.Elem().Interface().(bool); ok {
+			if enabled {
+				args = append(args, name)
+			}
+			continue
+		}
+		args = append(args, name, fmt.Sprint(field.Elem().Interface()))
+	}
+	return args
+}
+
+// configPath busca --config <ruta> o --config=<ruta> en los argumentos
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if path, ok := strings.CutPrefix(arg, "--config="); ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// commandLineArgs devuelve los argumentos a analizar: los del archivo de
+// configuración primero, para que los flags de la línea de comandos, que se
+// aplican después, tengan prioridad
+func commandLineArgs() []string {
+	args := os.Args[1:]
+	path := configPath(args)
+	if path == "" {
+		return args
+	}
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		log.Fatalf("Invalid config file %s: %v", path, err)
+	}
+	return append(cfg.args(), args...)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Bytes que mira http.DetectContentType para adivinar el tipo
+const sniffLength = 512
+
+// Extensiones que sí pueden ser una página HTML legítima
+var htmlExtensions = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true,
+	".php": true, ".asp": true, ".aspx": true, ".jsp": true,
+}
+
+// contentTypeMatches compara el Content-Type recibido con el esperado.
+// expected admite comodín de subtipo ("video/*")
+func contentTypeMatches(expected, header string) bool {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	if prefix, ok := strings.CutSuffix(expected, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return mediaType == expected
+}
+
+// isHTMLType indica si un Content-Type es una página HTML
+func isHTMLType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// sniffContent pide los primeros bytes del archivo y devuelve el Content-Type
+// que envía el servidor en el GET y el que se deduce del contenido
+func sniffContent(client *http.Client, rawURL string, creds Credentials) (header, sniffed string, err error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", sniffLength-1))
+	applyCredentials(req, creds)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	head, err := io.ReadAll(io.LimitReader(resp.Body, sniffLength))
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Header.Get("Content-Type"), http.DetectContentType(head), nil
+}
+
+// checkContentType aplica expected_content_type y avisa si el servidor
+// devuelve HTML para un nombre que no es una página: suele ser una página de
+// error con código 200 de un enlace caducado. Devuelve false si la descarga
+// se rechaza
+func checkContentType(safeConn *SafeConn, id, filename, expected, header, sniffed string) bool {
+	url := downloadIDs.URL(id)
+	contentType := header
+	if contentType == "" {
+		contentType = sniffed
+	}
+
+	if expected != "" && !contentTypeMatches(expected, contentType) {
+		log.Printf("Rejecting %s: content type %q, expected %q", url, contentType, expected)
+		sendError(safeConn, id, ErrorCodeContentTypeMismatch,
+			fmt.Sprintf("Server returned content type %q, expected %q", contentType, expected))
+		return false
+	}
+
+	if (isHTMLType(header) || isHTMLType(sniffed)) && !htmlExtensions[strings.ToLower(filepath.Ext(filename))] {
+		log.Printf("Server returned HTML for %s (Content-Type %q, sniffed %q)", url, header, sniffed)
+		sendMessage(safeConn, "log", id, fmt.Sprintf(
+			"⚠️ The server returned an HTML page for %s (Content-Type: %s); the link may have expired", filename, contentType))
+	}
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "errors"
+
+// freeDiskSpace no está soportado en esta plataforma
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space check is not supported on this platform")
+}
+
+// isDiskFull no distingue el disco lleno en esta plataforma
+func isDiskFull(err error) bool {
+	return false
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// freeDiskSpace devuelve los bytes disponibles para usuarios normales en el
+// sistema de archivos de dir
+func freeDiskSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
+
+// isDiskFull indica si err se debe a que no queda espacio en el disco
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Margen libre que se deja en disco además del archivo
+const diskSpaceMargin int64 = 64 * 1024 * 1024
+
+// checkFileSize aplica max_file_size (0 = sin límite)
+func checkFileSize(size, maxSize int64) error {
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("file is %s, larger than the allowed %s", formatBytes(size), formatBytes(maxSize))
+	}
+	return nil
+}
+
+// checkDiskSpace comprueba que caben los chunks y el archivo final. Durante
+// el merge conviven los dos, así que si comparten sistema de archivos hace
+// falta el doble. En modo directo solo se escribe el archivo final
+func checkDiskSpace(d *ChunkedDownload, tempBase string) error {
+	size := d.RequestedBytes()
+	if d.DirectWrite {
+		return ensureFreeSpace(d.DownloadDir, size)
+	}
+
+	same, err := sameFilesystem(tempBase, d.DownloadDir)
+	if err != nil {
+		log.Printf("Could not compare filesystems of %s and %s: %v", tempBase, d.DownloadDir, err)
+	}
+	if same {
+		return ensureFreeSpace(d.DownloadDir, 2*size)
+	}
+	if err := ensureFreeSpace(tempBase, size); err != nil {
+		return err
+	}
+	return ensureFreeSpace(d.DownloadDir, size)
+}
+
+// ensureFreeSpace falla si en dir no quedan needed bytes más el margen. Si el
+// espacio libre no se puede consultar solo se registra un aviso
+func ensureFreeSpace(dir string, needed int64) error {
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		log.Printf("Could not check free space in %s: %v", dir, err)
+		return nil
+	}
+	if needed+diskSpaceMargin > free {
+		return fmt.Errorf("not enough disk space in %s: %s needed, %s free",
+			dir, formatBytes(needed), formatBytes(free))
+	}
+	return nil
+}
+
+// diskErrorCode distingue el disco lleno (ver isDiskFull) de los demás
+// fallos de escritura
+func diskErrorCode(err error) string {
+	if isDiskFull(err) {
+		return ErrorCodeDiskFull
+	}
+	return ErrorCodeDiskError
+}
+
+// handleDiskError da por fallida una descarga que no pudo escribir en disco.
+// Los temporales se conservan como en cualquier otro fallo
+func handleDiskError(safeConn *SafeConn, download *ChunkedDownload, err error) {
+	log.Printf("Disk error for %s: %v", download.URL, err)
+	msg := fmt.Sprintf("Download failed: %v", err)
+	sendError(safeConn, download.ID, diskErrorCode(err), msg)
+	reportFinalStatus(safeConn, download, StatusFailed)
+	notifyDownloadFailed(download, msg)
+}
+
+// formatBytes formatea un tamaño en unidades binarias
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,32 @@
+package download
+
+import (
+	"crypto"
+	_ "crypto/md5" // Registrar los hashes admitidos
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// Algoritmo de checksum por defecto cuando no se indica ninguno
+const DefaultChecksumAlgorithm = "sha256"
+
+// ChecksumAlgorithms son los algoritmos de checksum admitidos
+var ChecksumAlgorithms = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+}
+
+// ChecksumHash devuelve el hash del algoritmo indicado ("" = SHA-256)
+func ChecksumHash(algo string) (crypto.Hash, error) {
+	if algo == "" {
+		algo = DefaultChecksumAlgorithm
+	}
+	h, ok := ChecksumAlgorithms[strings.ToLower(algo)]
+	if !ok || !h.Available() {
+		return 0, fmt.Errorf("unsupported checksum algorithm %q (use sha256, sha1 or md5)", algo)
+	}
+	return h, nil
+}
@@ -0,0 +1,867 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultChunkSize es el tamaño de chunk si NewChunkedDownload recibe 0
+	DefaultChunkSize int64 = 5 * 1024 * 1024
+	// DefaultConcurrentChunks es el número de chunks descargados a la vez de
+	// una descarga nueva
+	DefaultConcurrentChunks = 8
+)
+
+// ChunkStatus representa el estado de un chunk
+type ChunkStatus string
+
+const (
+	ChunkPending   ChunkStatus = "pending"
+	ChunkActive    ChunkStatus = "active"
+	ChunkCompleted ChunkStatus = "completed"
+	ChunkFailed    ChunkStatus = "failed"
+	ChunkPaused    ChunkStatus = "paused"
+)
+
+// DownloadStatus representa el estado de una descarga completa tal como se
+// reporta al cliente. completed, failed y canceled son estados terminales;
+// failed_recoverable conserva los chunks para repetir con retry_download
+type DownloadStatus string
+
+const (
+	StatusQueued            DownloadStatus = "queued"
+	StatusStarting          DownloadStatus = "starting"
+	StatusDownloading       DownloadStatus = "downloading"
+	StatusPaused            DownloadStatus = "paused"
+	StatusCompleted         DownloadStatus = "completed"
+	StatusFailed            DownloadStatus = "failed"
+	StatusFailedRecoverable DownloadStatus = "failed_recoverable"
+	StatusCanceled          DownloadStatus = "canceled"
+)
+
+// IsTerminal indica si la descarga ya no puede avanzar
+func (s DownloadStatus) IsTerminal() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCanceled
+}
+
+// Chunk representa una parte de un archivo a descargar. Name es relativo al
+// TempDir de la descarga para que el directorio temporal pueda reubicarse
+type Chunk struct {
+	ID        int
+	Start     int64
+	End       int64
+	Name      string
+	Status    ChunkStatus
+	Progress  int64
+	Error     string
+	mu        sync.Mutex
+	cancelCtx chan struct{}
+	resumeCh  chan struct{} // Abierto mientras el chunk está pausado con PauseChunk
+	readDone  chan struct{} // Se cierra cuando el lector del intento actual termina
+	meter     SpeedMeter
+	source    int // Origen actual: 0 la URL principal, n el mirror Mirrors[n-1]
+}
+
+// ChunkProgress representa el progreso de un chunk para reportar al cliente
+type ChunkProgress struct {
+	ID        int         `json:"id"`
+	Start     int64       `json:"start"`
+	End       int64       `json:"end"`
+	Progress  int64       `json:"progress"`
+	Status    ChunkStatus `json:"status"`
+	Speed     float64     `json:"speed"`
+	Percent   float64     `json:"percent"`   // Progress respecto al tamaño del chunk (0-100)
+	Completed int64       `json:"completed"` // End+1, solo en el chunk_progress final del chunk (0 en el resto)
+}
+
+// chunkPercent calcula el porcentaje completado de un chunk con dos decimales
+func chunkPercent(start, end, progress int64) float64 {
+	size := end - start + 1
+	if size <= 0 {
+		return 0
+	}
+	return math.Round(float64(progress)*10000/float64(size)) / 100
+}
+
+// ChunkedDownload representa una descarga dividida en múltiples chunks
+type ChunkedDownload struct {
+	// Id asignado por el servidor al aceptar la descarga; vacío con Download
+	ID  string
+	URL string
+	// URL final tras las redirecciones, usada por las peticiones de rango.
+	// No se persiste: tras reiniciar los chunks se piden a URL otra vez
+	ResolvedURL string
+	Filename    string
+	Size        int64
+	ChunkSize   int64
+	TempDir     string
+	// Raíz temporal propia (temp_dir); vacío usa la del servidor
+	TempBase string
+	// Los chunks escriben en PartPath() en lugar de en TempDir (ver directwrite.go)
+	DirectWrite bool
+	// Directorio donde se deja el archivo final y si se puede sobrescribir
+	DownloadDir string
+	Overwrite   bool
+	Chunks      []*Chunk
+	Ranges      []ByteRange // Rangos solicitados; vacío para el archivo completo
+	Complete    bool
+	Paused      bool
+	Status      DownloadStatus
+	StartedAt   time.Time
+	// Límites de ancho de banda: el de esta descarga y uno compartido con
+	// otras (--max-rate). Nil no limita; la tasa efectiva es el mínimo
+	Limiter       *RateLimiter
+	SharedLimiter *RateLimiter
+	// Nodo de la CDN fijado y fallos seguidos de un chunk antes de rotarlo
+	// (ver RotateEdges); nil sin rotación
+	edges        *edgePool
+	edgeRotation int
+	// Validadores de la respuesta inicial, enviados en If-Range (ver remotechange.go)
+	ETag         string
+	LastModified string
+	resumed      bool // Se reanudó tras una pausa o un reinicio del servidor
+	// Protocolo negociado (HTTP/1.1, HTTP/2.0) y el pedido por el cliente
+	// ("" = auto, "http1" o "http2")
+	Protocol     string
+	HTTPProtocol string
+	// Credenciales aplicadas a cada petición, también tras reanudar
+	Credentials Credentials
+	// UserAgentFor elige el User-Agent de cada petición a url a partir del
+	// propio de la descarga (Credentials.UserAgent, vacío si no hay). Nil
+	// envía ese tal cual
+	UserAgentFor func(override, url string) string
+	// Proxy propio de la descarga (no se persiste, igual que las credenciales)
+	Proxy string
+	// Webhook propio de la descarga (tampoco se persiste: puede llevar un token)
+	Webhook string
+	// URLs alternativas con el mismo archivo, probadas en orden por cada
+	// chunk que agota sus reintentos (ver mirrors.go)
+	Mirrors []string
+	// Checksum esperado tras el merge (vacío = sin verificación)
+	ExpectedChecksum  string
+	ChecksumAlgorithm string
+	// Sin pausas cosméticas entre los mensajes del servidor
+	FastMode bool
+	// Número máximo de chunks descargados a la vez
+	MaxConcurrentChunks int
+	// Número máximo de chunks copiados en paralelo por MergeChunks
+	MergeConcurrency int
+	// Reintentos y tiempos límite de los chunks (ver retry.go)
+	Retry      RetryConfig
+	mu         sync.RWMutex
+	cancelChan chan struct{}
+	// Lectores de chunk activos, para repartir el límite de velocidad
+	activeReaders int32
+	// Semáforo de la tanda de chunks en curso (ver slots.go)
+	slots atomic.Pointer[ChunkSlots]
+	// Última escritura del manifiesto (ver manifest.go)
+	manifestMu    sync.Mutex
+	manifestSaved time.Time
+	// Checksums calculados por el último merge secuencial (ver mergehash.go)
+	sumsMu    sync.Mutex
+	mergeSums map[string]string
+}
+
+// NewChunkedDownload crea una nueva descarga dividida en chunks
+func NewChunkedDownload(url, filename string, size int64, chunkSize int64) *ChunkedDownload {
+	// Si no se especifica un tamaño de chunk, usar un valor predeterminado
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	return &ChunkedDownload{
+		URL:        url,
+		Filename:   filename,
+		Size:       size,
+		ChunkSize:  chunkSize,
+		TempDir:    filepath.Join(os.TempDir(), "catchme", filename),
+		Status:     StatusStarting,
+		StartedAt:  time.Now(),
+		cancelChan: make(chan struct{}),
+		// Valores por defecto; el servidor aplica los de su configuración
+		MaxConcurrentChunks: DefaultConcurrentChunks,
+		MergeConcurrency:    1,
+		Retry:               DefaultRetryConfig(),
+	}
+}
+
+// Lock, Unlock, RLock y RUnlock protegen los campos exportados que cambian
+// mientras se descarga (Status, Credentials, Proxy, TempDir...), para leer o
+// cambiar varios de una vez
+func (d *ChunkedDownload) Lock()    { d.mu.Lock() }
+func (d *ChunkedDownload) Unlock()  { d.mu.Unlock() }
+func (d *ChunkedDownload) RLock()   { d.mu.RLock() }
+func (d *ChunkedDownload) RUnlock() { d.mu.RUnlock() }
+
+// SetStatus actualiza el estado de la descarga
+func (d *ChunkedDownload) SetStatus(status DownloadStatus) {
+	d.mu.Lock()
+	d.Status = status
+	d.mu.Unlock()
+}
+
+// CurrentStatus devuelve el estado actual de la descarga
+func (d *ChunkedDownload) CurrentStatus() DownloadStatus {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Status
+}
+
+// requestURL devuelve la URL a la que se piden los chunks. Como URL, no
+// cambia una vez empezada la descarga y se lee sin el mutex
+func (d *ChunkedDownload) requestURL() string {
+	if d.ResolvedURL != "" {
+		return d.ResolvedURL
+	}
+	return d.URL
+}
+
+// SetPaused actualiza el flag de pausa de la descarga
+func (d *ChunkedDownload) SetPaused(paused bool) {
+	d.mu.Lock()
+	d.Paused = paused
+	d.mu.Unlock()
+}
+
+// IsPaused indica si la descarga está pausada. Los bucles de lectura lo
+// consultan sin parar, así que nunca se debe leer d.Paused sin el mutex
+func (d *ChunkedDownload) IsPaused() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Paused
+}
+
+// ChunkPath reconstruye la ruta absoluta del archivo temporal de un chunk a
+// partir del TempDir actual de la descarga
+func (d *ChunkedDownload) ChunkPath(chunk *Chunk) string {
+	return filepath.Join(d.TempDir, chunk.Name)
+}
+
+// RelocateTempDir apunta la descarga a un nuevo directorio temporal. Como los
+// chunks guardan rutas relativas, basta con actualizar la base
+func (d *ChunkedDownload) RelocateTempDir(tempDir string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.TempDir != tempDir {
+		log.Printf("Temp directory for %s relocated: %s -> %s", d.Filename, d.TempDir, tempDir)
+		d.TempDir = tempDir
+	}
+}
+
+// PrepareChunks divide la descarga en chunks
+func (d *ChunkedDownload) PrepareChunks() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Crear directorio temporal para chunks
+	if err := os.MkdirAll(d.TempDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+
+	// Sin rangos explícitos se descarga el archivo entero como un único rango
+	ranges := d.Ranges
+	if len(ranges) == 0 {
+		ranges = []ByteRange{{Start: 0, End: d.Size - 1}}
+	}
+
+	// Dividir cada rango en chunks
+	var chunks []*Chunk
+	for _, r := range ranges {
+		for start := r.Start; start <= r.End; start += d.ChunkSize {
+			end := start + d.ChunkSize - 1
+			if end > r.End {
+				end = r.End
+			}
+
+			chunk := &Chunk{
+				ID:        len(chunks),
+				Start:     start,
+				End:       end,
+				Name:      fmt.Sprintf("chunk_%d", len(chunks)),
+				Status:    ChunkPending,
+				cancelCtx: make(chan struct{}),
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	d.Chunks = chunks
+	return nil
+}
+
+// MergeChunks combina todos los chunks en un archivo final
+func (d *ChunkedDownload) MergeChunks(destPath string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	d.setMergeChecksums(nil)
+
+	// Verificar que todos los chunks estén completos
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		if chunk.Status != ChunkCompleted {
+			chunk.mu.Unlock()
+			return fmt.Errorf("chunk %d not completed", chunk.ID)
+		}
+		chunk.mu.Unlock()
+	}
+
+	// Crear directorio de destino si no existe
+	dir := filepath.Dir(destPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// En modo directo los datos ya están en su sitio
+	if d.DirectWrite {
+		return d.finishDirectWrite(destPath)
+	}
+
+	// Con concurrencia > 1 copiar los chunks en paralelo sobre un destino
+	// preasignado. Las descargas por rangos siempre escriben por offset para
+	// dejar huecos (archivo disperso) fuera de los rangos pedidos
+	if (d.MergeConcurrency > 1 && len(d.Chunks) > 1) || len(d.Ranges) > 0 {
+		if err := d.mergeChunksConcurrent(destPath, max(d.MergeConcurrency, 1)); err != nil {
+			return err
+		}
+		d.Complete = true
+		return nil
+	}
+
+	// Retomar un merge interrumpido: los chunks ya escritos forman un prefijo
+	// del destino que se conserva si su tamaño en disco lo respalda
+	state := d.loadMergeState(destPath)
+	resumeFrom, offset := 0, int64(0)
+	for _, chunk := range d.Chunks {
+		if !state.IsMerged(chunk.ID) {
+			break
+		}
+		resumeFrom++
+		offset += chunk.End - chunk.Start + 1
+	}
+
+	// Los chunks se escriben en orden: calcular el checksum sobre la marcha
+	hasher := d.newMergeHasher()
+
+	var destFile *os.File
+	var err error
+	if resumeFrom > 0 {
+		destFile, err = d.openPartialMerge(destPath, offset)
+		if err != nil {
+			log.Printf("Cannot resume merge of %s, restarting: %v", destPath, err)
+			resumeFrom, offset = 0, 0
+		} else {
+			log.Printf("Resuming merge of %s from chunk %d (%d bytes already written)",
+				destPath, resumeFrom, offset)
+			if err := hasher.hashPrefix(destPath, offset); err != nil {
+				log.Printf("Cannot hash merged prefix of %s, checksum will be computed later: %v", destPath, err)
+				hasher = nil
+			}
+		}
+	}
+	if destFile == nil {
+		// Crear archivo de destino
+		state.Reset()
+		destFile, err = os.Create(destPath)
+		if err != nil {
+			return err
+		}
+	}
+	defer destFile.Close()
+
+	var dest io.Writer = destFile
+	if hasher != nil {
+		dest = io.MultiWriter(destFile, hasher)
+	}
+
+	// Escribir cada chunk pendiente en el archivo de destino
+	for _, chunk := range d.Chunks[resumeFrom:] {
+		chunkFile, err := os.Open(d.ChunkPath(chunk))
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(dest, chunkFile)
+		chunkFile.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := state.MarkMerged(chunk.ID); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// Verificar tamaño final
+	info, err := destFile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.Size {
+		state.Reset()
+		return fmt.Errorf("size mismatch: expected %d, got %d", d.Size, info.Size())
+	}
+
+	state.Remove()
+	if hasher != nil {
+		d.setMergeChecksums(hasher.Sums())
+	}
+	d.Complete = true
+	return nil
+}
+
+// openPartialMerge abre un destino parcialmente unido y lo posiciona al final
+// de la parte ya escrita, descartando cualquier resto a medio escribir
+func (d *ChunkedDownload) openPartialMerge(destPath string, offset int64) (*os.File, error) {
+	info, err := os.Stat(destPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < offset {
+		return nil, fmt.Errorf("destination has %d bytes, expected at least %d", info.Size(), offset)
+	}
+
+	destFile, err := os.OpenFile(destPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := destFile.Truncate(offset); err != nil {
+		destFile.Close()
+		return nil, err
+	}
+	if _, err := destFile.Seek(offset, io.SeekStart); err != nil {
+		destFile.Close()
+		return nil, err
+	}
+	return destFile, nil
+}
+
+// mergeChunksConcurrent copia los chunks en paralelo, cada uno en su offset
+// dentro de un archivo destino preasignado con el tamaño final.
+// Se debe llamar con d.mu tomado en lectura.
+func (d *ChunkedDownload) mergeChunksConcurrent(destPath string, workers int) error {
+	// Si hay un merge previo hacia el mismo destino se reutiliza el archivo y
+	// solo se copian los chunks que faltan
+	state := d.loadMergeState(destPath)
+	flags := os.O_CREATE | os.O_WRONLY
+	if len(state.Merged) == 0 {
+		flags |= os.O_TRUNC
+	} else {
+		log.Printf("Resuming concurrent merge of %s (%d/%d chunks already written)",
+			destPath, len(state.Merged), len(d.Chunks))
+	}
+
+	destFile, err := os.OpenFile(destPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	// Preasignar el tamaño final para que cada WriteAt caiga dentro del archivo
+	if err := destFile.Truncate(d.Size); err != nil {
+		return fmt.Errorf("failed to preallocate destination: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	errs := make(chan error, len(d.Chunks))
+
+	for _, chunk := range d.Chunks {
+		if state.IsMerged(chunk.ID) {
+			continue
+		}
+		currentChunk := chunk
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			chunkFile, err := os.Open(d.ChunkPath(currentChunk))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer chunkFile.Close()
+
+			// Escribir el chunk exactamente en su rango del archivo final
+			expected := currentChunk.End - currentChunk.Start + 1
+			written, err := io.Copy(io.NewOffsetWriter(destFile, currentChunk.Start), chunkFile)
+			if err != nil {
+				errs <- fmt.Errorf("chunk %d: %v", currentChunk.ID, err)
+				return
+			}
+			if written != expected {
+				errs <- fmt.Errorf("chunk %d size mismatch: expected %d, got %d",
+					currentChunk.ID, expected, written)
+				return
+			}
+
+			if err := state.MarkMerged(currentChunk.ID); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	// Verificar tamaño final (el Truncate no garantiza que todo se haya escrito)
+	info, err := destFile.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.Size {
+		state.Reset()
+		return fmt.Errorf("size mismatch: expected %d, got %d", d.Size, info.Size())
+	}
+
+	if err := destFile.Sync(); err != nil {
+		return err
+	}
+	state.Remove()
+	return nil
+}
+
+// chunkByID busca un chunk por su ID
+func (d *ChunkedDownload) chunkByID(chunkID int) *Chunk {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, chunk := range d.Chunks {
+		if chunk.ID == chunkID {
+			return chunk
+		}
+	}
+	return nil
+}
+
+// PauseChunk pausa un chunk específico. Su worker no termina: espera en
+// waitChunkResume a que ResumeChunk lo reanude, sin afectar a los demás
+func (d *ChunkedDownload) PauseChunk(chunkID int) error {
+	chunk := d.chunkByID(chunkID)
+	if chunk == nil {
+		return fmt.Errorf("chunk %d not found", chunkID)
+	}
+
+	chunk.mu.Lock()
+	defer chunk.mu.Unlock()
+	if chunk.Status != ChunkActive {
+		return fmt.Errorf("chunk %d is %s, only active chunks can be paused", chunkID, chunk.Status)
+	}
+	close(chunk.cancelCtx)
+	chunk.Status = ChunkPaused
+	chunk.resumeCh = make(chan struct{})
+	return nil
+}
+
+// ResumeChunk reanuda un chunk pausado con PauseChunk
+func (d *ChunkedDownload) ResumeChunk(chunkID int) error {
+	chunk := d.chunkByID(chunkID)
+	if chunk == nil {
+		return fmt.Errorf("chunk %d not found", chunkID)
+	}
+
+	chunk.mu.Lock()
+	defer chunk.mu.Unlock()
+	if chunk.Status != ChunkPaused || chunk.resumeCh == nil {
+		return fmt.Errorf("chunk %d is not paused", chunkID)
+	}
+	chunk.cancelCtx = make(chan struct{})
+	chunk.Status = ChunkActive
+	close(chunk.resumeCh)
+	chunk.resumeCh = nil
+	return nil
+}
+
+// waitChunkResume bloquea el worker de un chunk pausado con PauseChunk hasta
+// que se reanude. Devuelve false si el chunk no estaba pausado por sí solo, o
+// si entretanto se pausó o canceló la descarga entera (el worker debe salir)
+func (d *ChunkedDownload) waitChunkResume(chunk *Chunk) bool {
+	chunk.mu.Lock()
+	resume := chunk.resumeCh
+	chunk.mu.Unlock()
+	if resume == nil {
+		return false
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-resume:
+			return true
+		case <-ticker.C:
+			if d.IsPaused() || d.CurrentStatus().IsTerminal() {
+				chunk.mu.Lock()
+				chunk.resumeCh = nil
+				chunk.mu.Unlock()
+				return false
+			}
+		}
+	}
+}
+
+// ChunkState devuelve el estado actual de un chunk
+func (d *ChunkedDownload) ChunkState(chunkID int) (ChunkProgress, bool) {
+	for _, state := range d.ChunkStates() {
+		if state.ID == chunkID {
+			return state, true
+		}
+	}
+	return ChunkProgress{}, false
+}
+
+// Tiempo máximo que PauseAllChunks espera a que los lectores de los chunks
+// dejen de escribir
+const pauseAckTimeout = 5 * time.Second
+
+// PauseAllChunks pausa todos los chunks y espera (como mucho pauseAckTimeout)
+// a que sus lectores terminen, para que una reanudación no abra el mismo
+// archivo mientras el lector anterior aún escribe en él
+func (d *ChunkedDownload) PauseAllChunks() {
+	d.SetPaused(true)
+
+	var pending []chan struct{}
+	d.mu.RLock()
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		if chunk.Status == ChunkActive {
+			close(chunk.cancelCtx)
+			chunk.cancelCtx = make(chan struct{}) // Nuevo canal para futura reanudación
+			chunk.Status = ChunkPaused
+			if chunk.readDone != nil {
+				pending = append(pending, chunk.readDone)
+			}
+		}
+		chunk.mu.Unlock()
+	}
+	d.mu.RUnlock()
+
+	// Los lectores toman d.mu para informar del progreso: se espera sin él
+	deadline := time.NewTimer(pauseAckTimeout)
+	defer deadline.Stop()
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-deadline.C:
+			log.Printf("Warning: chunk readers of %s still running %v after pause", d.URL, pauseAckTimeout)
+			return
+		}
+	}
+}
+
+// ResetPendingChunks prepara los chunks sin terminar para una nueva tanda
+// de workers (reanudación o reintento): vuelven a pending, sin error y con
+// un canal de cancelación nuevo. Devuelve esos chunks
+func (d *ChunkedDownload) ResetPendingChunks() []*Chunk {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var pending []*Chunk
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		if chunk.Status != ChunkCompleted {
+			chunk.Status = ChunkPending
+			chunk.Error = ""
+			chunk.cancelCtx = make(chan struct{})
+			pending = append(pending, chunk)
+		}
+		chunk.mu.Unlock()
+	}
+	return pending
+}
+
+// ChunkStates devuelve una copia del estado actual de cada chunk
+func (d *ChunkedDownload) ChunkStates() []ChunkProgress {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	states := make([]ChunkProgress, 0, len(d.Chunks))
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		states = append(states, ChunkProgress{
+			ID:       chunk.ID,
+			Start:    chunk.Start,
+			End:      chunk.End,
+			Progress: chunk.Progress,
+			Status:   chunk.Status,
+			Percent:  chunkPercent(chunk.Start, chunk.End, chunk.Progress),
+		})
+		chunk.mu.Unlock()
+	}
+	return states
+}
+
+// GetProgress obtiene el progreso general de la descarga
+func (d *ChunkedDownload) GetProgress() (downloaded int64, total int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	total = d.requestedBytes()
+	allCompleted := len(d.Chunks) > 0
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		chunkSize := chunk.End - chunk.Start + 1
+		if chunk.Status == ChunkCompleted {
+			downloaded += chunkSize
+		} else {
+			// Un chunk sin terminar nunca aporta más que su tamaño ni
+			// cuenta como completo aunque haya llegado hasta el final
+			progress := chunk.Progress
+			if progress > chunkSize {
+				progress = chunkSize
+			}
+			if progress > 0 {
+				downloaded += progress
+			}
+			allCompleted = false
+		}
+		chunk.mu.Unlock()
+	}
+
+	// El 100% se reserva para cuando todos los chunks están terminados
+	if !allCompleted && downloaded >= total && total > 0 {
+		downloaded = total - 1
+	}
+	return
+}
+
+// IsComplete verifica si la descarga está completa
+func (d *ChunkedDownload) IsComplete() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.Chunks) == 0 {
+		return false
+	}
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		completed := chunk.Status == ChunkCompleted
+		chunk.mu.Unlock()
+		if !completed {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestedBytes devuelve el total de bytes a transferir: el tamaño del archivo
+// o la suma de los rangos solicitados
+func (d *ChunkedDownload) RequestedBytes() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.requestedBytes()
+}
+
+// requestedBytes es RequestedBytes con d.mu ya tomado
+func (d *ChunkedDownload) requestedBytes() int64 {
+	if len(d.Ranges) == 0 {
+		return d.Size
+	}
+	var total int64
+	for _, r := range d.Ranges {
+		total += r.Length()
+	}
+	return total
+}
+
+// Cleanup elimina archivos temporales. El manifiesto se borra primero para que
+// un borrado a medias no deje una descarga que se restauraría al reiniciar
+func (d *ChunkedDownload) Cleanup() error {
+	if d.DirectWrite {
+		if err := os.Remove(d.PartPath()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove %s: %v", d.PartPath(), err)
+		}
+	}
+	if err := os.Remove(filepath.Join(d.TempDir, manifestFile)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove manifest for %s: %v", d.Filename, err)
+	}
+	return os.RemoveAll(d.TempDir)
+}
+
+// InvalidChunkFiles compara el tamaño en disco de cada archivo de chunk con
+// End-Start+1. Los que no coinciden se vacían y vuelven a ChunkPending para
+// descargarlos de nuevo. En modo directo no hay archivos que comprobar
+func (d *ChunkedDownload) InvalidChunkFiles() []*Chunk {
+	if d.DirectWrite {
+		return nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var invalid []*Chunk
+	for _, chunk := range d.Chunks {
+		path := d.ChunkPath(chunk)
+		expected := chunk.End - chunk.Start + 1
+		if info, err := os.Stat(path); err == nil && info.Size() == expected {
+			continue
+		}
+
+		if err := os.Truncate(path, 0); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to reset chunk file %s: %v", path, err)
+		}
+		chunk.mu.Lock()
+		chunk.Status = ChunkPending
+		chunk.Progress = 0
+		chunk.mu.Unlock()
+		invalid = append(invalid, chunk)
+	}
+	return invalid
+}
+
+// RestartChunk descarta lo descargado de un chunk para volver a pedirlo desde
+// su primer byte. En escritura directa basta con poner el progreso a 0: la
+// región del .part se sobrescribe
+func (d *ChunkedDownload) RestartChunk(chunk *Chunk) error {
+	if !d.DirectWrite {
+		path := d.ChunkPath(chunk)
+		if err := os.Truncate(path, 0); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to reset chunk file %s: %v", path, err)
+		}
+	}
+
+	chunk.mu.Lock()
+	chunk.Progress = 0
+	chunk.Error = ""
+	chunk.mu.Unlock()
+
+	if err := d.SaveManifest(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// markCompleted marca el chunk como completo al llegar EOF. Devuelve false si
+// la conexión terminó antes del último byte: el chunk sigue activo para que
+// el reintento pida lo que falta
+func (c *Chunk) markCompleted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expectedSize := c.End - c.Start + 1
+
+	// Solo cuenta como completo si han llegado todos sus bytes
+	if c.Progress >= expectedSize {
+		c.Status = ChunkCompleted
+		c.Progress = expectedSize // Force exact size
+		return true
+	}
+	c.Error = fmt.Sprintf("incomplete data: %d/%d", c.Progress, expectedSize)
+	return false
+}
@@ -0,0 +1,53 @@
+package download
+
+import (
+	"sync"
+	"testing"
+)
+
+// Con go test -race detecta accesos a Paused sin el mutex
+func TestChunkedDownloadPausedConcurrentAccess(t *testing.T) {
+	download := NewChunkedDownload("http://example.com/file", "file", 1024, 256)
+
+	var readers, writers sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Bucle de descarga que consulta el flag sin parar
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				download.IsPaused()
+			}
+		}
+	}()
+
+	// Pausas y reanudaciones concurrentes
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(paused bool) {
+			defer writers.Done()
+			for j := 0; j < 1000; j++ {
+				download.SetPaused(paused)
+				paused = !paused
+			}
+		}(i%2 == 0)
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	download.SetPaused(true)
+	if !download.IsPaused() {
+		t.Errorf("IsPaused() = false after SetPaused(true)")
+	}
+	download.SetPaused(false)
+	if download.IsPaused() {
+		t.Errorf("IsPaused() = true after SetPaused(false)")
+	}
+}
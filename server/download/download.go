@@ -0,0 +1,368 @@
+// Package download es el motor de descarga de CatchMe: ChunkedDownload
+// divide el archivo en chunks, DownloadChunk los descarga con reintentos,
+// reconexiones y mirrors, y MergeChunks los une en el archivo final. El
+// servidor lo usa con su ProgressReporter (WebSocket, SSE); Download lo
+// envuelve para usarlo como biblioteca, sin servidor. El progreso se informa
+// con un callback y la descarga se cancela con su context.Context
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressInterval es el intervalo entre llamadas a Options.OnProgress
+const ProgressInterval = 500 * time.Millisecond
+
+var (
+	// ErrFileTooLarge indica que el archivo supera Options.MaxFileSize
+	ErrFileTooLarge = errors.New("file exceeds the maximum allowed size")
+	// ErrChecksumMismatch indica que el archivo descargado no coincide con
+	// Options.ExpectedChecksum. El archivo se borra
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnknownSize indica que el servidor no informa del tamaño del
+	// archivo: los chunks se calculan a partir de él
+	ErrUnknownSize = errors.New("server did not report the file size")
+)
+
+// Options configura Download. El valor cero es válido
+type Options struct {
+	// Client hace las peticiones. nil usa un cliente sin timeout global
+	Client *http.Client
+
+	// Credenciales y cabeceras propias enviadas con cada petición
+	Credentials Credentials
+
+	// Tamaño de cada chunk en bytes (0 = DefaultChunkSize)
+	ChunkSize int64
+
+	// Número máximo de chunks descargados a la vez (0 = DefaultConcurrentChunks)
+	MaxConcurrentChunks int
+
+	// Reintentos y tiempos límite de cada chunk. Los campos a cero toman el
+	// valor de DefaultRetryConfig. ChunkTimeout limita cada intento completo
+	// de un chunk: sin soporte de rangos el archivo entero es un solo chunk
+	Retry RetryConfig
+
+	// Tamaño máximo aceptado en bytes (0 = sin límite)
+	MaxFileSize int64
+
+	// Checksum esperado del archivo final (hex) y su algoritmo (ver
+	// ChecksumAlgorithms; vacío = DefaultChecksumAlgorithm). Si no coincide
+	// se devuelve ErrChecksumMismatch y el archivo se borra
+	ExpectedChecksum  string
+	ChecksumAlgorithm string
+
+	// Límite de velocidad en bytes/s (0 = sin límite)
+	MaxRate int64
+
+	// OnProgress recibe cada ProgressInterval los bytes descargados, el total
+	// y la velocidad suavizada en bytes/s. Nunca se llama de forma
+	// concurrente. Puede ser nil
+	OnProgress func(downloaded, total int64, speed float64)
+}
+
+// withDefaults rellena los campos vacíos de o
+func (o Options) withDefaults() Options {
+	if o.Client == nil {
+		o.Client = &http.Client{}
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.MaxConcurrentChunks <= 0 {
+		o.MaxConcurrentChunks = DefaultConcurrentChunks
+	}
+
+	defaults := DefaultRetryConfig()
+	if o.Retry.Strategy == "" {
+		o.Retry.Strategy = defaults.Strategy
+	}
+	if o.Retry.BaseDelay <= 0 {
+		o.Retry.BaseDelay = defaults.BaseDelay
+	}
+	if o.Retry.MaxDelay <= 0 {
+		o.Retry.MaxDelay = defaults.MaxDelay
+	}
+	if o.Retry.MaxRetries <= 0 {
+		o.Retry.MaxRetries = defaults.MaxRetries
+	}
+	if o.Retry.ChunkTimeout <= 0 {
+		o.Retry.ChunkTimeout = defaults.ChunkTimeout
+	}
+	if o.Retry.StuckTimeout <= 0 {
+		o.Retry.StuckTimeout = defaults.StuckTimeout
+	}
+	return o
+}
+
+// newRequest crea una petición ligada a ctx con el User-Agent y las
+// credenciales de o
+func (o Options) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.Credentials.UserAgent != "" {
+		req.Header.Set("User-Agent", o.Credentials.UserAgent)
+	}
+	o.Credentials.Apply(req)
+	return req, nil
+}
+
+// Download descarga url en dest con el mismo motor que el servidor: por
+// chunks en paralelo si el servidor acepta rangos y como un único chunk si
+// no. Los chunks se guardan en un directorio temporal y se unen en dest al
+// terminar. Cancelar ctx detiene la descarga, borra los temporales y
+// devuelve ctx.Err()
+func Download(ctx context.Context, url, dest string, opts Options) error {
+	opts = opts.withDefaults()
+	if opts.ExpectedChecksum != "" {
+		if _, err := ChecksumHash(opts.ChecksumAlgorithm); err != nil {
+			return err
+		}
+	}
+
+	info, err := fetchInfo(ctx, url, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	if opts.MaxFileSize > 0 && info.size > opts.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes (limit %d)", ErrFileTooLarge, info.size, opts.MaxFileSize)
+	}
+	if info.size <= 0 {
+		return ErrUnknownSize
+	}
+
+	tempDir, err := os.MkdirTemp("", "catchme-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Sin rangos el único chunk es el archivo entero, que es lo que llega
+	// en una respuesta 200
+	chunkSize := opts.ChunkSize
+	if !info.acceptsRanges {
+		chunkSize = info.size
+	}
+	d := NewChunkedDownload(url, filepath.Base(dest), info.size, chunkSize)
+	d.ResolvedURL = info.url
+	d.TempDir = tempDir
+	d.Credentials = opts.Credentials
+	d.MaxConcurrentChunks = opts.MaxConcurrentChunks
+	d.Retry = opts.Retry
+	d.Limiter = NewRateLimiter(opts.MaxRate)
+	d.ExpectedChecksum = opts.ExpectedChecksum
+	d.ChecksumAlgorithm = strings.ToLower(opts.ChecksumAlgorithm)
+	d.SetValidators(info.header)
+	if err := d.PrepareChunks(); err != nil {
+		return err
+	}
+	d.SetStatus(StatusDownloading)
+
+	if err := downloadChunks(ctx, d, opts, !info.acceptsRanges); err != nil {
+		return err
+	}
+
+	if err := d.MergeChunks(dest); err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("failed to merge chunks: %w", err)
+	}
+	if opts.ExpectedChecksum != "" {
+		algo := d.ChecksumAlgorithm
+		if algo == "" {
+			algo = DefaultChecksumAlgorithm
+		}
+		if actual := d.MergeChecksum(algo); !strings.EqualFold(actual, opts.ExpectedChecksum) {
+			os.Remove(dest)
+			return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, opts.ExpectedChecksum, actual)
+		}
+	}
+	d.SetStatus(StatusCompleted)
+	if opts.OnProgress != nil {
+		opts.OnProgress(info.size, info.size, 0)
+	}
+	return nil
+}
+
+// downloadChunks descarga los chunks de d con DownloadChunk, como mucho
+// MaxConcurrentChunks a la vez. El primer chunk que falla pausa a los demás,
+// igual que cancelar ctx. Sin rangos (restart) un corte no se puede retomar
+// en su offset, así que el chunk vuelve a empezar desde el primer byte
+func downloadChunks(ctx context.Context, d *ChunkedDownload, opts Options, restart bool) error {
+	stopProgress := reportProgress(d, opts)
+	defer stopProgress()
+
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.PauseAllChunks()
+		case <-watchDone:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	slots := d.NewChunkSlots()
+	for _, chunk := range d.Chunks {
+		slots.Acquire()
+		if ctx.Err() != nil || d.IsPaused() {
+			slots.Release()
+			break
+		}
+		wg.Add(1)
+		go func(chunk *Chunk) {
+			defer func() {
+				slots.Release()
+				wg.Done()
+			}()
+			err := d.DownloadChunk(opts.Client, chunk, discardReporter{})
+			for attempt := 0; restart && errors.Is(err, ErrRangeIgnored) && attempt < d.Retry.MaxRetries; attempt++ {
+				if err = d.RestartChunk(chunk); err == nil {
+					err = d.DownloadChunk(opts.Client, chunk, discardReporter{})
+				}
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					d.PauseAllChunks()
+				})
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if !d.IsComplete() {
+		return errors.New("download stopped before all chunks completed")
+	}
+	return nil
+}
+
+// fileInfo es lo que se sabe del archivo antes de descargarlo
+type fileInfo struct {
+	url           string // URL final tras las redirecciones
+	size          int64  // -1 si el servidor no lo indica
+	acceptsRanges bool
+	header        http.Header // Cabeceras con los validadores (ETag, Last-Modified)
+}
+
+// fetchInfo pide las cabeceras del archivo con HEAD y, si HEAD falla o no da
+// el tamaño, con un GET del primer byte (muchas CDN rechazan HEAD)
+func fetchInfo(ctx context.Context, url string, opts Options) (fileInfo, error) {
+	info := fileInfo{url: url, size: -1, header: http.Header{}}
+
+	req, err := opts.newRequest(ctx, http.MethodHead, url)
+	if err != nil {
+		return info, err
+	}
+	resp, headErr := opts.Client.Do(req)
+	if headErr == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			headErr = &StatusError{Code: resp.StatusCode}
+		} else {
+			info.url = resp.Request.URL.String()
+			info.size = resp.ContentLength
+			info.acceptsRanges = resp.Header.Get("Accept-Ranges") == "bytes"
+			info.header = resp.Header
+			if info.size > 0 {
+				return info, nil
+			}
+		}
+	}
+
+	req, err = opts.newRequest(ctx, http.MethodGet, url)
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err = opts.Client.Do(req)
+	if err != nil {
+		if headErr != nil {
+			return info, fmt.Errorf("%w (HEAD: %v)", err, headErr)
+		}
+		return info, nil
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		info.url = resp.Request.URL.String()
+		info.size = contentRangeTotal(resp.Header.Get("Content-Range"))
+		info.acceptsRanges = info.size > 0
+		info.header = resp.Header
+	case resp.StatusCode < 400:
+		info.url = resp.Request.URL.String()
+		info.size = resp.ContentLength
+		info.acceptsRanges = false
+		info.header = resp.Header
+	case headErr != nil:
+		return info, &StatusError{Code: resp.StatusCode}
+	}
+	return info, nil
+}
+
+// contentRangeTotal extrae el tamaño total de "bytes 0-0/12345" (-1 si se
+// desconoce)
+func contentRangeTotal(header string) int64 {
+	var start, end, total int64
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return -1
+	}
+	return total
+}
+
+// reportProgress llama a OnProgress cada ProgressInterval con el progreso y
+// la velocidad de d hasta que se llama a la función devuelta, que espera a
+// que termine la última llamada
+func reportProgress(d *ChunkedDownload, opts Options) (stop func()) {
+	if opts.OnProgress == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				downloaded, total := d.GetProgress()
+				opts.OnProgress(downloaded, total, d.Speed())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testData devuelve size bytes pseudoaleatorios reproducibles
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// fastRetry evita las esperas entre reintentos en los tests
+var fastRetry = RetryConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestDownload(t *testing.T) {
+	data := testData(300*1024 + 17)
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	// ServeContent atiende HEAD y Range
+	ranged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	})
+	// Sin rangos: siempre el archivo entero
+	plain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+	// Corta una de cada dos respuestas con rango tras sus 10 primeros bytes
+	var cuts atomic.Int32
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil && cuts.Add(1)%2 == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : start+10])
+			return
+		}
+		ranged(w, r)
+	})
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		opts     Options
+		wantErr  error
+		wantFile bool
+	}{
+		{"chunked", ranged, Options{ChunkSize: 64 * 1024}, nil, true},
+		{"chunked with checksum", ranged, Options{ChunkSize: 64 * 1024, ExpectedChecksum: checksum}, nil, true},
+		{"stream without ranges", plain, Options{}, nil, true},
+		{"short reads are retried", flaky, Options{ChunkSize: 64 * 1024}, nil, true},
+		{"checksum mismatch", ranged, Options{ExpectedChecksum: "00"}, ErrChecksumMismatch, false},
+		{"file too large", ranged, Options{MaxFileSize: 1024}, ErrFileTooLarge, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			dest := filepath.Join(t.TempDir(), "file.bin")
+			opts := tt.opts
+			opts.Retry = fastRetry
+			var last atomic.Int64
+			opts.OnProgress = func(downloaded, total int64, speed float64) {
+				last.Store(downloaded)
+			}
+
+			err := Download(context.Background(), server.URL+"/file.bin", dest, opts)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Download() error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+
+			got, readErr := os.ReadFile(dest)
+			if !tt.wantFile {
+				if readErr == nil {
+					t.Errorf("%s exists after a failed download", dest)
+				}
+				return
+			}
+			if readErr != nil {
+				t.Fatalf("read %s: %v", dest, readErr)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes that differ from the %d served", len(got), len(data))
+			}
+			if last.Load() != int64(len(data)) {
+				t.Errorf("last OnProgress downloaded = %d, want %d", last.Load(), len(data))
+			}
+		})
+	}
+}
+
+func TestDownloadStatusError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "missing.bin")
+	err := Download(context.Background(), server.URL+"/missing.bin", dest, Options{Retry: fastRetry})
+
+	var status *StatusError
+	if !errors.As(err, &status) || status.Code != http.StatusNotFound {
+		t.Fatalf("Download() error = %v, want StatusError 404", err)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Errorf("%s exists after a 404", dest)
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	data := testData(1024 * 1024)
+	started := make(chan struct{}, 16)
+
+	// Envía el primer trozo de cada rango y se queda colgado hasta que el
+	// cliente cancela
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-1023/"+strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:512])
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	done := make(chan error, 1)
+	go func() {
+		done <- Download(ctx, server.URL+"/file.bin", dest, Options{ChunkSize: 1024, Retry: fastRetry})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Download() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download did not return after ctx was canceled")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Errorf("%s exists after cancel", dest)
+	}
+}
@@ -0,0 +1,551 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tamaño del buffer de lectura de cada chunk (--read-buffer en el servidor),
+// independiente de la concurrencia. La memoria en buffers es
+// aproximadamente ReadBufferSize × chunks concurrentes × descargas
+// simultáneas. Se fija antes de empezar a descargar
+var ReadBufferSize = 512 * 1024
+
+// Pool de buffers de lectura (chunks y descargas de una sola conexión),
+// reutilizados entre descargas para reducir la presión sobre el GC. No hace
+// falta limpiarlos: cada lectura sobrescribe buf[:n] y solo se usa esa parte
+var readBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, ReadBufferSize)
+		return &buf
+	},
+}
+
+// GetReadBuffer obtiene un buffer de lectura del pool
+func GetReadBuffer() *[]byte {
+	return readBufferPool.Get().(*[]byte)
+}
+
+// PutReadBuffer devuelve un buffer al pool
+func PutReadBuffer(buf *[]byte) {
+	readBufferPool.Put(buf)
+}
+
+// ErrDiskWrite envuelve los fallos al abrir o escribir los archivos de la
+// descarga (disco lleno, permisos...). Reintentar no los arregla
+var ErrDiskWrite = errors.New("disk write error")
+
+// ErrRangeIgnored indica que el servidor respondió a una petición con Range
+// enviando el archivo completo
+var ErrRangeIgnored = errors.New("server ignored the Range header")
+
+// errRangeNotSatisfiable indica un 416 al pedir el resto de un chunk: el
+// archivo remoto probablemente cambió de tamaño desde que se empezó
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// errChunkStalled indica que un chunk pasó Retry.StuckTimeout sin recibir datos y se
+// cerró su conexión. DownloadChunk reconecta en el mismo offset sin espera
+var errChunkStalled = errors.New("chunk stalled")
+
+// Reconexiones seguidas tras un atasco antes de tratarlo como un fallo normal
+// que consume reintentos
+const maxStallReconnects = 3
+
+// StatusError es una respuesta HTTP que no se puede usar como datos del
+// archivo (4xx, 5xx o un código inesperado)
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned status code %d", e.Code)
+}
+
+// AbortOnDiskError detiene el resto de chunks si err es un error de disco:
+// seguir descargando no sirve si no se puede escribir
+func (d *ChunkedDownload) AbortOnDiskError(err error) {
+	if errors.Is(err, ErrDiskWrite) {
+		d.SetStatus(StatusFailed)
+		d.PauseAllChunks()
+	}
+}
+
+// userAgent devuelve el User-Agent de una petición a url (ver UserAgentFor)
+func (d *ChunkedDownload) userAgent(url string) string {
+	if d.UserAgentFor != nil {
+		return d.UserAgentFor(d.Credentials.UserAgent, url)
+	}
+	return d.Credentials.UserAgent
+}
+
+// DownloadChunk descarga un chunk específico - modificado para usar la nueva función con retry
+func (d *ChunkedDownload) DownloadChunk(client *http.Client, chunk *Chunk, reporter ProgressReporter) error {
+	// Un chunk ya completado (p. ej. antes de pausar) no se vuelve a bajar;
+	// se comprueba y se marca como activo bajo el mismo lock
+	chunk.mu.Lock()
+	if chunk.Status == ChunkCompleted {
+		chunk.mu.Unlock()
+		return nil
+	}
+	chunk.Status = ChunkActive
+	chunk.mu.Unlock()
+
+	// Añadir log de inicio de chunk
+	log.Printf("Starting chunk %d: bytes %d-%d", chunk.ID, chunk.Start, chunk.End)
+
+	// Add retry loop with exponential backoff
+	retry := d.Retry
+	var lastError error
+	retryCount := 0
+	restarted := false // El chunk ya se reinició una vez tras un 416
+	stallReconnects := 0
+
+	for retryCount <= retry.MaxRetries {
+		if retryCount > 0 {
+			// Calculate backoff using the configured retry strategy
+			delay := retry.Delay(retryCount)
+			log.Printf("Retrying chunk %d (attempt %d/%d) after %v delay",
+				chunk.ID, retryCount, retry.MaxRetries, delay)
+			logEvent(reporter, slog.LevelWarn, "chunk_retry", "url", d.URL, "download_id", d.ID, "chunk_id", chunk.ID,
+				"retry", retryCount, "delay", delay.Seconds(), "error", errString(lastError))
+
+			// Send retry info to client
+			reporter.ChunkRetry(d.ID, ChunkProgress{
+				ID:     chunk.ID,
+				Start:  chunk.Start,
+				End:    chunk.End,
+				Status: "retrying",
+			}, retryCount, retry.MaxRetries, delay)
+
+			time.Sleep(delay)
+		}
+
+		// Check if the download has been paused or canceled
+		select {
+		case <-chunk.cancelCtx:
+			if d.waitChunkResume(chunk) {
+				continue
+			}
+			chunk.mu.Lock()
+			if chunk.Status == ChunkActive {
+				chunk.Status = ChunkPaused
+			}
+			chunk.mu.Unlock()
+			return nil
+		default:
+			if d.IsPaused() {
+				chunk.mu.Lock()
+				if chunk.Status == ChunkActive {
+					chunk.Status = ChunkPaused
+				}
+				chunk.mu.Unlock()
+				return nil
+			}
+		}
+
+		// Recordar el nodo usado en este intento por si hay que rotar
+		edgeIP := ""
+		if d.edges != nil {
+			edgeIP = d.edges.Current()
+		}
+
+		// Try the download using our new timeout method
+		chunk.mu.Lock()
+		progressBefore := chunk.Progress
+		chunk.mu.Unlock()
+		err := d.tryDownloadChunkWithTimeout(client, chunk, reporter)
+		if err == nil {
+			// Un chunk pausado por sí solo vuelve a intentarlo al reanudarse
+			if d.waitChunkResume(chunk) {
+				continue
+			}
+			// Success!
+			return nil
+		}
+
+		// Una conexión atascada (p. ej. un keep-alive colgado) se cambia por
+		// otra en el mismo offset sin gastar reintentos ni esperar. Solo
+		// cuentan como seguidas las reconexiones sin datos entre medias
+		if errors.Is(err, errChunkStalled) {
+			chunk.mu.Lock()
+			progress := chunk.Progress
+			chunk.mu.Unlock()
+			if progress > progressBefore {
+				stallReconnects = 0
+			}
+			if stallReconnects < maxStallReconnects {
+				stallReconnects++
+				log.Printf("Chunk %d stalled at byte %d, reconnecting (%d/%d)",
+					chunk.ID, chunk.Start+progress, stallReconnects, maxStallReconnects)
+				reporter.Log(d.ID, fmt.Sprintf("Chunk %d stalled, reconnecting at byte %d", chunk.ID, chunk.Start+progress))
+				continue
+			}
+		}
+
+		// Reintentar no sirve si el servidor ignora los rangos, si el
+		// archivo cambió o si no se puede escribir en disco
+		if errors.Is(err, ErrRangeIgnored) || errors.Is(err, ErrRemoteChanged) || errors.Is(err, ErrDiskWrite) {
+			chunk.mu.Lock()
+			chunk.Status = ChunkFailed
+			chunk.Error = err.Error()
+			chunk.mu.Unlock()
+			return err
+		}
+
+		// Con un 416 el resto del chunk ya no existe en el servidor:
+		// repetir el mismo rango no sirve, así que se empieza el chunk de
+		// cero una sola vez antes de darlo por perdido
+		if errors.Is(err, errRangeNotSatisfiable) {
+			chunk.mu.Lock()
+			progress := chunk.Progress
+			chunk.mu.Unlock()
+			if restarted || progress == 0 {
+				chunk.mu.Lock()
+				chunk.Status = ChunkFailed
+				chunk.Error = err.Error()
+				chunk.mu.Unlock()
+				return fmt.Errorf("chunk %d: %v, the remote file may have changed", chunk.ID, err)
+			}
+
+			log.Printf("Chunk %d got 416 after %d bytes, the remote file may have changed; restarting chunk", chunk.ID, progress)
+			reporter.Log(d.ID, fmt.Sprintf("Chunk %d: range not satisfiable, the remote file may have changed. Restarting chunk from scratch", chunk.ID))
+			if resetErr := d.RestartChunk(chunk); resetErr != nil {
+				return resetErr
+			}
+			restarted = true
+			continue
+		}
+
+		// Log the error and retry
+		lastError = err
+		log.Printf("Chunk %d download failed (attempt %d/%d): %v",
+			chunk.ID, retryCount+1, retry.MaxRetries+1, err)
+
+		// Tras varios fallos seguidos probar otro nodo de la CDN
+		if d.edges != nil && (retryCount+1)%d.edgeRotation == 0 {
+			d.rotateEdge(client, chunk, edgeIP, reporter)
+		}
+
+		// Increment retry count and continue
+		retryCount++
+
+		// Agotados los reintentos en este origen, seguir en el siguiente
+		// mirror sin esperar
+		if retryCount > retry.MaxRetries && d.switchMirror(chunk, reporter) {
+			retryCount = 0
+		}
+	}
+
+	// If we get here, all retries failed
+	chunk.mu.Lock()
+	chunk.Status = ChunkFailed
+	chunk.Error = lastError.Error()
+	chunk.mu.Unlock()
+
+	return fmt.Errorf("chunk %d failed after %d retries: %w",
+		chunk.ID, retry.MaxRetries, lastError)
+}
+
+// isClosed indica si ch ya se cerró, sin bloquear
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// tryDownloadChunkWithTimeout handles downloading a chunk with timeout detection
+func (d *ChunkedDownload) tryDownloadChunkWithTimeout(client *http.Client, chunk *Chunk, reporter ProgressReporter) error {
+	// Crear o abrir archivo para el chunk en su posición inicial
+	file, err := d.openChunkWriter(chunk)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDiskWrite, err)
+	}
+	defer file.Close()
+
+	// Crear request con rango
+	source, mirror := d.chunkSource(chunk)
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	// Los mirrors no reciben credenciales pero sí el User-Agent de la
+	// descarga. Una cabecera User-Agent en Credentials.Headers lo sustituye
+	if agent := d.userAgent(source); agent != "" {
+		req.Header.Set("User-Agent", agent)
+	}
+
+	// Establecer rango de bytes para este chunk
+	rangeStart := chunk.Start + chunk.Progress
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, chunk.End))
+	// Con If-Range el servidor responde 200 en lugar de 206 si el archivo
+	// ya no es el mismo, en vez de mezclar datos de dos versiones. Los
+	// validadores son de la URL principal: un mirror tiene los suyos
+	validator := ""
+	if !mirror {
+		validator = d.ifRangeValidator(rangeStart > chunk.Start)
+		d.Credentials.Apply(req)
+	}
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	// Add context with timeout to detect stuck downloads
+	stuckTimeout := d.Retry.StuckTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), d.Retry.ChunkTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// Pausar o cancelar aborta también la petición, para que un Read
+	// bloqueado vuelva enseguida en lugar de esperar al siguiente paquete
+	chunk.mu.Lock()
+	cancelCtx := chunk.cancelCtx
+	chunk.mu.Unlock()
+	go func() {
+		select {
+		case <-cancelCtx:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Iniciar descarga
+	resp, err := client.Do(req)
+	if err != nil {
+		if isClosed(cancelCtx) {
+			return nil
+		}
+		return fmt.Errorf("failed to start download: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return fmt.Errorf("%w (bytes %d-%d)", errRangeNotSatisfiable, rangeStart, chunk.End)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{Code: resp.StatusCode}
+	}
+
+	if resp.StatusCode == http.StatusOK && validator != "" && d.remoteChanged(resp.Header) {
+		return fmt.Errorf("%w (If-Range %s not matched)", ErrRemoteChanged, validator)
+	}
+
+	// Un 200 trae el archivo desde el byte 0: solo sirve si el chunk es el
+	// archivo entero. En otro caso escribiría datos en la posición equivocada
+	if resp.StatusCode != http.StatusPartialContent && (rangeStart != 0 || chunk.End != d.Size-1) {
+		return fmt.Errorf("%w (status %d for bytes %d-%d)", ErrRangeIgnored, resp.StatusCode, rangeStart, chunk.End)
+	}
+
+	// Add progress monitoring with timeout detection. lastProgress lo
+	// actualiza el lector y lo vigila el bucle de abajo
+	startTime := time.Now()
+	var lastProgress atomic.Int64
+	lastProgress.Store(startTime.UnixNano())
+	var stalled atomic.Bool
+	chunk.meter.Reset()
+	updateInterval := 100 * time.Millisecond
+	lastUpdate := time.Now() // Define lastUpdate here to fix the undefined variable error
+
+	// Create a channel for the download goroutine
+	downloadDone := make(chan error, 1)
+	readDone := make(chan struct{})
+	chunk.mu.Lock()
+	chunk.readDone = readDone
+	chunk.mu.Unlock()
+
+	// Start the download in a separate goroutine. The goroutine owns the pooled
+	// read buffer and returns it when it exits, since it may outlive this call
+	// on timeout
+	go func() {
+		// Avisar a PauseAllChunks de que este lector ya no escribe
+		defer close(readDone)
+
+		bufPtr := GetReadBuffer()
+		defer PutReadBuffer(bufPtr)
+		buffer := *bufPtr
+
+		// Contar este lector para repartir el límite de ancho de banda
+		atomic.AddInt32(&d.activeReaders, 1)
+		defer atomic.AddInt32(&d.activeReaders, -1)
+
+		for {
+			// Check if download has been canceled or paused
+			select {
+			case <-cancelCtx:
+				downloadDone <- nil
+				return
+			default:
+				if d.IsPaused() {
+					downloadDone <- nil
+					return
+				}
+			}
+
+			// Read data with timeout
+			// Con límite de velocidad se lee en porciones de la parte justa de
+			// cada chunk, para que ninguno acapare el bucket con lecturas grandes
+			readSize := d.fairReadSize(int(atomic.LoadInt32(&d.activeReaders)), len(buffer))
+			n, err := resp.Body.Read(buffer[:readSize])
+			if n > 0 {
+				// Write to file
+				_, writeErr := file.Write(buffer[:n])
+				if writeErr != nil {
+					downloadDone <- fmt.Errorf("%w: %v", ErrDiskWrite, writeErr)
+					return
+				}
+
+				// Update progress
+				chunk.mu.Lock()
+				chunk.Progress += int64(n)
+				currentProgress := chunk.Progress
+				chunk.mu.Unlock()
+
+				lastProgress.Store(time.Now().UnixNano()) // Update progress time
+
+				// Respetar los límites de ancho de banda (global y de la descarga)
+				if !d.waitForBandwidth(n, cancelCtx) {
+					downloadDone <- nil
+					return
+				}
+
+				// Send progress update at interval
+				now := time.Now()
+				if now.Sub(lastUpdate) >= updateInterval {
+					elapsed := now.Sub(startTime).Seconds()
+					if elapsed > 0 {
+						speed := chunk.meter.Observe(currentProgress)
+						totalSpeed := d.Speed()
+
+						// Tomar los datos antes de informar: GetProgress y
+						// CurrentStatus ya toman d.mu, y el reporter puede
+						// tardar en enviar sin que haga falta tenerlo
+						chunk.mu.Lock()
+						chunkStatus := chunk.Status
+						chunk.mu.Unlock()
+						downloaded, total := d.GetProgress()
+						status := d.CurrentStatus()
+
+						// Report progress with speed
+						reporter.ChunkProgress(d.ID, ChunkProgress{
+							ID:       chunk.ID,
+							Start:    chunk.Start,
+							End:      chunk.End,
+							Progress: currentProgress,
+							Status:   chunkStatus,
+							Speed:    speed,
+							Percent:  chunkPercent(chunk.Start, chunk.End, currentProgress),
+						})
+
+						// Also report overall progress
+						reporter.OverallProgress(d.ID, downloaded, total, totalSpeed, status)
+						d.saveManifestThrottled()
+
+						lastUpdate = now
+					}
+				}
+			}
+
+			if err != nil {
+				if err == io.EOF {
+					completed := chunk.markCompleted()
+					if err := d.SaveManifest(); err != nil {
+						log.Printf("Warning: %v", err)
+					}
+					// Un EOF antes de End es un corte: devolver error para que
+					// DownloadChunk reintente desde el último byte recibido
+					if !completed {
+						chunk.mu.Lock()
+						received := chunk.Progress
+						chunk.mu.Unlock()
+						downloadDone <- fmt.Errorf("chunk %d: %w after %d of %d bytes",
+							chunk.ID, io.ErrUnexpectedEOF, received, chunk.End-chunk.Start+1)
+						return
+					}
+
+					// Report stats
+					elapsed := time.Since(startTime)
+					totalBytes := chunk.End - chunk.Start + 1
+					avgSpeed := float64(totalBytes) / elapsed.Seconds()
+
+					log.Printf("Chunk %d completed in %.2fs (%.2f MB/s)",
+						chunk.ID, elapsed.Seconds(), avgSpeed/(1024*1024))
+					logEvent(reporter, slog.LevelInfo, "chunk_completed", "url", d.URL, "download_id", d.ID, "chunk_id", chunk.ID,
+						"bytes", totalBytes, "elapsed", elapsed.Seconds(), "speed", avgSpeed)
+
+					// Send final notification
+					reporter.ChunkProgress(d.ID, ChunkProgress{
+						ID:        chunk.ID,
+						Start:     chunk.Start,
+						End:       chunk.End,
+						Progress:  totalBytes,
+						Status:    ChunkCompleted,
+						Speed:     0,
+						Percent:   100,
+						Completed: chunk.End + 1,
+					})
+
+					downloadDone <- nil
+					return
+				}
+
+				// Una lectura abortada por la pausa no es un error
+				if isClosed(cancelCtx) {
+					downloadDone <- nil
+					return
+				}
+				// Ni tampoco la cortada por el vigilante de atascos
+				if stalled.Load() {
+					downloadDone <- fmt.Errorf("%w: no progress for %v", errChunkStalled, stuckTimeout)
+					return
+				}
+
+				// Other error - signal failure
+				downloadDone <- err
+				return
+			}
+
+			// Check if download is stuck (no progress for a while)
+			if time.Since(time.Unix(0, lastProgress.Load())) > stuckTimeout {
+				downloadDone <- fmt.Errorf("%w: no progress for %v", errChunkStalled, stuckTimeout)
+				return
+			}
+		}
+	}()
+
+	// Un Read bloqueado no vuelve por sí solo: si pasa stuckTimeout sin datos
+	// se cierra el cuerpo, lo que descarta la conexión en vez de devolverla
+	// al pool de keep-alive
+	stallCheck := time.NewTicker(time.Second)
+	defer stallCheck.Stop()
+
+	// Wait for download completion or timeout
+	for {
+		select {
+		case err := <-downloadDone:
+			return err
+		case <-stallCheck.C:
+			if !stalled.Load() && time.Since(time.Unix(0, lastProgress.Load())) > stuckTimeout {
+				stalled.Store(true)
+				resp.Body.Close()
+			}
+		case <-ctx.Done():
+			// Si lo canceló una pausa, el lector está a punto de salir
+			if isClosed(cancelCtx) {
+				return <-downloadDone
+			}
+			// Timeout occurred
+			return fmt.Errorf("download timeout after %v", d.Retry.ChunkTimeout)
+		}
+	}
+}
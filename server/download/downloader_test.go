@@ -0,0 +1,194 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testChunkedDownload prepara una descarga por chunks de data servida por
+// handler (ver newTestDownload)
+func testChunkedDownload(tb testing.TB, handler http.Handler, size, chunkSize int64) (*ChunkedDownload, *http.Client) {
+	tb.Helper()
+	server := httptest.NewServer(handler)
+	tb.Cleanup(server.Close)
+
+	return newTestDownload(tb, server.URL+"/file.bin", size, chunkSize), server.Client()
+}
+
+// newTestDownload crea una descarga por chunks de url con los chunks ya
+// preparados en un directorio temporal y sin esperas entre reintentos
+func newTestDownload(tb testing.TB, url string, size, chunkSize int64) *ChunkedDownload {
+	tb.Helper()
+	download := NewChunkedDownload(url, "file.bin", size, chunkSize)
+	download.TempDir = tb.TempDir()
+	download.Retry.BaseDelay = time.Millisecond
+	if err := download.PrepareChunks(); err != nil {
+		tb.Fatalf("PrepareChunks: %v", err)
+	}
+	return download
+}
+
+// chunkData lee el archivo temporal de un chunk
+func chunkData(t *testing.T, download *ChunkedDownload, chunk *Chunk) []byte {
+	t.Helper()
+	data, err := os.ReadFile(download.ChunkPath(chunk))
+	if err != nil {
+		t.Fatalf("read chunk %d: %v", chunk.ID, err)
+	}
+	return data
+}
+
+func TestDownloadChunkRetriesShortRead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	// La primera respuesta termina limpiamente a mitad del rango
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		body := data[start : end+1]
+		if requests.Add(1) == 1 {
+			body = body[:len(body)/2]
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body)
+	})
+
+	download, client := testChunkedDownload(t, handler, int64(len(data)), int64(len(data)))
+	chunk := download.Chunks[0]
+	if err := download.DownloadChunk(client, chunk, discardReporter{}); err != nil {
+		t.Fatalf("DownloadChunk: %v", err)
+	}
+
+	if chunk.Status != ChunkCompleted {
+		t.Errorf("chunk status = %s, want %s", chunk.Status, ChunkCompleted)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2 (short read retried once)", got)
+	}
+	if got := chunkData(t, download, chunk); !bytes.Equal(got, data) {
+		t.Errorf("chunk has %d bytes that differ from the %d served", len(got), len(data))
+	}
+	if downloaded, total := download.GetProgress(); downloaded != total {
+		t.Errorf("GetProgress() = %d/%d, want complete", downloaded, total)
+	}
+}
+
+func TestDownloadChunkSkipsCompletedOnResume(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefghij"), 300)
+
+	// Cuenta las peticiones por byte inicial del rango
+	var mu sync.Mutex
+	requests := make(map[int]int)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		mu.Lock()
+		requests[start]++
+		mu.Unlock()
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+	})
+
+	download, client := testChunkedDownload(t, handler, int64(len(data)), 1000)
+	if len(download.Chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(download.Chunks))
+	}
+
+	// Antes de pausar solo terminó el primer chunk
+	first := download.Chunks[0]
+	if err := download.DownloadChunk(client, first, discardReporter{}); err != nil {
+		t.Fatalf("DownloadChunk(0): %v", err)
+	}
+	download.PauseAllChunks()
+
+	// Reanudar: todos los chunks vuelven a pasar por DownloadChunk
+	download.SetPaused(false)
+	for _, chunk := range download.Chunks {
+		if err := download.DownloadChunk(client, chunk, discardReporter{}); err != nil {
+			t.Fatalf("DownloadChunk(%d): %v", chunk.ID, err)
+		}
+	}
+
+	tests := []struct {
+		chunk    int
+		requests int
+	}{
+		{0, 1}, // Completado antes de la pausa: no se vuelve a pedir
+		{1, 1},
+		{2, 1},
+	}
+	for _, tt := range tests {
+		chunk := download.Chunks[tt.chunk]
+		if got := requests[int(chunk.Start)]; got != tt.requests {
+			t.Errorf("chunk %d requested %d times, want %d", tt.chunk, got, tt.requests)
+		}
+		if chunk.Status != ChunkCompleted {
+			t.Errorf("chunk %d status = %s, want %s", tt.chunk, chunk.Status, ChunkCompleted)
+		}
+		want := data[chunk.Start : chunk.End+1]
+		if got := chunkData(t, download, chunk); !bytes.Equal(got, want) {
+			t.Errorf("chunk %d has %d bytes that differ from the %d served", tt.chunk, len(got), len(want))
+		}
+	}
+}
+
+// quietLog descarta el log durante un benchmark
+func quietLog(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// Bucle de lectura de un chunk de 1MB: el buffer de lectura sale del pool
+func BenchmarkDownloadChunk(b *testing.B) {
+	quietLog(b)
+	data := bytes.Repeat([]byte("catchme"), 1<<20/7)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+	client := server.Client()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		download := newTestDownload(b, server.URL+"/file.bin", int64(len(data)), int64(len(data)))
+		b.StartTimer()
+		if err := download.DownloadChunk(client, download.Chunks[0], discardReporter{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// DownloadChunk usa los reintentos de la propia descarga
+func TestDownloadChunkUsesRetryConfig(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	download, client := testChunkedDownload(t, handler, 1000, 1000)
+	download.Retry.MaxRetries = 2
+	if err := download.DownloadChunk(client, download.Chunks[0], discardReporter{}); err == nil {
+		t.Fatal("DownloadChunk succeeded against a failing server")
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("requests = %d, want 3 (one try and two retries)", got)
+	}
+}
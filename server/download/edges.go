@@ -0,0 +1,148 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// edgePool fija las conexiones de una descarga a una IP concreta de las que
+// devuelve el DNS del host. Cuando un nodo de la CDN falla repetidamente se
+// vuelve a resolver el host y se pasa a otra IP del conjunto
+type edgePool struct {
+	host string
+
+	mu      sync.RWMutex
+	current string          // IP fijada; vacía hasta la primera rotación
+	failed  map[string]bool // IPs abandonadas por fallos
+}
+
+// newEdgePool crea el pool para el host de la URL, o nil si el host ya es
+// una IP
+func newEdgePool(rawURL string) *edgePool {
+	parsed, err := neturl.Parse(rawURL)
+	if err != nil || parsed.Hostname() == "" || net.ParseIP(parsed.Hostname()) != nil {
+		return nil
+	}
+	return &edgePool{host: parsed.Hostname(), failed: make(map[string]bool)}
+}
+
+// Current devuelve la IP fijada (vacía si todavía no se ha rotado)
+func (p *edgePool) Current() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current
+}
+
+// Rotate abandona la IP from y fija la siguiente IP que devuelva el DNS. Si
+// otro chunk ya rotó desde from no hace nada, para que varios fallos
+// simultáneos en el mismo nodo no salten varias IPs de golpe, y devuelve
+// rotated=false
+func (p *edgePool) Rotate(ctx context.Context, from string) (ip string, rotated bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, p.host)
+	if err != nil {
+		return "", false, fmt.Errorf("re-resolving %s: %v", p.host, err)
+	}
+	if len(addrs) < 2 {
+		return "", false, fmt.Errorf("%s resolves to a single address, nothing to rotate to", p.host)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.current != from {
+		return p.current, false, nil
+	}
+
+	// Sin IP fijada se asume que el sistema usaba la primera del resultado
+	start := 0
+	if from != "" {
+		p.failed[from] = true
+		start = -1
+		for i, addr := range addrs {
+			if addr.IP.String() == from {
+				start = i
+				break
+			}
+		}
+	} else {
+		p.failed[addrs[0].IP.String()] = true
+	}
+
+	// Buscar la siguiente IP no abandonada; si todas fallaron, empezar de nuevo
+	for pass := 0; pass < 2; pass++ {
+		for i := 1; i <= len(addrs); i++ {
+			candidate := addrs[(start+i+len(addrs))%len(addrs)].IP.String()
+			if candidate != from && !p.failed[candidate] {
+				p.current = candidate
+				return candidate, true, nil
+			}
+		}
+		p.failed = map[string]bool{from: true}
+	}
+	return "", false, fmt.Errorf("no alternative address for %s", p.host)
+}
+
+// wrapDial devuelve un DialContext que conecta a la IP fijada cuando el
+// destino es el host del pool. TLS sigue usando el nombre del host (SNI y
+// verificación de certificado) porque net/http lo toma de la URL
+func (p *edgePool) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil && host == p.host {
+			if ip := p.Current(); ip != "" {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// RotateEdges activa la rotación de nodos: tras threshold fallos seguidos de
+// un chunk se pasa a otra IP del host. Con 0 se deja que el sistema elija la
+// IP en cada conexión
+func (d *ChunkedDownload) RotateEdges(threshold int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.edges = nil
+	d.edgeRotation = threshold
+	if threshold > 0 {
+		d.edges = newEdgePool(d.requestURL())
+	}
+}
+
+// WrapDial fija las conexiones de dial al nodo actual de la descarga. Sin
+// rotación de nodos devuelve dial tal cual
+func (d *ChunkedDownload) WrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.RLock()
+	edges := d.edges
+	d.mu.RUnlock()
+	if edges == nil {
+		return dial
+	}
+	return edges.wrapDial(dial)
+}
+
+// rotateEdge cambia de nodo tras fallos repetidos de un chunk y cierra las
+// conexiones ociosas para que los siguientes intentos usen la nueva IP
+func (d *ChunkedDownload) rotateEdge(client *http.Client, chunk *Chunk, from string, reporter ProgressReporter) {
+	ip, rotated, err := d.edges.Rotate(context.Background(), from)
+	if err != nil {
+		log.Printf("Edge rotation for chunk %d skipped: %v", chunk.ID, err)
+		return
+	}
+	if !rotated {
+		return
+	}
+	client.CloseIdleConnections()
+
+	log.Printf("Chunk %d: switching %s to edge %s after repeated failures", chunk.ID, d.edges.host, ip)
+	reporter.Log(d.ID, fmt.Sprintf("Switching to edge %s of %s after repeated chunk failures", ip, d.edges.host))
+}
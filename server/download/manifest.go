@@ -0,0 +1,205 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Archivo dentro del TempDir con el estado de la descarga, para poder
+// reanudarla tras reiniciar el servidor
+const manifestFile = "manifest.json"
+
+// Intervalo mínimo entre escrituras del manifiesto durante la descarga
+const manifestSaveInterval = time.Second
+
+// chunkManifest es el estado persistido de un chunk
+type chunkManifest struct {
+	ID       int         `json:"id"`
+	Start    int64       `json:"start"`
+	End      int64       `json:"end"`
+	Name     string      `json:"name"`
+	Progress int64       `json:"progress"`
+	Status   ChunkStatus `json:"status"`
+}
+
+// downloadManifest es el estado persistido de una descarga por chunks. Las
+// credenciales no se guardan: hay que volver a enviarlas en resume_download
+type downloadManifest struct {
+	ID                string          `json:"id,omitempty"`
+	URL               string          `json:"url"`
+	Filename          string          `json:"filename"`
+	Size              int64           `json:"size"`
+	ChunkSize         int64           `json:"chunk_size"`
+	MaxChunks         int             `json:"max_concurrent_chunks,omitempty"`
+	DownloadDir       string          `json:"download_dir"`
+	Overwrite         bool            `json:"overwrite,omitempty"`
+	DirectWrite       bool            `json:"direct_write,omitempty"`
+	FastMode          bool            `json:"fast_mode,omitempty"`
+	Ranges            []ByteRange     `json:"ranges,omitempty"`
+	ForceHTTP1        bool            `json:"force_http1,omitempty"` // Manifiestos anteriores a protocol
+	HTTPProtocol      string          `json:"protocol,omitempty"`
+	ExpectedChecksum  string          `json:"expected_checksum,omitempty"`
+	ChecksumAlgorithm string          `json:"checksum_algorithm,omitempty"`
+	StartedAt         time.Time       `json:"started_at"`
+	ETag              string          `json:"etag,omitempty"`
+	LastModified      string          `json:"last_modified,omitempty"`
+	Mirrors           []string        `json:"mirrors,omitempty"`
+	Chunks            []chunkManifest `json:"chunks"`
+}
+
+// SaveManifest escribe el estado actual de la descarga en su TempDir. Las
+// descargas terminadas no se guardan para que no reaparezcan al reiniciar
+func (d *ChunkedDownload) SaveManifest() error {
+	d.mu.RLock()
+	if d.Status.IsTerminal() {
+		d.mu.RUnlock()
+		return nil
+	}
+	manifest := downloadManifest{
+		ID:                d.ID,
+		URL:               d.URL,
+		Filename:          d.Filename,
+		Size:              d.Size,
+		ChunkSize:         d.ChunkSize,
+		MaxChunks:         d.MaxConcurrentChunks,
+		DownloadDir:       d.DownloadDir,
+		Overwrite:         d.Overwrite,
+		DirectWrite:       d.DirectWrite,
+		FastMode:          d.FastMode,
+		Ranges:            d.Ranges,
+		HTTPProtocol:      d.HTTPProtocol,
+		ExpectedChecksum:  d.ExpectedChecksum,
+		ChecksumAlgorithm: d.ChecksumAlgorithm,
+		StartedAt:         d.StartedAt,
+		ETag:              d.ETag,
+		LastModified:      d.LastModified,
+		Mirrors:           d.Mirrors,
+		Chunks:            make([]chunkManifest, 0, len(d.Chunks)),
+	}
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		manifest.Chunks = append(manifest.Chunks, chunkManifest{
+			ID:       chunk.ID,
+			Start:    chunk.Start,
+			End:      chunk.End,
+			Name:     chunk.Name,
+			Progress: chunk.Progress,
+			Status:   chunk.Status,
+		})
+		chunk.mu.Unlock()
+	}
+	path := filepath.Join(d.TempDir, manifestFile)
+	d.mu.RUnlock()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Serializar escrituras: varios chunks pueden guardar a la vez
+	d.manifestMu.Lock()
+	defer d.manifestMu.Unlock()
+	d.manifestSaved = time.Now()
+
+	// Escribir y renombrar para no dejar nunca un manifiesto a medias
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save download manifest: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// saveManifestThrottled guarda el manifiesto como mucho una vez por
+// manifestSaveInterval; se llama en cada actualización de progreso
+func (d *ChunkedDownload) saveManifestThrottled() {
+	d.manifestMu.Lock()
+	due := time.Since(d.manifestSaved) >= manifestSaveInterval
+	d.manifestMu.Unlock()
+
+	if due {
+		if err := d.SaveManifest(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
+
+// LoadManifest reconstruye una descarga pausada a partir del manifiesto de
+// tempDir. El avance de cada chunk se limita a lo que hay realmente en disco.
+// La configuración de la sesión (reintentos, rotación de nodos, límites) no
+// se guarda y queda con los valores por defecto
+func LoadManifest(tempDir string) (*ChunkedDownload, error) {
+	data, err := os.ReadFile(filepath.Join(tempDir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest downloadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.URL == "" || manifest.Size <= 0 || len(manifest.Chunks) == 0 {
+		return nil, fmt.Errorf("incomplete manifest")
+	}
+
+	download := NewChunkedDownload(manifest.URL, manifest.Filename, manifest.Size, manifest.ChunkSize)
+	download.ID = manifest.ID
+	download.TempDir = tempDir
+	if manifest.MaxChunks > 0 {
+		download.MaxConcurrentChunks = manifest.MaxChunks
+	}
+	download.DownloadDir = manifest.DownloadDir
+	download.Overwrite = manifest.Overwrite
+	download.DirectWrite = manifest.DirectWrite
+	download.FastMode = manifest.FastMode
+	download.Ranges = manifest.Ranges
+	download.HTTPProtocol = manifest.HTTPProtocol
+	if manifest.ForceHTTP1 && download.HTTPProtocol == "" {
+		download.HTTPProtocol = "http1"
+	}
+	download.ExpectedChecksum = manifest.ExpectedChecksum
+	download.ChecksumAlgorithm = manifest.ChecksumAlgorithm
+	if !manifest.StartedAt.IsZero() {
+		download.StartedAt = manifest.StartedAt
+	}
+	download.ETag = manifest.ETag
+	download.LastModified = manifest.LastModified
+	download.Mirrors = manifest.Mirrors
+	download.Paused = true
+	download.Status = StatusPaused
+
+	for _, saved := range manifest.Chunks {
+		chunk := &Chunk{
+			ID:        saved.ID,
+			Start:     saved.Start,
+			End:       saved.End,
+			Name:      saved.Name,
+			Progress:  saved.Progress,
+			Status:    saved.Status,
+			cancelCtx: make(chan struct{}),
+		}
+
+		// Lo escrito en disco manda: el manifiesto puede ir por detrás o, si
+		// se perdió la caché del sistema, por delante del archivo del chunk.
+		// El .part del modo directo está preasignado y no lo indica
+		if !download.DirectWrite {
+			var onDisk int64
+			if info, err := os.Stat(download.ChunkPath(chunk)); err == nil {
+				onDisk = info.Size()
+			}
+			if chunk.Progress > onDisk {
+				chunk.Progress = onDisk
+			}
+		}
+		if chunk.Status != ChunkCompleted || chunk.Progress < chunk.End-chunk.Start+1 {
+			chunk.Status = ChunkPaused
+		}
+
+		download.Chunks = append(download.Chunks, chunk)
+	}
+
+	return download, nil
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// mergeHasher calcula los checksums del archivo final mientras el merge
+// secuencial lo escribe, para no tener que releerlo del disco después. Los
+// merges por offset (concurrentes, por rangos o en modo directo) no escriben
+// en orden y siguen calculando el checksum al final
+type mergeHasher struct {
+	hashes map[string]hash.Hash
+	writer io.Writer
+}
+
+// newMergeHasher prepara el algoritmo por defecto y, si es otro, el del
+// checksum esperado de la descarga
+func (d *ChunkedDownload) newMergeHasher() *mergeHasher {
+	m := &mergeHasher{hashes: make(map[string]hash.Hash)}
+	writers := make([]io.Writer, 0, 2)
+	for _, algo := range []string{DefaultChecksumAlgorithm, d.ChecksumAlgorithm} {
+		if _, exists := m.hashes[algo]; exists || algo == "" {
+			continue
+		}
+		h, err := ChecksumHash(algo)
+		if err != nil {
+			continue
+		}
+		m.hashes[algo] = h.New()
+		writers = append(writers, m.hashes[algo])
+	}
+	m.writer = io.MultiWriter(writers...)
+	return m
+}
+
+// Write añade bytes del archivo final, en orden
+func (m *mergeHasher) Write(p []byte) (int, error) {
+	return m.writer.Write(p)
+}
+
+// hashPrefix añade los primeros n bytes ya unidos de destPath, al retomar un
+// merge interrumpido
+func (m *mergeHasher) hashPrefix(destPath string, n int64) error {
+	file, err := os.Open(destPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.CopyN(m, file, n)
+	return err
+}
+
+// Sums devuelve los checksums en hexadecimal por algoritmo
+func (m *mergeHasher) Sums() map[string]string {
+	sums := make(map[string]string, len(m.hashes))
+	for algo, h := range m.hashes {
+		sums[algo] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return sums
+}
+
+// setMergeChecksums guarda los checksums del último merge (nil los borra)
+func (d *ChunkedDownload) setMergeChecksums(sums map[string]string) {
+	d.sumsMu.Lock()
+	d.mergeSums = sums
+	d.sumsMu.Unlock()
+}
+
+// MergeChecksum devuelve el checksum calculado durante el merge, o "" si el
+// merge no fue secuencial o no incluía ese algoritmo
+func (d *ChunkedDownload) MergeChecksum(algo string) string {
+	d.sumsMu.Lock()
+	defer d.sumsMu.Unlock()
+	return d.mergeSums[algo]
+}
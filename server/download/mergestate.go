@@ -0,0 +1,120 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Archivo dentro del TempDir donde se registra el avance del merge
+const mergeStateFile = "merge.json"
+
+// mergeState registra qué chunks ya se escribieron en el destino, para poder
+// continuar un merge interrumpido en lugar de empezarlo de cero
+type mergeState struct {
+	DestPath string `json:"dest_path"`
+	Size     int64  `json:"size"`
+	Merged   []int  `json:"merged"`
+
+	mu     sync.Mutex
+	path   string
+	merged map[int]bool
+}
+
+// loadMergeState lee el avance del merge hacia destPath. Si no existe o
+// corresponde a otro destino devuelve un estado vacío
+func (d *ChunkedDownload) loadMergeState(destPath string) *mergeState {
+	state := &mergeState{
+		DestPath: destPath,
+		Size:     d.Size,
+		path:     filepath.Join(d.TempDir, mergeStateFile),
+		merged:   make(map[int]bool),
+	}
+
+	data, err := os.ReadFile(state.path)
+	if err != nil {
+		return state
+	}
+
+	var saved mergeState
+	if err := json.Unmarshal(data, &saved); err != nil ||
+		saved.DestPath != destPath || saved.Size != d.Size {
+		return state
+	}
+
+	// Sin el archivo destino el avance guardado no sirve de nada
+	if _, err := os.Stat(destPath); err != nil {
+		return state
+	}
+
+	for _, id := range saved.Merged {
+		state.merged[id] = true
+	}
+	state.Merged = saved.Merged
+	return state
+}
+
+// PendingMergeDest devuelve el destino de un merge interrumpido de esta
+// descarga, si queda alguno a medias en disco
+func (d *ChunkedDownload) PendingMergeDest() string {
+	data, err := os.ReadFile(filepath.Join(d.TempDir, mergeStateFile))
+	if err != nil {
+		return ""
+	}
+	var saved mergeState
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Size != d.Size || saved.DestPath == "" {
+		return ""
+	}
+	if _, err := os.Stat(saved.DestPath); err != nil {
+		return ""
+	}
+	return saved.DestPath
+}
+
+// IsMerged indica si el chunk ya se escribió en el destino
+func (s *mergeState) IsMerged(chunkID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.merged[chunkID]
+}
+
+// MarkMerged registra el chunk como escrito y persiste el avance
+func (s *mergeState) MarkMerged(chunkID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.merged[chunkID] {
+		return nil
+	}
+	s.merged[chunkID] = true
+	s.Merged = append(s.Merged, chunkID)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// Escribir y renombrar para no dejar nunca un archivo de estado a medias
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save merge progress: %v", err)
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// Reset olvida el avance guardado (merge empezado de cero)
+func (s *mergeState) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.merged = make(map[int]bool)
+	s.Merged = nil
+	os.Remove(s.path)
+}
+
+// Remove borra el archivo de estado al terminar el merge
+func (s *mergeState) Remove() {
+	os.Remove(s.path)
+}
@@ -0,0 +1,35 @@
+package download
+
+import (
+	"fmt"
+	"log"
+)
+
+// chunkSource devuelve la URL de la que se pide un chunk: la principal (tras
+// redirecciones) o el mirror al que se cambió
+func (d *ChunkedDownload) chunkSource(chunk *Chunk) (url string, mirror bool) {
+	chunk.mu.Lock()
+	source := chunk.source
+	chunk.mu.Unlock()
+	if source == 0 {
+		return d.requestURL(), false
+	}
+	return d.Mirrors[source-1], true
+}
+
+// switchMirror pasa el chunk al siguiente mirror cuando agotó los reintentos
+// en su origen actual. Devuelve false si no quedan mirrors por probar
+func (d *ChunkedDownload) switchMirror(chunk *Chunk, reporter ProgressReporter) bool {
+	chunk.mu.Lock()
+	if chunk.source >= len(d.Mirrors) {
+		chunk.mu.Unlock()
+		return false
+	}
+	chunk.source++
+	mirror := d.Mirrors[chunk.source-1]
+	chunk.mu.Unlock()
+
+	log.Printf("Chunk %d: retries exhausted, switching to mirror %s", chunk.ID, mirror)
+	reporter.Log(d.ID, fmt.Sprintf("Chunk %d: retries exhausted, switching to mirror %s", chunk.ID, mirror))
+	return true
+}
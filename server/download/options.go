@@ -0,0 +1,54 @@
+package download
+
+import "net/http"
+
+// ByteRange es un rango de bytes inclusivo [Start, End] dentro del archivo remoto
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Length devuelve el número de bytes del rango
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// Credentials son las credenciales opcionales de una descarga protegida. Se
+// aplican a la petición HEAD inicial y a cada petición de chunk. Las
+// cabeceras y cookies propias (p. ej. Referer o la cookie de sesión) van
+// aquí también porque, como el resto, no se envían a los mirrors ni se
+// persisten en el manifiesto
+type Credentials struct {
+	Username string
+	Password string
+	Token    string            // Token Bearer; tiene prioridad sobre usuario/contraseña
+	Headers  map[string]string // Cabeceras extra; pueden sustituir al User-Agent
+	Cookies  string            // Valor de la cabecera Cookie ("a=1; b=2")
+	// User-Agent propio de la descarga (user_agent); vacío usa el del
+	// cliente (ChunkedDownload.UserAgentFor)
+	UserAgent string
+}
+
+// IsZero indica si no hay ninguna credencial
+func (c Credentials) IsZero() bool {
+	return c.Username == "" && c.Password == "" && c.Token == "" && len(c.Headers) == 0 && c.Cookies == "" &&
+		c.UserAgent == ""
+}
+
+// Apply añade las cabeceras extra, las cookies y la cabecera Authorization a
+// la petición. El User-Agent lo pone quien la envía antes de llamar a Apply,
+// así una cabecera User-Agent en headers tiene prioridad sobre él
+func (c Credentials) Apply(req *http.Request) {
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	if c.Cookies != "" {
+		req.Header.Set("Cookie", c.Cookies)
+	}
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
@@ -0,0 +1,132 @@
+package download
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter es un token bucket en bytes por segundo compartido por todas las
+// lecturas que lo usan. Con rate 0 no limita. No usa goroutines propias: cada
+// lector calcula su espera al reservar, así que no hay nada que detener
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes por segundo
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter crea un limitador de bytesPerSecond (0 = sin límite)
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// SetRate cambia el límite en caliente
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bytesPerSecond < 0 {
+		bytesPerSecond = 0
+	}
+	l.rate = float64(bytesPerSecond)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate devuelve el límite actual en bytes por segundo (0 si l es nil)
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// reserve descuenta n bytes del bucket y devuelve cuánto debe esperar el lector
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	// Ráfaga máxima de un segundo de tráfico
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait espera hasta que los n bytes leídos quepan en el límite. Devuelve false
+// si cancel se cierra antes (pausa o cancelación)
+func (l *RateLimiter) Wait(n int, cancel <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// Tamaño mínimo de lectura al repartir el límite entre chunks
+const minFairReadSize = 16 * 1024
+
+// fairReadSize limita el tamaño de cada lectura a unos 100ms de la parte que
+// corresponde a cada chunk activo. Así los chunks se
+// turnan en el bucket compartido en lugar de reservar ráfagas de varios
+// segundos, y la velocidad reportada por chunk es estable
+func (d *ChunkedDownload) fairReadSize(readers int, max int) int {
+	rate := d.SharedLimiter.Rate()
+	if r := d.Limiter.Rate(); r > 0 && (rate == 0 || r < rate) {
+		rate = r
+	}
+	if rate <= 0 {
+		return max
+	}
+	if readers < 1 {
+		readers = 1
+	}
+
+	size := int(rate / int64(readers) / 10)
+	if size < minFairReadSize {
+		size = minFairReadSize
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// waitForBandwidth aplica el límite compartido y el de la descarga. Esperar
+// en ambos hace que la tasa efectiva sea el mínimo de los dos
+func (d *ChunkedDownload) waitForBandwidth(n int, cancel <-chan struct{}) bool {
+	if !d.SharedLimiter.Wait(n, cancel) {
+		return false
+	}
+	return d.Limiter.Wait(n, cancel)
+}
@@ -0,0 +1,55 @@
+package download
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrRemoteChanged indica que el servidor respondió 200 a una petición con
+// If-Range: el validador ya no coincide y los chunks guardados no sirven
+var ErrRemoteChanged = errors.New("remote file changed since the download started")
+
+// SetValidators guarda el ETag y el Last-Modified de la respuesta inicial
+func (d *ChunkedDownload) SetValidators(header http.Header) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ETag = header.Get("ETag")
+	d.LastModified = header.Get("Last-Modified")
+}
+
+// MarkResumed indica que la descarga continúa datos de una sesión anterior
+func (d *ChunkedDownload) MarkResumed() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resumed = true
+}
+
+// ifRangeValidator devuelve el valor para If-Range, o "" si no hace falta.
+// Solo se envía al continuar datos ya descargados (un chunk a medias o una
+// descarga reanudada): algunos servidores cambian Last-Modified en cada
+// respuesta y no deben romper una descarga nueva. Los ETag débiles no se
+// admiten en If-Range, así que en ese caso se usa Last-Modified
+func (d *ChunkedDownload) ifRangeValidator(partial bool) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if !partial && !d.resumed {
+		return ""
+	}
+	if d.ETag != "" && !strings.HasPrefix(d.ETag, "W/") {
+		return d.ETag
+	}
+	return d.LastModified
+}
+
+// remoteChanged compara los validadores de una respuesta 200 con los
+// guardados. Si coinciden el servidor simplemente ignoró el rango (se trata
+// como ErrRangeIgnored); si difieren o faltan, el archivo cambió
+func (d *ChunkedDownload) remoteChanged(header http.Header) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.ETag != "" {
+		return header.Get("ETag") != d.ETag
+	}
+	return header.Get("Last-Modified") != d.LastModified
+}
@@ -0,0 +1,54 @@
+package download
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ProgressReporter recibe los eventos del motor de descarga. El servidor lo
+// implementa publicándolos por WebSocket, SSE y suscriptores; una CLI, un
+// espía de tests u otro transporte pueden aportar el suyo
+type ProgressReporter interface {
+	// ChunkProgress informa del estado de un chunk
+	ChunkProgress(id string, chunk ChunkProgress)
+	// ChunkRetry avisa de que un chunk se reintentará tras delay, en el
+	// reintento retry de maxRetries
+	ChunkRetry(id string, chunk ChunkProgress, retry, maxRetries int, delay time.Duration)
+	// OverallProgress informa del progreso total de la descarga
+	OverallProgress(id string, downloaded, total int64, speed float64, status DownloadStatus)
+	// Log envía un mensaje informativo
+	Log(id, message string)
+	// Error envía un mensaje de error
+	Error(id, message string)
+}
+
+// EventLogger lo implementan los reporters que además llevan un log
+// estructurado: reciben chunk_retry y chunk_completed con sus campos
+type EventLogger interface {
+	LogEvent(level slog.Level, event string, attrs ...any)
+}
+
+// logEvent pasa un evento estructurado al reporter, si lo admite
+func logEvent(reporter ProgressReporter, level slog.Level, event string, attrs ...any) {
+	if logger, ok := reporter.(EventLogger); ok {
+		logger.LogEvent(level, event, attrs...)
+	}
+}
+
+// errString devuelve el texto de un error o "" si es nil
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// discardReporter descarta todos los eventos, para usar el motor de chunks
+// sin nadie que escuche
+type discardReporter struct{}
+
+func (discardReporter) ChunkProgress(string, ChunkProgress)                           {}
+func (discardReporter) ChunkRetry(string, ChunkProgress, int, int, time.Duration)     {}
+func (discardReporter) OverallProgress(string, int64, int64, float64, DownloadStatus) {}
+func (discardReporter) Log(string, string)                                            {}
+func (discardReporter) Error(string, string)                                          {}
@@ -0,0 +1,100 @@
+package download
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryStrategy define cómo crece la espera entre reintentos
+type RetryStrategy string
+
+const (
+	RetryFixed       RetryStrategy = "fixed"
+	RetryLinear      RetryStrategy = "linear"
+	RetryExponential RetryStrategy = "exponential"
+)
+
+// Valores por defecto de RetryConfig
+const (
+	MaxChunkRetries      = 5  // Maximum retries per chunk
+	InitialRetryDelay    = 1  // Initial retry delay in seconds
+	MaxRetryDelay        = 15 // Maximum retry delay in seconds
+	DownloadTimeout      = 30 // Timeout for individual chunk operations in seconds
+	StuckProgressTimeout = 60 // Consider a chunk stuck if no progress for this many seconds
+)
+
+// RetryConfig agrupa los reintentos y tiempos límite de una descarga. En el
+// servidor se rellena con --retry-strategy, --retry-base, --retry-max,
+// --retry-jitter, --max-retries, --chunk-timeout, --stuck-timeout y
+// --head-retries (o las mismas claves de --config), y cada descarga guarda
+// su copia al crearse. Los mirrors lentos necesitan más margen que los
+// valores por defecto
+type RetryConfig struct {
+	Strategy  RetryStrategy
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Jitter    bool
+	// Reintentos y tiempos límite de cada chunk
+	MaxRetries   int
+	ChunkTimeout time.Duration
+	StuckTimeout time.Duration
+	// Reintentos de la petición de información del archivo (HEAD o GET del
+	// primer byte). Algunos mirrors académicos fallan las primeras
+	// conexiones y responden a la tercera
+	HeadRetries int
+}
+
+// DefaultRetryConfig devuelve la configuración de reintentos por defecto
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Strategy:     RetryExponential,
+		BaseDelay:    InitialRetryDelay * time.Second,
+		MaxDelay:     MaxRetryDelay * time.Second,
+		MaxRetries:   MaxChunkRetries,
+		ChunkTimeout: DownloadTimeout * time.Second,
+		StuckTimeout: StuckProgressTimeout * time.Second,
+		HeadRetries:  MaxChunkRetries,
+	}
+}
+
+// ParseRetryStrategy valida el nombre de una estrategia de reintento
+func ParseRetryStrategy(name string) (RetryStrategy, error) {
+	switch strategy := RetryStrategy(name); strategy {
+	case RetryFixed, RetryLinear, RetryExponential:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown retry strategy %q (use fixed, linear or exponential)", name)
+	}
+}
+
+// Delay calcula la espera antes del reintento número attempt (desde 1)
+func (c RetryConfig) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	var delay time.Duration
+	switch c.Strategy {
+	case RetryFixed:
+		delay = c.BaseDelay
+	case RetryLinear:
+		delay = c.BaseDelay * time.Duration(attempt)
+	default:
+		// Limitar el desplazamiento para no desbordar con muchos reintentos
+		delay = c.BaseDelay << uint(min(attempt-1, 30))
+	}
+
+	if delay > c.MaxDelay || delay <= 0 {
+		delay = c.MaxDelay
+	}
+
+	// Jitter: esperar entre la mitad y el total para repartir los reintentos
+	// de varios chunks que fallan a la vez
+	if c.Jitter && delay > 1 {
+		half := delay / 2
+		delay = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+
+	return delay
+}
@@ -0,0 +1,85 @@
+package download
+
+import "sync"
+
+// ChunkSlots es el semáforo de chunks de una descarga. A diferencia de un
+// canal con buffer, su límite puede cambiar mientras se descarga: al bajarlo
+// los chunks activos terminan y sus huecos no se vuelven a ocupar
+type ChunkSlots struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+// NewChunkSlots crea un semáforo de limit huecos (mínimo 1)
+func NewChunkSlots(limit int) *ChunkSlots {
+	s := &ChunkSlots{limit: max(limit, 1)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Acquire espera a que haya un hueco libre y lo ocupa
+func (s *ChunkSlots) Acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.active >= s.limit {
+		s.cond.Wait()
+	}
+	s.active++
+}
+
+// Release libera un hueco ocupado con Acquire
+func (s *ChunkSlots) Release() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// SetLimit cambia el número de huecos (mínimo 1)
+func (s *ChunkSlots) SetLimit(limit int) {
+	s.mu.Lock()
+	s.limit = max(limit, 1)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// Usage devuelve el límite actual y los huecos ocupados
+func (s *ChunkSlots) Usage() (limit, active int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit, s.active
+}
+
+// NewChunkSlots prepara el semáforo de una tanda de chunks (inicio o
+// reanudación), con toda la concurrencia configurada
+func (d *ChunkedDownload) NewChunkSlots() *ChunkSlots {
+	slots := NewChunkSlots(d.MaxConcurrentChunks)
+	d.slots.Store(slots)
+	return slots
+}
+
+// Concurrency devuelve cuántos chunks pueden descargarse a la vez y cuántos
+// lo están haciendo. Antes de empezar es la concurrencia configurada
+func (d *ChunkedDownload) Concurrency() (limit, active int) {
+	if slots := d.slots.Load(); slots != nil {
+		return slots.Usage()
+	}
+	return d.MaxConcurrentChunks, 0
+}
+
+// HasPendingChunks indica si quedan chunks esperando un hueco
+func (d *ChunkedDownload) HasPendingChunks() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		pending := chunk.Status == ChunkPending
+		chunk.mu.Unlock()
+		if pending {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package download
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// speedAlpha es el peso de cada muestra nueva en la media exponencial
+	speedAlpha = 0.3
+	// speedMinInterval evita muestras sobre intervalos demasiado cortos, que
+	// dan picos aunque la media sea correcta
+	speedMinInterval = 100 * time.Millisecond
+)
+
+// SpeedMeter suaviza la velocidad con una media móvil exponencial de las
+// diferencias de bytes entre observaciones, para que la velocidad reportada
+// no salte entre 0 y picos enormes cada 100ms
+type SpeedMeter struct {
+	mu        sync.Mutex
+	last      time.Time
+	lastBytes int64
+	speed     float64
+}
+
+// Observe registra el total de bytes recibidos y devuelve la velocidad
+// suavizada en bytes/s
+func (m *SpeedMeter) Observe(total int64) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	// Primera muestra o contador reiniciado: solo fijar la referencia
+	if m.last.IsZero() || total < m.lastBytes {
+		m.last, m.lastBytes = now, total
+		return m.speed
+	}
+	if now.Sub(m.last) < speedMinInterval {
+		return m.speed
+	}
+	elapsed := now.Sub(m.last).Seconds()
+
+	sample := float64(total-m.lastBytes) / elapsed
+	if m.speed == 0 {
+		m.speed = sample
+	} else {
+		m.speed = speedAlpha*sample + (1-speedAlpha)*m.speed
+	}
+	m.last, m.lastBytes = now, total
+	return m.speed
+}
+
+// Speed devuelve la última velocidad suavizada
+func (m *SpeedMeter) Speed() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.speed
+}
+
+// Reset olvida las muestras, p.ej. al reintentar un chunk
+func (m *SpeedMeter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last, m.lastBytes, m.speed = time.Time{}, 0, 0
+}
+
+// Speed es la velocidad suavizada de la descarga: la suma de la de sus
+// chunks activos
+func (d *ChunkedDownload) Speed() float64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	total := 0.0
+	for _, chunk := range d.Chunks {
+		chunk.mu.Lock()
+		active := chunk.Status == ChunkActive
+		chunk.mu.Unlock()
+		if active {
+			total += chunk.meter.Speed()
+		}
+	}
+	return total
+}
@@ -0,0 +1,92 @@
+package download
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpeedMeter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []int64 // Totales observados, separados por speedMinInterval+
+		check func(t *testing.T, speeds []float64)
+	}{
+		{
+			name:  "first sample only sets the reference",
+			steps: []int64{1000},
+			check: func(t *testing.T, speeds []float64) {
+				if speeds[0] != 0 {
+					t.Errorf("first Observe = %v, want 0", speeds[0])
+				}
+			},
+		},
+		{
+			name:  "steady rate",
+			steps: []int64{0, 15000, 30000},
+			check: func(t *testing.T, speeds []float64) {
+				// 15000 bytes cada ~150ms: ~100 KB/s
+				for _, speed := range speeds[1:] {
+					if speed < 30000 || speed > 110000 {
+						t.Errorf("speed = %.0f, want about 100000", speed)
+					}
+				}
+			},
+		},
+		{
+			name:  "spike is smoothed",
+			steps: []int64{0, 15000, 315000},
+			check: func(t *testing.T, speeds []float64) {
+				// La muestra instantánea sería ~2 MB/s; la media pesa solo un 30%
+				if speeds[2] >= 1000000 {
+					t.Errorf("speed after spike = %.0f, want it smoothed well below 1 MB/s", speeds[2])
+				}
+				if speeds[2] <= speeds[1] {
+					t.Errorf("speed after spike = %.0f, want above %.0f", speeds[2], speeds[1])
+				}
+			},
+		},
+		{
+			name:  "counter reset keeps the last speed",
+			steps: []int64{0, 15000, 100},
+			check: func(t *testing.T, speeds []float64) {
+				if speeds[2] != speeds[1] {
+					t.Errorf("speed after reset = %.0f, want unchanged %.0f", speeds[2], speeds[1])
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var meter SpeedMeter
+			speeds := make([]float64, 0, len(tt.steps))
+			for i, total := range tt.steps {
+				if i > 0 {
+					time.Sleep(speedMinInterval + 50*time.Millisecond)
+				}
+				speeds = append(speeds, meter.Observe(total))
+			}
+			tt.check(t, speeds)
+		})
+	}
+}
+
+func TestSpeedMeterIgnoresShortIntervals(t *testing.T) {
+	var meter SpeedMeter
+	meter.Observe(0)
+	time.Sleep(speedMinInterval + 50*time.Millisecond)
+	speed := meter.Observe(15000)
+
+	// Una muestra inmediata daría un pico enorme: se devuelve la media anterior
+	if got := meter.Observe(10000000); got != speed {
+		t.Errorf("Observe right after a sample = %.0f, want %.0f", got, speed)
+	}
+	if got := meter.Speed(); got != speed {
+		t.Errorf("Speed() = %.0f, want %.0f", got, speed)
+	}
+
+	meter.Reset()
+	if got := meter.Speed(); got != 0 {
+		t.Errorf("Speed() after Reset = %.0f, want 0", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directorio de descargas por defecto (--download-dir). Vacío usa la carpeta
+// de descargas del sistema (ver defaultDownloadDir)
+var downloadDirectory = ""
+
+// resolveDownloadDir elige el directorio de destino: el indicado en el mensaje,
+// el de --download-dir o la carpeta de descargas del sistema, en ese orden
+func resolveDownloadDir(override string) (string, error) {
+	dir := override
+	if dir == "" {
+		dir = downloadDirectory
+	}
+
+	if dir == "" || dir == "~" || strings.HasPrefix(dir, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get home directory: %v", err)
+		}
+		switch {
+		case dir == "":
+			dir = defaultDownloadDir(home)
+		case dir == "~":
+			dir = home
+		default:
+			dir = filepath.Join(home, dir[2:])
+		}
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid download directory %q: %v", dir, err)
+	}
+	return abs, nil
+}
+
+// ensureWritableDir crea el directorio si hace falta y comprueba que se puede
+// escribir en él creando y borrando un archivo temporal
+func ensureWritableDir(dir string) error {
+	if err := makeDownloadDir(dir); err != nil {
+		return fmt.Errorf("cannot create download directory %s: %v", dir, err)
+	}
+
+	if err := probeWritable(dir); err != nil {
+		return fmt.Errorf("download directory %s is not writable: %v", dir, err)
+	}
+	return nil
+}
+
+// probeWritable crea y borra un archivo temporal en dir. Es la única forma
+// fiable de detectar montajes de solo lectura, ACLs o cuotas
+func probeWritable(dir string) error {
+	probe, err := os.CreateTemp(dir, ".catchme-write-test-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// checkWritableDirs vuelve a comprobar, al reanudar, que el destino y la raíz
+// temporal de una descarga siguen admitiendo escritura: pueden haber cambiado
+// mientras estaba en pausa o el servidor parado
+func checkWritableDirs(d *ChunkedDownload) error {
+	if d.DownloadDir != "" {
+		if err := ensureWritableDir(d.DownloadDir); err != nil {
+			return err
+		}
+	}
+	base := tempRoot(d)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return fmt.Errorf("cannot create temp directory %s: %v", base, err)
+	}
+	if err := probeWritable(base); err != nil {
+		return fmt.Errorf("temp directory %s is not writable: %v", base, err)
+	}
+	return nil
+}
+
+// confineDownloadDir resuelve un directorio recibido por la API HTTP y exige
+// que quede dentro del directorio de descargas configurado, para que una
+// petición no pueda escribir en cualquier ruta del sistema. Vacío se mantiene
+// vacío (el directorio por defecto)
+func confineDownloadDir(override string) (string, error) {
+	if override == "" {
+		return "", nil
+	}
+	base, err := resolveDownloadDir("")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(override) && override != "~" && !strings.HasPrefix(override, "~/") {
+		override = filepath.Join(base, override)
+	}
+	dir, err := resolveDownloadDir(override)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the download directory %s", dir, base)
+	}
+	return dir, nil
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDownloadDir devuelve la carpeta de descargas de XDG: $XDG_DOWNLOAD_DIR
+// o la entrada XDG_DOWNLOAD_DIR de user-dirs.dirs, que en escritorios
+// localizados no se llama Downloads. Sin configuración XDG (macOS incluido)
+// es home/Downloads
+func defaultDownloadDir(home string) string {
+	if dir := expandXDGDir(os.Getenv("XDG_DOWNLOAD_DIR"), home); dir != "" {
+		return dir
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(home, ".config")
+	}
+	if dir := readUserDirsEntry(filepath.Join(configHome, "user-dirs.dirs"), "XDG_DOWNLOAD_DIR", home); dir != "" {
+		return dir
+	}
+	return filepath.Join(home, "Downloads")
+}
+
+// readUserDirsEntry busca key en un user-dirs.dirs (líneas KEY="$HOME/ruta").
+// Devuelve "" si el archivo o la entrada no existen
+func readUserDirsEntry(path, key, home string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		value, found := strings.CutPrefix(line, key+"=")
+		if !found {
+			continue
+		}
+		return expandXDGDir(strings.Trim(value, `"`), home)
+	}
+	return ""
+}
+
+// expandXDGDir sustituye $HOME y descarta rutas relativas, que la
+// especificación no permite. Apuntar a home a secas significa que el usuario
+// desactivó la carpeta, así que también se descarta
+func expandXDGDir(dir, home string) string {
+	if rest, found := strings.CutPrefix(dir, "$HOME"); found {
+		dir = home + rest
+	}
+	if !filepath.IsAbs(dir) || filepath.Clean(dir) == filepath.Clean(home) {
+		return ""
+	}
+	return filepath.Clean(dir)
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procSHGetKnownFolderPath = syscall.NewLazyDLL("shell32.dll").NewProc("SHGetKnownFolderPath")
+	procCoTaskMemFree        = syscall.NewLazyDLL("ole32.dll").NewProc("CoTaskMemFree")
+)
+
+// folderIDDownloads es FOLDERID_Downloads {374DE290-123F-4565-9164-39C4925E467B}
+var folderIDDownloads = struct {
+	Data1 uint32
+	Data2 uint16
+	Data3 uint16
+	Data4 [8]byte
+}{0x374de290, 0x123f, 0x4565, [8]byte{0x91, 0x64, 0x39, 0xc4, 0x92, 0x5e, 0x46, 0x7b}}
+
+// defaultDownloadDir pregunta a Windows por la carpeta conocida de descargas,
+// que el usuario puede haber movido a otro disco o a una ruta localizada.
+// Si la llamada falla se usa home\Downloads
+func defaultDownloadDir(home string) string {
+	var path *uint16
+	hr, _, _ := procSHGetKnownFolderPath.Call(uintptr(unsafe.Pointer(&folderIDDownloads)), 0, 0, uintptr(unsafe.Pointer(&path)))
+	if path != nil {
+		defer procCoTaskMemFree.Call(uintptr(unsafe.Pointer(path)))
+	}
+	if hr != 0 || path == nil {
+		return filepath.Join(home, "Downloads")
+	}
+
+	n := 0
+	for *(*uint16)(unsafe.Add(unsafe.Pointer(path), n*2)) != 0 {
+		n++
+	}
+	dir := syscall.UTF16ToString(unsafe.Slice(path, n))
+	if dir == "" {
+		return filepath.Join(home, "Downloads")
+	}
+	return dir
+}
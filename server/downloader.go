@@ -1,34 +1,20 @@
 package main
 
 import (
-	"context"
-	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
-)
-
-// Gestor de descargas activas
-var (
-	activeDownloadsMap   = make(map[string]*ChunkedDownload)
-	activeDownloadsMutex sync.RWMutex
-)
 
-// Estructura para hacer seguimiento del estado de descargas
-type downloadState struct {
-	active bool
-	paused bool
-}
-
-// Cambiamos el mapa para almacenar estados más complejos
-var (
-	activeDownloadsState = make(map[string]downloadState)
-	activeDownloadsMux   sync.Mutex
+	"catchme/server/download"
 )
 
 // Constantes de configuración
@@ -37,31 +23,97 @@ const (
 	MaxConcurrentChunks       = 8                // Aumentar a 8 chunks concurrentes (antes era 5)
 	MinChunkSize        int64 = 5 * 1024 * 1024  // 5MB mínimo
 	MaxChunkSize        int64 = 50 * 1024 * 1024 // 50MB máximo
+	MaxChunkWorkers           = 32               // Máximo de max_concurrent_chunks por descarga
 
 	// Auto-tune chunk size based on connection speed
 	SpeedThresholdFast   int64 = 10 * 1024 * 1024 // 10MB/s
 	SpeedThresholdMedium int64 = 5 * 1024 * 1024  // 5MB/s
+)
+
+// Opciones de ejecución configurables desde la línea de comandos
+var (
+	// Número de chunks que se copian en paralelo durante el merge. Con 1 se
+	// mantiene la concatenación secuencial; valores mayores preasignan el
+	// archivo final y escriben cada chunk en su offset (útil en RAID/multi-disco)
+	mergeConcurrency = 1
+
+	// Máximo de checksums calculados a la vez, para no saturar la CPU cuando
+	// varias descargas grandes terminan juntas
+	maxConcurrentChecksums = max(runtime.NumCPU()/2, 1)
+
+	// Enviar un chunk_init por chunk en lugar del mensaje agrupado chunks_init,
+	// para clientes antiguos
+	individualChunkInit = false
+
+	// Omitir las pausas entre mensajes que dan tiempo a la UI a mostrar cada
+	// estado (--no-ui-delays). Los mensajes se envían en el mismo orden
+	noUIDelays = false
+
+	// Escribir los chunks directamente en el archivo final (--direct-write).
+	// El archivo a medias vive en el directorio de descargas como
+	// "<nombre>.part" (ver ChunkedDownload.PartPath)
+	directWrite = false
+)
 
-	// Retry settings
-	MaxChunkRetries      = 5  // Maximum retries per chunk
-	InitialRetryDelay    = 1  // Initial retry delay in seconds
-	MaxRetryDelay        = 15 // Maximum retry delay in seconds
-	DownloadTimeout      = 30 // Timeout for individual chunk operations in seconds
-	StuckProgressTimeout = 60 // Consider a chunk stuck if no progress for this many seconds
+// Semáforo global de cálculos de checksum, creado al primer uso para respetar
+// el valor configurado por línea de comandos
+var (
+	checksumSem     chan struct{}
+	checksumSemOnce sync.Once
 )
 
-// Speed tracking
+// Tamaño de los buffers con los que se lee el archivo al calcular checksums
+const checksumBufferSize = 8 * 1024 * 1024
+
+// Pool de buffers de checksum: son grandes y los cálculos llegan a ráfagas
+// cuando terminan varias descargas a la vez
+var checksumBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, checksumBufferSize)
+		return &buf
+	},
+}
+
+// acquireChecksumSlot reserva un hueco para calcular un checksum. Si no hay
+// hueco libre avisa al cliente con checksum_queued y espera su turno
+func acquireChecksumSlot(safeConn *SafeConn, id, filename string) {
+	checksumSemOnce.Do(func() {
+		checksumSem = make(chan struct{}, maxConcurrentChecksums)
+	})
+
+	select {
+	case checksumSem <- struct{}{}:
+		return
+	default:
+	}
+
+	log.Printf("Checksum for %s queued, %d calculations already running", filename, maxConcurrentChecksums)
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "checksum_queued",
+		"download_id": id,
+		"filename":    filename,
+	})
+	checksumSem <- struct{}{}
+}
+
+// releaseChecksumSlot libera el hueco reservado con acquireChecksumSlot
+func releaseChecksumSlot() {
+	<-checksumSem
+}
+
+// Speed tracking, por id de descarga. La media de cada servidor para
+// dimensionar los chunks está en speedhints.go
 var (
 	speedHistory = make(map[string][]float64)
 	speedMutex   sync.RWMutex
 )
 
-// Get previous speed for a URL
-func getPreviousSpeed(url string) float64 {
+// Get previous speed for a download
+func getPreviousSpeed(id string) float64 {
 	speedMutex.RLock()
 	defer speedMutex.RUnlock()
 
-	if speeds, exists := speedHistory[url]; exists && len(speeds) > 0 {
+	if speeds, exists := speedHistory[id]; exists && len(speeds) > 0 {
 		// Calculate average of last 5 speed samples
 		count := min(len(speeds), 5)
 		sum := 0.0
@@ -73,24 +125,32 @@ func getPreviousSpeed(url string) float64 {
 	return 0
 }
 
-// Update speed history for a URL
-func updateSpeedHistory(url string, speed float64) {
+// Update speed history for a download
+func updateSpeedHistory(id string, speed float64) {
 	speedMutex.Lock()
 	defer speedMutex.Unlock()
 
-	if _, exists := speedHistory[url]; !exists {
-		speedHistory[url] = make([]float64, 0, 10)
+	if _, exists := speedHistory[id]; !exists {
+		speedHistory[id] = make([]float64, 0, 10)
 	}
 
 	// Add new speed
-	speedHistory[url] = append(speedHistory[url], speed)
+	speedHistory[id] = append(speedHistory[id], speed)
 
 	// Keep only last 10 samples
-	if len(speedHistory[url]) > 10 {
-		speedHistory[url] = speedHistory[url][1:]
+	if len(speedHistory[id]) > 10 {
+		speedHistory[id] = speedHistory[id][1:]
 	}
 }
 
+// forgetSpeedHistory borra las muestras de una descarga que ya terminó
+func forgetSpeedHistory(id string) {
+	speedMutex.Lock()
+	delete(speedHistory, id)
+	delete(lastSpeedSample, id)
+	speedMutex.Unlock()
+}
+
 // Helper function for min of two ints
 func min(a, b int) int {
 	if a < b {
@@ -100,600 +160,1046 @@ func min(a, b int) int {
 }
 
 // handleChunkedDownload inicia una descarga por chunks (función de proxy con nombre que coincide con main.go)
-func handleChunkedDownload(safeConn *SafeConn, url string) {
-	startChunkedDownload(safeConn, url)
+func handleChunkedDownload(safeConn *SafeConn, id, url string, opts DownloadOptions) {
+	startChunkedDownload(safeConn, id, url, opts)
 }
 
 // handleCancelChunkedDownload cancela una descarga en progreso (función de proxy con nombre que coincide con main.go)
-func handleCancelChunkedDownload(safeConn *SafeConn, url string) {
-	cancelChunkedDownload(safeConn, url)
+func handleCancelChunkedDownload(safeConn *SafeConn, id string) {
+	cancelChunkedDownload(safeConn, id)
 }
 
 // handlePauseChunkedDownload pausa una descarga en progreso (función de proxy con nombre que coincide con main.go)
-func handlePauseChunkedDownload(safeConn *SafeConn, url string) {
-	pauseChunkedDownload(safeConn, url)
+func handlePauseChunkedDownload(safeConn *SafeConn, id string) {
+	pauseChunkedDownload(safeConn, id)
+}
+
+// handleResumeChunkedDownload reanuda una descarga pausada (función de proxy con nombre que coincide con main.go).
+// La reanudación pasa por la cola de descargas como una descarga nueva
+func handleResumeChunkedDownload(safeConn *SafeConn, id string) {
+	if downloadSlots.IsRunning(id) {
+		// Sigue preparándose o es de una sola conexión: basta con retirar la
+		// pausa, la descarga no ha soltado su hueco
+		if paused, _ := registry.IsPaused(id); paused {
+			registry.SetPaused(id, false)
+			log.Printf("Pause withdrawn, download still running: %s", downloadIDs.URL(id))
+			sendMessage(safeConn, "resume_confirmed", id, "Download resumed successfully")
+			return
+		}
+		log.Printf("Resume ignored, download already running: %s", downloadIDs.URL(id))
+		sendMessage(safeConn, "resume_confirmed", id, "Download already running")
+		return
+	}
+	if err := downloadSlots.Submit(id, safeConn, func() { resumeChunkedDownload(safeConn, id) }); err != nil {
+		sendMessage(safeConn, "log", id, err.Error())
+	}
+}
+
+// handleRetryDownload atiende retry_download: repite una descarga que terminó
+// en recoverable_failure. Es una reanudación, así que solo se piden los
+// chunks sin terminar, desde su progreso guardado. Tras un reinicio la
+// descarga vuelve como pausada, por eso basta con que no esté en marcha
+func handleRetryDownload(safeConn *SafeConn, id string) {
+	if _, exists := registry.Get(id); !exists {
+		sendError(safeConn, id, ErrorCodeNotFound, "No download found to retry")
+		return
+	}
+	if paused, _ := registry.IsPaused(id); !paused {
+		sendError(safeConn, id, ErrorCodeInvalidRequest, "Download is still running, nothing to retry")
+		return
+	}
+
+	sendMessage(safeConn, "log", id, "Retrying the chunks that did not complete")
+	safeConn.Own(id)
+	handleResumeChunkedDownload(safeConn, id)
+}
+
+// applyResumeOptions toma de resume_download o retry_download lo que no se
+// persiste: las credenciales (con cabeceras y cookies), el proxy y el
+// webhook. Tras un reinicio hay que volver a enviarlos para reanudar
+func applyResumeOptions(id string, msg map[string]interface{}) {
+	opts, err := parseDownloadOptions(msg)
+	if err != nil {
+		return
+	}
+	download, exists := registry.Get(id)
+	if !exists {
+		return
+	}
+
+	download.Lock()
+	defer download.Unlock()
+	if !opts.Credentials.IsZero() {
+		download.Credentials = opts.Credentials
+	}
+	if opts.Proxy != "" {
+		download.Proxy = opts.Proxy
+	}
+	if opts.Webhook != "" {
+		download.Webhook = opts.Webhook
+	}
+}
+
+// handleChunkCommand atiende pause_chunk y resume_chunk: pausa o reanuda un
+// único chunk de una descarga y responde con su estado resultante
+func handleChunkCommand(safeConn *SafeConn, msg map[string]interface{}) {
+	url, _ := msg["url"].(string)
+	id, err := resolveDownload(msg)
+	if err == errDownloadNotFound {
+		sendURLError(safeConn, url, ErrorCodeNotFound, "No active chunked download found")
+		return
+	} else if err != nil {
+		sendURLError(safeConn, url, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	rawChunkID, ok := msg["chunk_id"].(float64)
+	if !ok {
+		sendError(safeConn, id, ErrorCodeInvalidRequest, fmt.Sprintf("%v requires a chunk_id", msg["type"]))
+		return
+	}
+	chunkID := int(rawChunkID)
+
+	download, exists := registry.Get(id)
+	if !exists {
+		sendError(safeConn, id, ErrorCodeNotFound, "No active chunked download found")
+		return
+	}
+
+	action := "paused"
+	if msg["type"] == "resume_chunk" {
+		err = download.ResumeChunk(chunkID)
+		action = "resumed"
+	} else {
+		err = download.PauseChunk(chunkID)
+	}
+	if err != nil {
+		sendError(safeConn, id, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+
+	log.Printf("Chunk %d of %s %s", chunkID, download.URL, action)
+	sendMessage(safeConn, "log", id, fmt.Sprintf("Chunk %d %s", chunkID, action))
+	if state, ok := download.ChunkState(chunkID); ok {
+		publishEvent(safeConn, map[string]interface{}{
+			"type":        "chunk_progress",
+			"download_id": id,
+			"chunk":       state,
+		})
+	}
 }
 
-// handleResumeChunkedDownload reanuda una descarga pausada (función de proxy con nombre que coincide con main.go)
-func handleResumeChunkedDownload(safeConn *SafeConn, url string) {
-	resumeChunkedDownload(safeConn, url)
+// handlePauseAll pausa todas las descargas por chunks en curso. La cola se
+// retiene para que los huecos liberados no arranquen descargas en espera
+func handlePauseAll(safeConn *SafeConn) {
+	downloadSlots.SetHeld(true)
+	count := 0
+	for _, entry := range registry.Entries() {
+		if entry.Paused || entry.Download == nil || entry.Download.CurrentStatus().IsTerminal() {
+			continue
+		}
+		pauseChunkedDownload(safeConn, entry.ID)
+		count++
+	}
+	log.Printf("Paused %d downloads", count)
+}
+
+// handleResumeAll reanuda todas las descargas pausadas y suelta la cola
+func handleResumeAll(safeConn *SafeConn) {
+	count := 0
+	for _, entry := range registry.Entries() {
+		if !entry.Paused || entry.Download == nil {
+			continue
+		}
+		safeConn.Own(entry.ID)
+		handleResumeChunkedDownload(safeConn, entry.ID)
+		count++
+	}
+	downloadSlots.SetHeld(false)
+	log.Printf("Resumed %d downloads", count)
+}
+
+// handleCancelAll cancela todas las descargas, también las que esperan en la
+// cola, y borra sus temporales. Las de la cola se cancelan primero para que
+// no arranquen al liberarse los huecos
+func handleCancelAll(safeConn *SafeConn) {
+	downloadSlots.SetHeld(true)
+	defer downloadSlots.SetHeld(false)
+
+	count := 0
+	for _, id := range downloadSlots.Waiting() {
+		cancelDownload(safeConn, id)
+		count++
+	}
+	for _, entry := range registry.Entries() {
+		cancelDownload(safeConn, entry.ID)
+		count++
+	}
+	log.Printf("Canceled %d downloads", count)
 }
 
 // startChunkedDownload inicia una descarga por chunks
-func startChunkedDownload(safeConn *SafeConn, url string) {
-	// Agregar tracking en el sistema principal
-	markDownloadActive(url)
-	defer markDownloadInactive(url)
-
-	// Verificar si ya existe una descarga para esta URL
-	activeDownloadsMutex.RLock()
-	if _, exists := activeDownloadsMap[url]; exists {
-		activeDownloadsMutex.RUnlock()
-		sendMessage(safeConn, "error", url, "Download already in progress")
+func startChunkedDownload(safeConn *SafeConn, id, url string, opts DownloadOptions) {
+	// Agregar tracking en el registro; si la preparación falla antes de lanzar
+	// los workers dejamos de rastrear la URL
+	registry.Prepare(id, url)
+	if limiter, ok := registry.Limiter(id); ok {
+		limiter.SetRate(opts.MaxRate)
+	}
+	launched := false
+	defer func() {
+		if !launched {
+			registry.Remove(id)
+		}
+	}()
+
+	// Comprobar el directorio de destino antes de tocar la red
+	downloadDir, err := resolveDownloadDir(opts.DownloadDir)
+	if err == nil {
+		err = ensureWritableDir(downloadDir)
+	}
+	if err != nil {
+		sendError(safeConn, id, ErrorCodeNotWritable, err.Error())
+		return
+	}
+	tempBase, err := resolveTempBase(opts.TempDir)
+	if err != nil {
+		sendError(safeConn, id, ErrorCodeNotWritable, err.Error())
 		return
 	}
-	activeDownloadsMutex.RUnlock()
+	warnIfCrossFilesystem(safeConn, id, tempBase, downloadDir)
 
 	// Obtener información del archivo
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Head(url)
+	client := &http.Client{Timeout: 30 * time.Second, Transport: newDownloadTransport(10, opts.httpProtocol(), opts.Proxy)}
+	resp, err := fetchFileInfo(safeConn, id, client, url, opts.Credentials)
 	if err != nil {
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to get file info: %v", err))
+		sendError(safeConn, id, networkErrorCode(err, ErrorCodeHeadFailed), fmt.Sprintf("Failed to get file info: %v", err))
+		return
+	}
+	if preparationCanceled(id) {
+		log.Printf("Download canceled during preparation: %s", url)
 		return
 	}
+	reportProtocol(safeConn, id, resp)
 
-	// Verificar si el servidor soporta rangos
+	// Las peticiones de rango van directas a la URL final (p. ej. la CDN a la
+	// que redirige un mirror) para que todos los chunks usen el mismo host
+	resolvedURL := reportResolvedURL(safeConn, id, resp)
+
+	// Sin soporte de rangos los chunks recibirían el archivo entero cada uno:
+	// usar la descarga de una sola conexión, que gestiona su propio registro
 	acceptRanges := resp.Header.Get("Accept-Ranges")
-	if acceptRanges == "bytes" {
-		sendMessage(safeConn, "log", url, "Server supports range requests, enabling chunked download")
-	} else {
-		sendMessage(safeConn, "log", url, "Server doesn't support range requests, using single connection")
+	if acceptRanges != "bytes" {
+		if len(opts.Ranges) > 0 {
+			sendError(safeConn, id, ErrorCodeNoRangeSupport, "Server doesn't support range requests, cannot download specific ranges")
+			return
+		}
+		sendMessage(safeConn, "log", id, "Server doesn't support range requests, using single connection")
+		launched = true
+		handleDownload(safeConn, id, url, opts)
+		return
+	}
+	sendMessage(safeConn, "log", id, "Server supports range requests, enabling chunked download")
+
+	// Algunos servidores solo envían Content-Disposition en la respuesta GET
+	if resp.Header.Get("Content-Disposition") == "" {
+		if disposition := probeContentDisposition(client, resolvedURL, opts.Credentials); disposition != "" {
+			resp.Header.Set("Content-Disposition", disposition)
+		}
+	}
+
+	// Rechazar directorios y listados HTML antes de mirar el tamaño: un
+	// listado suele llegar sin Content-Length. Un nombre elegido por el
+	// cliente tiene prioridad
+	filename := opts.Filename
+	if filename == "" {
+		filename, err = downloadFilename(url, resp)
+		if err != nil {
+			sendError(safeConn, id, ErrorCodeNotAFile, err.Error())
+			return
+		}
+	}
+
+	// Mirar los primeros bytes: un enlace caducado suele devolver una página
+	// de error HTML con 200 y Content-Length
+	contentType, sniffed, err := sniffContent(client, resolvedURL, opts.Credentials)
+	if err != nil {
+		log.Printf("Could not sniff content of %s: %v", url, err)
+	}
+	if contentType == "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	if !checkContentType(safeConn, id, filename, opts.ExpectedContentType, contentType, sniffed) {
+		return
+	}
+
+	// La misma URL hacia otro archivo es otra descarga; hacia el mismo no
+	if other := findChunkedDuplicate(id, url, downloadDir, filename); other != "" {
+		sendError(safeConn, id, ErrorCodeAlreadyInProgress, fmt.Sprintf("Download already in progress to %s (download %s)",
+			filepath.Join(downloadDir, filename), other))
+		return
 	}
 
 	// Obtener tamaño del archivo
 	contentLength := resp.ContentLength
 	if contentLength <= 0 {
-		sendMessage(safeConn, "error", url, "Unable to determine file size")
+		sendError(safeConn, id, ErrorCodeUnknownSize, "Unable to determine file size")
+		return
+	}
+	sendMessage(safeConn, "log", id, fmt.Sprintf("File size: %d bytes", contentLength))
+	if err := checkFileSize(contentLength, opts.MaxFileSize); err != nil {
+		sendError(safeConn, id, ErrorCodeFileTooLarge, err.Error())
 		return
 	}
-	sendMessage(safeConn, "log", url, fmt.Sprintf("File size: %d bytes", contentLength))
 
-	// Determinar nombre de archivo
-	filename := filepath.Base(url)
-	sendMessage(safeConn, "log", url, fmt.Sprintf("Downloading file: %s", filename))
+	// Los mirrors deben servir el mismo archivo
+	mirrors, err := checkMirrors(safeConn, id, client, url, opts.Mirrors, contentLength)
+	if err != nil {
+		sendError(safeConn, id, ErrorCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(opts.Mirrors) > 0 {
+		sendMessage(safeConn, "log", id, fmt.Sprintf("Using %d of %d mirrors", len(mirrors), len(opts.Mirrors)))
+	}
+
+	// Validar los rangos solicitados contra el tamaño real
+	var ranges []ByteRange
+	if len(opts.Ranges) > 0 {
+		ranges, err = normalizeRanges(opts.Ranges, contentLength)
+		if err != nil {
+			sendError(safeConn, id, ErrorCodeInvalidRequest, fmt.Sprintf("Invalid ranges: %v", err))
+			return
+		}
+	}
+
+	sendMessage(safeConn, "log", id, fmt.Sprintf("Downloading file: %s", filename))
 
 	// Crear instancia de descarga con tamaño de chunk dinámico
 	chunkSize := DefaultChunkSize
-	if previousSpeed := getPreviousSpeed(url); previousSpeed > 0 {
+	if opts.ChunkSize > 0 {
+		chunkSize = opts.ChunkSize
+	} else if previousSpeed := speedHint(url); previousSpeed > 0 {
 		chunkSize = calculateOptimalChunkSize(previousSpeed)
 	}
-	download := NewChunkedDownload(url, filename, contentLength, chunkSize)
+	download := newChunkedDownload(url, filename, contentLength, chunkSize)
+	download.ID = id
+	if opts.MaxConcurrentChunks > 0 {
+		download.MaxConcurrentChunks = opts.MaxConcurrentChunks
+	}
+	download.Ranges = ranges
+	download.Protocol = resp.Proto
+	download.SetValidators(resp.Header)
+	download.HTTPProtocol = opts.httpProtocol()
+	download.Proxy = opts.Proxy
+	download.Webhook = opts.Webhook
+	download.ResolvedURL = resolvedURL
+	download.Mirrors = mirrors
+	download.RotateEdges(edgeRotationThreshold)
+	download.DownloadDir = downloadDir
+	if tempBase != tempBaseDir() {
+		download.TempBase = tempBase
+		download.TempDir = filepath.Join(tempBase, filename)
+		rememberTempRoot(tempBase)
+	}
+	// Dos descargas con el mismo nombre (la misma URL hacia otro directorio,
+	// o URLs distintas) no pueden compartir el directorio de chunks
+	if tempDirInUse(download.TempDir) {
+		download.TempDir += "-" + id
+	}
+	download.Overwrite = opts.Overwrite
+	download.DirectWrite = opts.DirectWrite || directWrite
+	download.FastMode = opts.FastMode
+	download.Credentials = opts.Credentials
+	download.ExpectedChecksum = opts.ExpectedChecksum
+	download.ChecksumAlgorithm = opts.ChecksumAlgorithm
+	if len(ranges) > 0 {
+		sendMessage(safeConn, "log", id, fmt.Sprintf("Downloading %d ranges (%d of %d bytes) into a sparse file",
+			len(ranges), download.RequestedBytes(), contentLength))
+	}
+
+	// No empezar una descarga que va a llenar el disco a mitad
+	if err := checkDiskSpace(download, tempBase); err != nil {
+		sendError(safeConn, id, ErrorCodeInsufficientSpace, err.Error())
+		return
+	}
 
 	// Preparar chunks
 	if err := download.PrepareChunks(); err != nil {
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to prepare chunks: %v", err))
+		sendError(safeConn, id, diskErrorCode(err), fmt.Sprintf("Failed to prepare chunks: %v", err))
 		return
 	}
 
+	if download.DirectWrite {
+		if err := download.PreallocatePart(); err != nil {
+			sendError(safeConn, id, diskErrorCode(err), err.Error())
+			return
+		}
+	}
+
+	// Persistir el estado para poder reanudar tras un reinicio del servidor
+	if err := download.SaveManifest(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	// Numerar y registrar chunks
 	numChunks := len(download.Chunks)
-	sendMessage(safeConn, "log", url, fmt.Sprintf("Split into %d chunks", numChunks))
+	sendMessage(safeConn, "log", id, fmt.Sprintf("Split into %d chunks", numChunks))
+	logEvent(safeConn, slog.LevelInfo, "download_started", "url", url, "download_id", id, "filename", filename,
+		"bytes", download.RequestedBytes(), "chunked", true, "chunks", numChunks)
+
+	// Cancelada mientras se creaban los chunks: aún no está registrada, así
+	// que los temporales se borran aquí
+	if preparationCanceled(id) {
+		log.Printf("Download canceled during preparation: %s", url)
+		if err := download.Cleanup(); err != nil {
+			log.Printf("Warning: Failed to clean temporary files: %v", err)
+		}
+		return
+	}
 
 	// Registrar la descarga
-	activeDownloadsMutex.Lock()
-	activeDownloadsMap[url] = download
-	activeDownloadsMutex.Unlock()
+	if !registry.Register(id, download) {
+		sendError(safeConn, id, ErrorCodeAlreadyInProgress, "Download already in progress")
+		return
+	}
+
+	// Una pausa o cancelación recibida desde aquí se atiende entre pasos,
+	// antes de lanzar los workers. En pausa la descarga sigue registrada
+	interrupted := func() bool {
+		stop, held := holdPreparedDownload(safeConn, download)
+		launched = held
+		return stop
+	}
+	if interrupted() {
+		return
+	}
 
 	// Asegurar que eliminamos la descarga en caso de error
 	defer func() {
 		if r := recover(); r != nil {
-			sendMessage(safeConn, "error", url, fmt.Sprintf("Download crashed: %v", r))
-			activeDownloadsMutex.Lock()
-			delete(activeDownloadsMap, url)
-			activeDownloadsMutex.Unlock()
+			sendError(safeConn, id, ErrorCodeInternal, fmt.Sprintf("Download crashed: %v", r))
+			registry.Remove(id)
 		}
 	}()
 
 	// Ensure all initial messages are sent with delays
-	time.Sleep(100 * time.Millisecond)
+	uiDelay(download, 100*time.Millisecond)
+	if interrupted() {
+		return
+	}
 
 	// Reportar estado inicial
-	sendProgress(safeConn, url, 0, contentLength, 0, "starting")
-	sendMessage(safeConn, "log", url, "📥 0.0%")
-	time.Sleep(300 * time.Millisecond) // Longer delay for UI to reflect starting state
+	sendProgress(safeConn, id, 0, download.RequestedBytes(), 0, StatusStarting)
+	sendMessage(safeConn, "log", id, "📥 0.0%")
+	uiDelay(download, 300*time.Millisecond) // Longer delay for UI to reflect starting state
+	if interrupted() {
+		return
+	}
 
 	// Luego reportar los chunks en un bloque de RLock
-	download.mu.RLock()
-	for _, chunk := range download.Chunks {
-		safeConn.SendJSON(map[string]interface{}{
-			"type": "chunk_init",
-			"url":  url,
-			"chunk": ChunkProgress{
-				ID:     chunk.ID,
-				Start:  chunk.Start,
-				End:    chunk.End,
-				Status: chunk.Status,
-			},
-		})
-		// Shorter delay between chunks
-		time.Sleep(5 * time.Millisecond)
-	}
-	download.mu.RUnlock()
+	sendChunksInit(safeConn, download)
 
 	// One final delay before starting download
-	time.Sleep(200 * time.Millisecond)
+	uiDelay(download, 200*time.Millisecond)
+	// Desde aquí una pausa sigue el camino normal de pauseChunkedDownload;
+	// la anotada hasta ahora se atiende todavía como parte de la preparación
+	if paused, tracked := registry.EndPreparing(id); (paused || !tracked) && interrupted() {
+		return
+	}
+	download.SetStatus(StatusDownloading)
 
 	// Iniciar proceso de descarga en background
+	launched = true
 	go func() {
 		defer func() {
-			// Asegurar que eliminamos la descarga al terminar
-			activeDownloadsMutex.Lock()
-			delete(activeDownloadsMap, url)
-			activeDownloadsMutex.Unlock()
+			// Asegurar que eliminamos la descarga al terminar, salvo que esté
+			// pausada: en ese caso debe seguir registrada para poder reanudarla
+			if paused, _ := registry.IsPaused(id); paused {
+				return
+			}
+			registry.Remove(id)
 		}()
 
 		// Cliente HTTP para las descargas - optimizado para mejor rendimiento
-		downloadClient := &http.Client{
-			Timeout: 0, // Sin timeout
-			Transport: &http.Transport{
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-				DisableCompression:    true,
-				ForceAttemptHTTP2:     true,
-				DisableKeepAlives:     false,            // Asegurar que keep-alives esté habilitado
-				MaxConnsPerHost:       20,               // Aumentar conexiones por host (antes 10)
-				ResponseHeaderTimeout: 30 * time.Second, // Aumentar timeout (antes 15s)
-				TLSHandshakeTimeout:   10 * time.Second,
-			},
-		}
+		downloadClient := newChunkClient(download, 20) // Aumentar conexiones por host (antes 10)
 
 		// Usar un WaitGroup en lugar de errgroup
 		var wg sync.WaitGroup
-		sem := make(chan struct{}, MaxConcurrentChunks)
+		slots := download.NewChunkSlots()
+		stopTuner := startConcurrencyTuner(safeConn, download, slots)
 		var downloadError error
 		var errorMutex sync.Mutex
 
 		// Iniciar descarga para cada chunk
 		for _, chunk := range download.Chunks {
 			currentChunk := chunk // Importante para evitar capturas de variables incorrectas
-			sem <- struct{}{}     // Adquirir un slot
+			slots.Acquire()       // Adquirir un slot
 			wg.Add(1)
 			go func() {
 				defer func() {
-					<-sem // Liberar slot al terminar
+					slots.Release() // Liberar slot al terminar
 					wg.Done()
 				}()
 				if err := download.DownloadChunk(downloadClient, currentChunk, safeConn); err != nil {
 					errorMutex.Lock()
 					downloadError = err
 					errorMutex.Unlock()
+					download.AbortOnDiskError(err)
 				}
 			}()
 		}
 
-		// Esperar a que todos los chunks se completen
+		// Esperar a que todos los chunks se completen, con un progreso
+		// periódico aunque ninguno avance
+		stopHeartbeat := startProgressHeartbeat(safeConn, download)
 		wg.Wait()
+		stopHeartbeat()
+		stopTuner()
 
-		if downloadError != nil {
-			sendMessage(safeConn, "error", url, fmt.Sprintf("Download failed: %v", downloadError))
+		// Si los chunks terminaron por una pausa no es un error: la reanudación
+		// se encarga de completar la descarga
+		if paused, _ := registry.IsPaused(id); paused {
+			log.Printf("Chunk workers stopped for paused download: %s", url)
+			return
+		}
+		if download.CurrentStatus() == StatusCanceled {
+			log.Printf("Chunk workers stopped for canceled download: %s", url)
 			return
 		}
 
-		// SIMPLIFIED COMPLETION SEQUENCE with more robust error handling
-		if download.IsComplete() {
-			// Get destination path
-			home, err := os.UserHomeDir()
-			if err != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to get home directory: %v", err))
-				return
-			}
-			downloadDir := filepath.Join(home, "Downloads")
-			destPath := filepath.Join(downloadDir, filename)
+		if errors.Is(downloadError, errRangeIgnored) {
+			fallbackToSingleStream(safeConn, download)
+			return
+		}
+		if errors.Is(downloadError, errRemoteChanged) {
+			handleRemoteChanged(safeConn, download)
+			return
+		}
+		if errors.Is(downloadError, errDiskWrite) {
+			handleDiskError(safeConn, download, downloadError)
+			return
+		}
+		if downloadError != nil {
+			recoverChunkFailure(safeConn, download, fmt.Errorf("download failed: %w", downloadError))
+			return
+		}
 
-			if err := os.MkdirAll(downloadDir, 0755); err != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to create download directory: %v", err))
-				return
-			}
+		finishDownload(safeConn, download, downloadClient)
+	}()
+}
 
-			// STRICTLY ORDERED SEQUENCE with more verbose logging:
-			// 1. First check all chunks are really complete
-			for _, chunk := range download.Chunks {
-				chunk.mu.Lock()
-				if chunk.Status != ChunkCompleted {
-					errMsg := fmt.Sprintf("Chunk %d not completed (status: %s, progress: %d/%d)",
-						chunk.ID, chunk.Status, chunk.Progress,
-						chunk.End-chunk.Start+1)
-					chunk.mu.Unlock()
-					sendMessage(safeConn, "error", url, errMsg)
-					return
-				}
-				chunk.mu.Unlock()
-			}
+// preparationCanceled indica si se canceló la descarga antes de registrarla:
+// cancelar deja de rastrearla aunque aún no tenga chunks
+func preparationCanceled(id string) bool {
+	_, tracked := registry.IsPaused(id)
+	return !tracked
+}
 
-			log.Printf("All chunks verified complete for %s, starting completion sequence", url)
+// holdPreparedDownload atiende una pausa o cancelación recibida mientras se
+// preparaba una descarga ya registrada. Con pausa la deja en pausa con sus
+// chunks y su manifiesto, sin haber transferido nada, y resume_download la
+// arranca como cualquier otra. stop indica que la preparación debe terminar y
+// held que la descarga sigue registrada
+func holdPreparedDownload(safeConn *SafeConn, download *ChunkedDownload) (stop, held bool) {
+	id := download.ID
+	paused, tracked := registry.IsPaused(id)
+	if !tracked || download.CurrentStatus() == StatusCanceled {
+		log.Printf("Download canceled during preparation: %s", download.URL)
+		return true, false
+	}
+	if !paused {
+		return false, false
+	}
 
-			// 2. Send 99.9% progress with explicit log message to debug
-			sendProgress(safeConn, url, download.Size-1, download.Size, 0, "downloading")
-			log.Printf("Sent 99.9%% progress for %s", url)
-			sendMessage(safeConn, "log", url, "📥 99.9%")
-			time.Sleep(500 * time.Millisecond) // Longer delay for UI to catch up
+	log.Printf("Download paused during preparation: %s", download.URL)
+	registry.EndPreparing(id)
+	downloadSlots.Release(id)
+	download.SetStatus(StatusPaused)
+	if err := download.SaveManifest(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 
-			// 3. Then 100% progress with explicit log message
-			sendProgress(safeConn, url, download.Size, download.Size, 0, "completed")
-			log.Printf("Sent 100.0%% progress for %s", url)
-			sendMessage(safeConn, "log", url, "📥 100.0%")
-			time.Sleep(500 * time.Millisecond)
+	downloaded, total := download.GetProgress()
+	sendMessage(safeConn, "pause_confirmed", id, "Download paused before it started")
+	logEvent(safeConn, slog.LevelInfo, "download_paused", "url", download.URL, "download_id", id, "bytes", downloaded, "total", total)
+	sendProgress(safeConn, id, downloaded, total, 0, StatusPaused)
+	return true, true
+}
 
-			// 4. Send download complete notification to trigger UI updates
-			safeConn.SendJSON(map[string]interface{}{
-				"type": "download_complete",
-				"url":  url,
-			})
-			time.Sleep(300 * time.Millisecond)
+// uiDelay espera delay entre dos mensajes para que la UI llegue a mostrar el
+// primero, salvo con --no-ui-delays o fast_mode
+func uiDelay(d *ChunkedDownload, delay time.Duration) {
+	if noUIDelays || d.FastMode {
+		return
+	}
+	time.Sleep(delay)
+}
 
-			// 5. Then merging message
-			log.Printf("Starting merge for %s", url)
-			sendMessage(safeConn, "log", url, "🔄 Merging chunks...")
+// sendChunksInit anuncia la distribución de chunks al cliente. Por defecto se
+// envía un único mensaje chunks_init con todos los chunks; con
+// --individual-chunk-init se mantiene el antiguo chunk_init por chunk
+func sendChunksInit(safeConn *SafeConn, download *ChunkedDownload) {
+	download.RLock()
+	defer download.RUnlock()
+
+	chunks := make([]ChunkProgress, 0, len(download.Chunks))
+	for _, state := range download.ChunkStates() {
+		chunks = append(chunks, ChunkProgress{
+			ID:     state.ID,
+			Start:  state.Start,
+			End:    state.End,
+			Status: state.Status,
+		})
+	}
 
-			// Send merge_start notification to ensure client sees it
-			safeConn.SendJSON(map[string]interface{}{
-				"type": "merge_start",
-				"url":  url,
+	if individualChunkInit {
+		for _, chunk := range chunks {
+			publishEvent(safeConn, map[string]interface{}{
+				"type":        "chunk_init",
+				"download_id": download.ID,
+				"chunk":       chunk,
 			})
-			time.Sleep(300 * time.Millisecond)
-
-			// 6. Perform actual merge with retry
-			var mergeErr error
-			for attempt := 0; attempt < 3; attempt++ {
-				if attempt > 0 {
-					sendMessage(safeConn, "log", url, fmt.Sprintf("Retrying merge (attempt %d/3)...", attempt+1))
-					time.Sleep(time.Second * time.Duration(attempt+1))
-				}
-
-				if err := download.MergeChunks(destPath); err != nil {
-					mergeErr = err
-					log.Printf("Merge attempt %d failed: %v", attempt+1, err)
-				} else {
-					mergeErr = nil
-					break
-				}
-			}
-
-			if mergeErr != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to merge chunks: %v", mergeErr))
-				return
-			}
-
-			time.Sleep(300 * time.Millisecond)
-
-			// 7. Download completed message with explicit log
-			log.Printf("Download completed successfully: %s", url)
-			sendMessage(safeConn, "log", url, "✅ Download completed successfully")
-			time.Sleep(500 * time.Millisecond)
-
-			// 8. Calculate checksum (just once) with explicit log
-			log.Printf("Starting checksum calculation for %s", url)
-			handleCalculateChecksum(safeConn, url, filename)
-
-			// 9. Cleanup temporary files in background to avoid blocking
-			go func() {
-				if err := download.Cleanup(); err != nil {
-					log.Printf("Warning: Failed to clean temporary files: %v", err)
-				}
-			}()
-		} else {
-			// Add detailed error about incomplete chunks
-			incompleteChunks := []int{}
-			download.mu.RLock()
-			for _, chunk := range download.Chunks {
-				chunk.mu.Lock()
-				if chunk.Status != ChunkCompleted {
-					incompleteChunks = append(incompleteChunks, chunk.ID)
-				}
-				chunk.mu.Unlock()
-			}
-			download.mu.RUnlock()
-
-			errorMsg := fmt.Sprintf("Download incomplete: %d/%d chunks not completed. IDs: %v",
-				len(incompleteChunks), len(download.Chunks), incompleteChunks)
-			sendMessage(safeConn, "error", url, errorMsg)
+			// Shorter delay between chunks
+			uiDelay(download, 5*time.Millisecond)
 		}
-	}()
+		return
+	}
+
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "chunks_init",
+		"download_id": download.ID,
+		"chunks":      chunks,
+	})
 }
 
 // Función mejorada para pausar una descarga por chunks
-func pauseChunkedDownload(safeConn *SafeConn, url string) {
+func pauseChunkedDownload(safeConn *SafeConn, id string) {
+	url := downloadIDs.URL(id)
 	log.Printf("Server: Pausing download: %s", url)
 
-	// First update speed history before pausing
-	if download, exists := activeDownloadsMap[url]; exists {
-		downloaded, _ := download.GetProgress() // Remove unused total variable
-		// Convert downloaded to float64 for speed calculation
-		updateSpeedHistory(url, float64(downloaded))
+	// Aún preparándose: la preparación se detiene antes de transferir nada y
+	// confirma la pausa (ver holdPreparedDownload)
+	if registry.PauseIfPreparing(id) {
+		log.Printf("Pause requested during preparation: %s", url)
+		sendMessage(safeConn, "log", id, "Pause requested, the download will stop before transferring any data")
+		return
 	}
 
 	// CRITICAL: Set paused state BEFORE sending pause to chunks
-	activeDownloadsMutex.RLock()
-	download, exists := activeDownloadsMap[url]
-	activeDownloadsMutex.RUnlock()
+	download, exists := registry.Get(id)
 
 	if !exists {
-		log.Printf("No chunked download found to pause for: %s", url)
-		// Enviar confirmación de todas formas para mantener la UI consistente
-		sendMessage(safeConn, "pause_confirmed", url, "Download paused successfully")
+		// Descarga de una sola conexión: handleDownload deja de escribir en
+		// cuanto SetPaused vuelve (ver RunIfActive) y conserva su hueco
+		if !registry.SetPaused(id, true) {
+			log.Printf("No download found to pause for: %s", url)
+			sendError(safeConn, id, ErrorCodeNotFound, "No active download found to pause")
+			return
+		}
+		log.Printf("Paused single-connection download: %s", url)
+		sendMessage(safeConn, "pause_confirmed", id, "Download paused successfully")
 		return
 	}
 
 	log.Printf("Pausing chunked download: %s", url)
 
-	// Marcar la descarga como pausada y pausar todos los chunks
-	download.mu.Lock()
-	download.Paused = true
-	download.mu.Unlock()
+	// Marcar la descarga como pausada (estado global y descarga a la vez) y
+	// ceder su hueco a la siguiente descarga en cola
+	registry.SetPaused(id, true)
+	downloadSlots.Release(id)
 
 	// Pausar todos los chunks y esperar confirmación
 	download.PauseAllChunks()
 
-	// Actualizar estado global DESPUÉS de pausar los chunks
-	activeDownloadsMux.Lock()
-	activeDownloadsState[url] = downloadState{active: true, paused: true}
-	activeDownloadsMux.Unlock()
-
 	// Enviar mensaje detallado de log
-	sendMessage(safeConn, "log", url, "Download paused successfully by server")
+	sendMessage(safeConn, "log", id, "Download paused successfully by server")
 
 	// Notificar progreso actual para actualizar UI
 	downloaded, total := download.GetProgress()
 
 	// IMPORTANTE: Enviar mensaje de pausa confirmada PRIMERO
-	sendMessage(safeConn, "pause_confirmed", url, "Download paused successfully")
+	sendMessage(safeConn, "pause_confirmed", id, "Download paused successfully")
+	logEvent(safeConn, slog.LevelInfo, "download_paused", "url", url, "download_id", id, "bytes", downloaded, "total", total)
 	// Luego enviar actualización de progreso
-	progress := map[string]interface{}{
-		"type":          "progress",
-		"url":           url,
-		"bytesReceived": downloaded,
-		"totalBytes":    total,
-		"speed":         0,
-		"status":        "paused",
-	}
-	safeConn.SendJSON(progress)
-
-	// Reportar estado actual de todos los chunks para la UI
-	download.mu.RLock()
-	for _, chunk := range download.Chunks {
-		chunk.mu.Lock()
-		safeConn.SendJSON(map[string]interface{}{
-			"type": "chunk_progress",
-			"url":  url,
-			"chunk": ChunkProgress{
-				ID:       chunk.ID,
-				Start:    chunk.Start,
-				End:      chunk.End,
-				Progress: chunk.Progress,
-				Status:   chunk.Status,
-				Speed:    0, // Velocidad cero al pausar
-			},
+	download.SetStatus(StatusPaused)
+	sendProgress(safeConn, id, downloaded, total, 0, StatusPaused)
+	if err := download.SaveManifest(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Reportar estado actual de todos los chunks para la UI (velocidad cero)
+	for _, chunk := range download.ChunkStates() {
+		publishEvent(safeConn, map[string]interface{}{
+			"type":        "chunk_progress",
+			"download_id": id,
+			"chunk":       chunk,
 		})
-		chunk.mu.Unlock()
 	}
-	download.mu.RUnlock()
 	log.Printf("Download paused successfully: %s", url)
 }
 
 // Función mejorada para reanudar una descarga por chunks
-func resumeChunkedDownload(safeConn *SafeConn, url string) {
+func resumeChunkedDownload(safeConn *SafeConn, id string) {
+	url := downloadIDs.URL(id)
 	log.Printf("Server: Resuming download: %s", url)
 
-	activeDownloadsMutex.RLock()
-	download, exists := activeDownloadsMap[url]
-	activeDownloadsMutex.RUnlock()
-
+	download, exists := registry.Get(id)
 	if !exists {
 		log.Printf("No download found to resume: %s", url)
-		sendMessage(safeConn, "error", url, "No download found to resume")
+		sendError(safeConn, id, ErrorCodeNotFound, "No download found to resume")
 		return
 	}
 
-	// First update global state
-	activeDownloadsMux.Lock()
-	activeDownloadsState[url] = downloadState{active: true, paused: false}
-	activeDownloadsMux.Unlock()
+	// Sin permiso de escritura los chunks fallarían uno a uno; se avisa antes
+	// de reanudar y la descarga sigue en pausa
+	if err := checkWritableDirs(download); err != nil {
+		log.Printf("Cannot resume %s: %v", url, err)
+		sendError(safeConn, id, ErrorCodeNotWritable, err.Error())
+		return
+	}
+
+	// Tras un fallo recuperable al finalizar, la reanudación lo repite
+	registry.RearmFinish(id)
 
-	// Reset download state
-	download.mu.Lock()
-	download.Paused = false
-	download.mu.Unlock()
+	// Actualizar estado global y de la descarga en un solo paso
+	registry.SetPaused(id, false)
+	download.SetStatus(StatusDownloading)
+	download.MarkResumed()
+
+	// Reconstruir las rutas de los chunks desde la raíz temporal actual por si
+	// el directorio temporal se movió desde que empezó la descarga
+	download.RelocateTempDir(filepath.Join(tempRoot(download), filepath.Base(download.TempDir)))
 
 	// Send initial resume confirmation
-	sendMessage(safeConn, "resume_confirmed", url, "Download resumed successfully")
+	sendMessage(safeConn, "resume_confirmed", id, "Download resumed successfully")
+	logEvent(safeConn, slog.LevelInfo, "download_resumed", "url", url, "download_id", id)
 
 	// Create fresh HTTP client for resuming
-	downloadClient := &http.Client{
-		Timeout: 0,
-		Transport: &http.Transport{
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			DisableCompression:    true,
-			ForceAttemptHTTP2:     true,
-			MaxConnsPerHost:       10,
-			TLSHandshakeTimeout:   10 * time.Second,
-			DisableKeepAlives:     false,
-			ResponseHeaderTimeout: 30 * time.Second,
-		},
-	}
+	downloadClient := newChunkClient(download, 10)
 
 	var wg sync.WaitGroup
-	sem := make(chan struct{}, MaxConcurrentChunks)
+	slots := download.NewChunkSlots()
+	stopTuner := startConcurrencyTuner(safeConn, download, slots)
 	var downloadError error
 	var errorMutex sync.Mutex
 
 	// Resume each non-completed chunk
-	download.mu.RLock()
-	for _, chunk := range download.Chunks {
-		chunk.mu.Lock()
-		if chunk.Status != ChunkCompleted {
-			chunk.Status = ChunkPending
-			chunk.cancelCtx = make(chan struct{})
-			currentChunk := chunk
-			chunk.mu.Unlock()
-
-			sem <- struct{}{}
-			wg.Add(1)
-			go func() {
-				defer func() {
-					<-sem
-					wg.Done()
-				}()
-				if err := download.DownloadChunk(downloadClient, currentChunk, safeConn); err != nil {
-					errorMutex.Lock()
-					downloadError = err
-					errorMutex.Unlock()
-				}
+	for _, chunk := range download.ResetPendingChunks() {
+		currentChunk := chunk
+		slots.Acquire()
+		wg.Add(1)
+		go func() {
+			defer func() {
+				slots.Release()
+				wg.Done()
 			}()
-		} else {
-			chunk.mu.Unlock()
-		}
+			if err := download.DownloadChunk(downloadClient, currentChunk, safeConn); err != nil {
+				errorMutex.Lock()
+				downloadError = err
+				errorMutex.Unlock()
+				download.AbortOnDiskError(err)
+			}
+		}()
 	}
-	download.mu.RUnlock()
 
 	// Wait for all chunks and handle completion
 	go func() {
+		// Dejar de rastrear la descarga al terminar (y liberar su hueco en la
+		// cola), salvo que se haya vuelto a pausar
+		defer func() {
+			if paused, _ := registry.IsPaused(id); paused {
+				return
+			}
+			registry.Remove(id)
+		}()
+
+		stopHeartbeat := startProgressHeartbeat(safeConn, download)
 		wg.Wait()
+		stopHeartbeat()
+		stopTuner()
+		if paused, _ := registry.IsPaused(id); paused {
+			log.Printf("Chunk workers stopped for paused download: %s", url)
+			return
+		}
+		if download.CurrentStatus() == StatusCanceled {
+			log.Printf("Chunk workers stopped for canceled download: %s", url)
+			return
+		}
+		if errors.Is(downloadError, errRangeIgnored) {
+			fallbackToSingleStream(safeConn, download)
+			return
+		}
+		if errors.Is(downloadError, errRemoteChanged) {
+			handleRemoteChanged(safeConn, download)
+			return
+		}
+		if errors.Is(downloadError, errDiskWrite) {
+			handleDiskError(safeConn, download, downloadError)
+			return
+		}
 		if downloadError != nil {
-			sendMessage(safeConn, "error", url, fmt.Sprintf("Resume failed: %v", downloadError))
+			recoverChunkFailure(safeConn, download, fmt.Errorf("resume failed: %w", downloadError))
 			return
 		}
 
-		// Replace handleCompletedDownload with direct completion handling
-		if download.IsComplete() {
-			// Get destination path
-			home, err := os.UserHomeDir()
-			if err != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to get home directory: %v", err))
-				return
-			}
-			downloadDir := filepath.Join(home, "Downloads")
-			destPath := filepath.Join(downloadDir, download.Filename)
+		finishDownload(safeConn, download, downloadClient)
+	}()
+}
 
-			if err := os.MkdirAll(downloadDir, 0755); err != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to create download directory: %v", err))
-				return
+// finishDownload completa una descarga cuyos workers ya terminaron sin error:
+// revalida los chunks, los une y calcula el checksum. La usan tanto el inicio
+// como la reanudación; la secuencia de merge corre una sola vez por descarga
+// aunque ambas terminen a la vez, para que una no borre los temporales de la otra
+func finishDownload(safeConn *SafeConn, download *ChunkedDownload, client *http.Client) {
+	id := download.ID
+	url := download.URL
+
+	if !download.IsComplete() {
+		// Add detailed error about incomplete chunks
+		incompleteChunks := []int{}
+		for _, state := range download.ChunkStates() {
+			if state.Status != ChunkCompleted {
+				incompleteChunks = append(incompleteChunks, state.ID)
 			}
+		}
 
-			// STRICTLY ORDERED SEQUENCE:
-			// 1. First send 99.9% progress
-			sendProgress(safeConn, url, download.Size-1, download.Size, 0, "downloading")
-			sendMessage(safeConn, "log", url, "📥 99.9%")
-			time.Sleep(300 * time.Millisecond)
+		recoverChunkFailure(safeConn, download, fmt.Errorf("download incomplete: %d/%d chunks not completed. IDs: %v",
+			len(incompleteChunks), len(download.Chunks), incompleteChunks))
+		return
+	}
 
-			// 2. Then 100% progress
-			sendProgress(safeConn, url, download.Size, download.Size, 0, "completed")
-			sendMessage(safeConn, "log", url, "📥 100.0%")
-			time.Sleep(300 * time.Millisecond)
+	// Los contadores pueden no cuadrar con el disco: volver a bajar
+	// los chunks cuyo archivo no tiene el tamaño esperado
+	if err := revalidateChunks(safeConn, download, client); err != nil {
+		sendError(safeConn, id, networkErrorCode(err, ErrorCodeDownloadFailed), err.Error())
+		reportFinalStatus(safeConn, download, StatusFailed)
+		notifyDownloadFailed(download, err.Error())
+		return
+	}
+	if download.IsPaused() {
+		return
+	}
 
-			// 3. Then merging message
-			sendMessage(safeConn, "log", url, "🔄 Merging chunks...")
+	if !registry.BeginFinish(id) {
+		log.Printf("Completion sequence already ran for %s, skipping", url)
+		return
+	}
+	completeChunkedDownload(safeConn, download)
+}
 
-			// 4. Perform actual merge
-			if err := download.MergeChunks(destPath); err != nil {
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to merge chunks: %v", err))
-				return
-			}
-			time.Sleep(300 * time.Millisecond)
+// completeChunkedDownload es la secuencia de finalización de finishDownload:
+// progreso al 100%, merge, verificación, download_complete, checksum y limpieza
+func completeChunkedDownload(safeConn *SafeConn, download *ChunkedDownload) {
+	id := download.ID
+	url := download.URL
 
-			// 5. Download completed message
-			sendMessage(safeConn, "log", url, "✅ Download completed successfully")
-			time.Sleep(300 * time.Millisecond)
+	// Get destination path, numbering the name if the file exists
+	downloadDir := download.DownloadDir
+	destPath := destinationPath(download)
+	savedName := filepath.Base(destPath)
 
-			// 6. Calculate checksum (just once)
-			handleCalculateChecksum(safeConn, url, download.Filename)
+	if err := makeDownloadDir(downloadDir); err != nil {
+		recoverFinishFailure(safeConn, download, "destination", diskErrorCode(err), fmt.Errorf("failed to create download directory: %w", err))
+		return
+	}
 
-			// 7. Cleanup temporary files
-			if err := download.Cleanup(); err != nil {
-				log.Printf("Warning: Failed to clean temporary files: %v", err)
-			}
+	// STRICTLY ORDERED SEQUENCE with more verbose logging:
+	// 1. First check all chunks are really complete
+	for _, state := range download.ChunkStates() {
+		if state.Status != ChunkCompleted {
+			errMsg := fmt.Sprintf("Chunk %d not completed (status: %s, progress: %d/%d)",
+				state.ID, state.Status, state.Progress,
+				state.End-state.Start+1)
+			sendError(safeConn, id, ErrorCodeDownloadFailed, errMsg)
+			return
+		}
+	}
+
+	log.Printf("All chunks verified complete for %s, starting completion sequence", url)
+
+	// 2. Then 100% progress with explicit log message
+	requested := download.RequestedBytes()
+	sendProgress(safeConn, id, requested, requested, 0, StatusCompleted)
+	log.Printf("Sent 100.0%% progress for %s", url)
+	sendMessage(safeConn, "log", id, "📥 100.0%")
+	uiDelay(download, 500*time.Millisecond)
+
+	// 3. Then merging message
+	log.Printf("Starting merge for %s", url)
+	sendMessage(safeConn, "log", id, "🔄 Merging chunks...")
+
+	// Send merge_start notification to ensure client sees it
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "merge_start",
+		"download_id": id,
+	})
+	uiDelay(download, 300*time.Millisecond)
+
+	// 4. Perform actual merge with retry
+	var mergeErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			sendMessage(safeConn, "log", id, fmt.Sprintf("Retrying merge (attempt %d/3)...", attempt+1))
+			time.Sleep(time.Second * time.Duration(attempt+1))
+		}
+
+		if err := download.MergeChunks(destPath); err != nil {
+			mergeErr = err
+			log.Printf("Merge attempt %d failed: %v", attempt+1, err)
+		} else {
+			mergeErr = nil
+			break
+		}
+	}
+
+	// Los chunks siguen en disco: reanudar repite el merge
+	if mergeErr != nil {
+		code := ErrorCodeMergeFailed
+		if isDiskFull(mergeErr) {
+			code = ErrorCodeDiskFull
+		}
+		recoverFinishFailure(safeConn, download, "merge", code, fmt.Errorf("failed to merge chunks: %w", mergeErr))
+		return
+	}
+
+	// 5. Verify the expected checksum before declaring success. Los
+	// temporales solo se borran cuando ha pasado
+	if !verifyExpectedChecksum(safeConn, download, destPath) {
+		return
+	}
+	uiDelay(download, 300*time.Millisecond)
+
+	// 6. Download completed event and message with explicit log
+	log.Printf("Download completed successfully: %s", url)
+	applyOwnership(destPath)
+	download.SetStatus(StatusCompleted)
+	sendDownloadComplete(safeConn, id, destPath, requested, download.StartedAt)
+	sendMessage(safeConn, "log", id, fmt.Sprintf("✅ Download completed successfully: %s", savedName))
+	notifyDownloadResult(savedName, true, destPath)
+	uiDelay(download, 500*time.Millisecond)
+
+	// 7. Calculate checksum (just once) with explicit log
+	log.Printf("Starting checksum calculation for %s", url)
+	handleDownloadChecksum(safeConn, download, downloadDir, savedName, func(checksum string) {
+		fireDownloadWebhook(download, destPath, checksum, "")
+	})
+
+	// 8. Cleanup temporary files in background to avoid blocking
+	go func() {
+		if err := download.Cleanup(); err != nil {
+			log.Printf("Warning: Failed to clean temporary files: %v", err)
 		}
 	}()
 }
 
 // cancelChunkedDownload cancela una descarga en progreso
-func cancelChunkedDownload(safeConn *SafeConn, url string) {
-	activeDownloadsMutex.RLock()
-	download, exists := activeDownloadsMap[url]
-	activeDownloadsMutex.RUnlock()
-
+func cancelChunkedDownload(safeConn *SafeConn, id string) {
+	url := downloadIDs.URL(id)
+	download, exists := registry.Get(id)
 	if !exists {
-		sendMessage(safeConn, "log", url, "No active download found to cancel")
-		sendMessage(safeConn, "cancel_confirmed", url, "Download already cancelled")
+		// Si aún se está preparando, dejar de rastrearla la detiene (ver
+		// preparationCanceled)
+		registry.Remove(id)
+		sendMessage(safeConn, "log", id, "No active download found to cancel")
+		sendMessage(safeConn, "cancel_confirmed", id, "Download already cancelled")
 		return
 	}
 
+	// Marcar como cancelada antes de detener los chunks para que los workers
+	// no lo interpreten como un fallo
+	download.SetStatus(StatusCanceled)
+
 	// Pausar todos los chunks para detener la descarga
 	download.PauseAllChunks()
 
-	// Eliminar del mapa de descargas activas
-	activeDownloadsMutex.Lock()
-	delete(activeDownloadsMap, url)
-	activeDownloadsMutex.Unlock()
+	// Eliminar del registro de descargas activas
+	registry.Remove(id)
 
 	// Limpiar archivos temporales
 	if err := download.Cleanup(); err != nil {
-		sendMessage(safeConn, "log", url, fmt.Sprintf("Warning: Failed to clean temporary files: %v", err))
+		sendMessage(safeConn, "log", id, fmt.Sprintf("Warning: Failed to clean temporary files: %v", err))
 	}
 
-	sendMessage(safeConn, "log", url, "Download canceled")
-	sendMessage(safeConn, "cancel_confirmed", url, "Download canceled successfully")
+	sendMessage(safeConn, "log", id, "Download canceled")
+	logEvent(safeConn, slog.LevelInfo, "download_canceled", "url", url, "download_id", id)
+	sendMessage(safeConn, "cancel_confirmed", id, "Download canceled successfully")
+	reportFinalStatus(safeConn, download, StatusCanceled)
 }
 
-// isDownloadActive verifica si una URL está siendo descargada
-func isDownloadActive(url string) bool {
-	// Primero verificar el mapa de estados
-	activeDownloadsMux.Lock()
-	state, exists := activeDownloadsState[url]
-	activeDownloadsMux.Unlock()
+// recoverFinishFailure trata un fallo posterior a tener todos los chunks
+// (crear el destino, el merge o el checksum esperado) sin perder lo bajado:
+// conserva los chunks y el manifiesto, deja la descarga en pausa y registrada
+// y avisa con recoverable_failure. Reanudarla repite solo la finalización
+func recoverFinishFailure(safeConn *SafeConn, download *ChunkedDownload, stage, code string, err error) {
+	log.Printf("Finishing %s failed at %s, keeping chunks for a retry: %v", download.URL, stage, err)
+	registry.FailFinish(download.ID)
+	keepForRetry(safeConn, download, stage, code, StatusPaused, err, "resume the download to retry")
+}
 
-	if exists && state.active && !state.paused {
-		return true
-	}
+// recoverChunkFailure trata un chunk que agotó sus reintentos (en todos los
+// mirrors) sin tirar el resto: la descarga queda en failed_recoverable con los
+// chunks terminados y el progreso de los demás, y retry_download vuelve a
+// pedir solo lo que falta
+func recoverChunkFailure(safeConn *SafeConn, download *ChunkedDownload, err error) {
+	log.Printf("Download %s failed, keeping chunks for a retry: %v", download.URL, err)
+	keepForRetry(safeConn, download, "download", networkErrorCode(err, ErrorCodeDownloadFailed), StatusFailedRecoverable, err,
+		"send retry_download to fetch only the missing chunks")
+}
 
-	// Si no está en el mapa o está pausada, verificar en activeDownloadsMap
-	activeDownloadsMutex.RLock()
-	download, existsInMap := activeDownloadsMap[url]
-	activeDownloadsMutex.RUnlock()
+// keepForRetry deja la descarga registrada y en pausa para el registro (no
+// ocupa hueco en la cola), guarda el manifiesto y avisa con
+// recoverable_failure (con el error_code del fallo) y un progreso con status
+func keepForRetry(safeConn *SafeConn, download *ChunkedDownload, stage, code string, status DownloadStatus, err error, hint string) {
+	id := download.ID
+	logEvent(safeConn, slog.LevelError, "recoverable_failure", "url", download.URL, "download_id", id,
+		"stage", stage, "error_code", code, "error", err.Error())
+
+	registry.SetPaused(id, true)
+	downloadSlots.Release(id)
+	download.SetStatus(status)
+	if err := download.SaveManifest(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 
-	return existsInMap && !download.Paused
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "recoverable_failure",
+		"download_id": id,
+		"stage":       stage,
+		"error_code":  code,
+		"message":     fmt.Sprintf("%v. The downloaded chunks were kept; %s", err, hint),
+	})
+	downloaded, total := download.GetProgress()
+	sendProgress(safeConn, id, downloaded, total, 0, status)
+	notifyDownloadFailed(download, err.Error())
 }
 
-// markDownloadActive ahora establece el estado completo
-func markDownloadActive(url string) {
-	activeDownloadsMux.Lock()
-	activeDownloadsState[url] = downloadState{active: true, paused: false}
-	activeDownloadsMux.Unlock()
-	log.Printf("Download tracked: %s (active=%t, paused=%t)",
-		url, true, false)
+// reportFinalStatus registra un estado terminal en la descarga y lo reporta
+// al cliente con un último mensaje de progreso
+func reportFinalStatus(safeConn *SafeConn, download *ChunkedDownload, status DownloadStatus) {
+	download.SetStatus(status)
+	downloaded, total := download.GetProgress()
+	sendProgress(safeConn, download.ID, downloaded, total, 0, status)
 }
 
-// markDownloadInactive limpia el estado
-func markDownloadInactive(url string) {
-	activeDownloadsMux.Lock()
-	delete(activeDownloadsState, url)
-	activeDownloadsMux.Unlock()
-	log.Printf("Download untracked: %s", url)
-}
+// calculateChecksum calcula el checksum del archivo descargado con el
+// algoritmo indicado
+func calculateChecksum(filePath string, algo string) (string, error) {
+	h, err := download.ChecksumHash(algo)
+	if err != nil {
+		return "", err
+	}
 
-// Nueva función para calcular SHA-256 del archivo descargado
-func calculateSHA256(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("error opening file for checksum: %v", err)
 	}
 	defer file.Close()
 
-	hash := sha256.New()
+	hash := h.New()
 
 	// Usar un buffer grande para mejorar rendimiento
-	buf := make([]byte, 8*1024*1024) // 8MB buffer
+	bufPtr := checksumBufferPool.Get().(*[]byte)
+	defer checksumBufferPool.Put(bufPtr)
+	buf := *bufPtr
 
 	start := time.Now()
 	totalBytes := 0
@@ -713,65 +1219,197 @@ func calculateSHA256(filePath string) (string, error) {
 	duration := time.Since(start)
 
 	checksum := fmt.Sprintf("%x", hash.Sum(nil))
-	log.Printf("SHA-256 checksum calculated in %v for %s: %s (processed %d bytes)",
-		duration, filepath.Base(filePath), checksum, totalBytes)
+	log.Printf("%s checksum calculated in %v for %s: %s (processed %d bytes)",
+		h, duration, filepath.Base(filePath), checksum, totalBytes)
 
 	return checksum, nil
 }
 
-// handleCalculateChecksum procesa la solicitud de cálculo de checksum
-func handleCalculateChecksum(safeConn *SafeConn, url string, filename string) {
+// fallbackToSingleStream abandona la descarga por chunks cuando el servidor
+// ignora los rangos y la repite con una sola conexión y las mismas opciones
+func fallbackToSingleStream(safeConn *SafeConn, download *ChunkedDownload) {
+	id, url := download.ID, download.URL
+	log.Printf("Server ignored range requests for %s, falling back to a single connection", url)
+	sendMessage(safeConn, "log", id, "Server ignored range requests, restarting with a single connection")
+
+	download.RLock()
+	opts := DownloadOptions{
+		MaxRate:     download.Limiter.Rate(),
+		Protocol:    download.HTTPProtocol,
+		DownloadDir: download.DownloadDir,
+		Filename:    download.Filename,
+		Credentials: download.Credentials,
+		Proxy:       download.Proxy,
+		Webhook:     download.Webhook,
+		Overwrite:   download.Overwrite,
+	}
+	download.RUnlock()
+
+	// Desasociar la descarga por chunks sin dejar de rastrear la URL, para
+	// que conserve su hueco en la cola de descargas
+	registry.Detach(id)
+	if err := download.Cleanup(); err != nil {
+		log.Printf("Warning: Failed to clean temporary files: %v", err)
+	}
+	handleDownload(safeConn, id, url, opts)
+}
+
+// verifyExpectedChecksum compara el archivo final con el checksum esperado de
+// la descarga. Si no coincide borra el archivo y conserva los chunks para
+// repetir el merge (ver recoverFinishFailure); en modo directo no quedan
+// chunks aparte y la descarga se da por fallida. Devuelve true si la descarga
+// puede darse por completada
+func verifyExpectedChecksum(safeConn *SafeConn, download *ChunkedDownload, destPath string) bool {
+	if download.ExpectedChecksum == "" {
+		return true
+	}
+
+	id, url := download.ID, download.URL
+	algo := download.ChecksumAlgorithm
+	sendMessage(safeConn, "log", id, "🔐 Verifying expected checksum...")
+
+	// Si el merge secuencial ya lo calculó no hace falta releer el archivo
+	actual, code, err := checkFileChecksum(destPath, algo, download.ExpectedChecksum, download.MergeChecksum(algo))
+	if err != nil {
+		log.Printf("Checksum verification failed for %s: %v", url, err)
+		if !download.DirectWrite {
+			recoverFinishFailure(safeConn, download, "checksum", code, err)
+			return false
+		}
+		sendError(safeConn, id, code, err.Error())
+		reportFinalStatus(safeConn, download, StatusFailed)
+		notifyDownloadFailed(download, err.Error())
+		if err := download.Cleanup(); err != nil {
+			log.Printf("Warning: Failed to clean temporary files: %v", err)
+		}
+		return false
+	}
+
+	publishChecksumVerified(safeConn, id, algo, actual)
+	return true
+}
+
+// checkFileChecksum compara el checksum de path (actual, si ya se calculó)
+// con expected y borra el archivo si no coincide. Con error devuelve también
+// el error_code que le corresponde
+func checkFileChecksum(path, algo, expected, actual string) (string, string, error) {
+	var err error
+	if actual == "" {
+		actual, err = calculateChecksum(path, algo)
+	}
+	if err != nil {
+		return "", ErrorCodeChecksumFailed, err
+	}
+	if actual != expected {
+		if removeErr := os.Remove(path); removeErr != nil {
+			log.Printf("Warning: failed to remove %s after checksum mismatch: %v", path, removeErr)
+		}
+		return actual, ErrorCodeChecksumMismatch, fmt.Errorf("checksum mismatch: expected %s got %s", expected, actual)
+	}
+	return actual, "", nil
+}
+
+// publishChecksumVerified avisa de que el archivo coincide con el checksum
+// esperado
+func publishChecksumVerified(safeConn *SafeConn, id, algo, checksum string) {
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "checksum_verified",
+		"download_id": id,
+		"algorithm":   algo,
+		"checksum":    checksum,
+	})
+}
+
+// handleCalculateChecksum procesa la solicitud de cálculo de checksum.
+// onDone (opcional) recibe el resultado, vacío si no se pudo calcular
+func handleCalculateChecksum(safeConn *SafeConn, id string, downloadDir string, filename string, algo string, onDone func(checksum string)) {
+	done := func(checksum string) {
+		if onDone != nil {
+			onDone(checksum)
+		}
+	}
+
 	log.Printf("Calculating checksum for: %s", filename)
-	// Generar ruta del archivo
-	home, err := os.UserHomeDir()
+	if algo == "" {
+		algo = DefaultChecksumAlgorithm
+	}
+	algo = strings.ToLower(algo)
+	h, err := download.ChecksumHash(algo)
 	if err != nil {
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Failed to get home directory: %v", err))
+		sendError(safeConn, id, ErrorCodeInvalidRequest, err.Error())
+		done("")
 		return
 	}
-	filePath := filepath.Join(home, "Downloads", filename)
+
+	// Generar ruta del archivo
+	filePath := filepath.Join(downloadDir, filename)
 
 	// Verificar que el archivo existe
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		sendMessage(safeConn, "error", url, fmt.Sprintf("File not found for checksum: %v", err))
+		sendError(safeConn, id, ErrorCodeChecksumFailed, fmt.Sprintf("File not found for checksum: %v", err))
+		done("")
 		return
 	}
 
 	// Iniciar el cálculo en una goroutine separada
 	go func() {
-		sendMessage(safeConn, "log", url, "🔐 Starting SHA-256 checksum calculation...")
+		acquireChecksumSlot(safeConn, id, filename)
+		defer releaseChecksumSlot()
+
+		sendMessage(safeConn, "log", id, fmt.Sprintf("🔐 Starting %s checksum calculation...", h))
 
 		start := time.Now()
-		checksum, err := calculateSHA256(filePath)
+		checksum, err := calculateChecksum(filePath, algo)
 		if err != nil {
-			sendMessage(safeConn, "error", url, fmt.Sprintf("Checksum calculation failed: %v", err))
+			sendError(safeConn, id, ErrorCodeChecksumFailed, fmt.Sprintf("Checksum calculation failed: %v", err))
+			done("")
 			return
 		}
 
 		duration := time.Since(start)
 
 		// Enviar resultado al cliente
-		safeConn.SendJSON(map[string]interface{}{
-			"type":     "checksum_result",
-			"url":      url,
-			"filename": filename,
-			"checksum": checksum,
-			"duration": duration.Milliseconds(),
-		})
+		publishChecksumResult(safeConn, id, filename, filePath, checksum, algo, duration)
 
 		// Este log es suficiente, no necesitamos otro mensaje adicional
 		log.Printf("Checksum calculation done for %s: %s", filename, checksum)
 
-		// IMPORTANTE: Asegurarse de que el item no sigue en ningún mapa
-		activeDownloadsMutex.Lock()
-		delete(activeDownloadsMap, url)
-		activeDownloadsMutex.Unlock()
-
-		activeDownloadsMux.Lock()
-		delete(activeDownloadsState, url)
-		activeDownloadsMux.Unlock()
+		// IMPORTANTE: Asegurarse de que el item ya no sigue registrado
+		registry.Remove(id)
+		done(checksum)
 	}()
 }
 
+// handleDownloadChecksum envía el checksum de una descarga por chunks recién
+// unida. Si el merge secuencial ya lo calculó se envía sin releer el archivo;
+// si no, se calcula igual que con calculate_checksum
+func handleDownloadChecksum(safeConn *SafeConn, download *ChunkedDownload, downloadDir, filename string, onDone func(checksum string)) {
+	checksum := download.MergeChecksum(DefaultChecksumAlgorithm)
+	if checksum == "" {
+		handleCalculateChecksum(safeConn, download.ID, downloadDir, filename, DefaultChecksumAlgorithm, onDone)
+		return
+	}
+
+	log.Printf("Checksum for %s computed during merge: %s", filename, checksum)
+	publishChecksumResult(safeConn, download.ID, filename, filepath.Join(downloadDir, filename), checksum, DefaultChecksumAlgorithm, 0)
+	registry.Remove(download.ID)
+	onDone(checksum)
+}
+
+// publishChecksumResult envía el evento checksum_result. save_path es la ruta
+// absoluta del archivo verificado, ya con el nombre numerado si lo hubo
+func publishChecksumResult(safeConn *SafeConn, id, filename, savePath, checksum, algo string, duration time.Duration) {
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "checksum_result",
+		"download_id": id,
+		"filename":    filename,
+		"save_path":   savePath,
+		"checksum":    checksum,
+		"algorithm":   algo,
+		"duration":    duration.Milliseconds(),
+	})
+}
+
 func calculateOptimalChunkSize(speed float64) int64 {
 	switch {
 	case speed >= float64(SpeedThresholdFast):
@@ -783,293 +1421,43 @@ func calculateOptimalChunkSize(speed float64) int64 {
 	}
 }
 
-// DownloadChunk descarga un chunk específico - modificado para usar la nueva función con retry
-func (d *ChunkedDownload) DownloadChunk(client *http.Client, chunk *Chunk, safeConn *SafeConn) error {
-	// Reset chunk state at start
-	chunk.mu.Lock()
-	if chunk.Status != ChunkCompleted {
-		chunk.Status = ChunkActive
-	}
-	chunk.mu.Unlock()
-
-	// Añadir log de inicio de chunk
-	log.Printf("Starting chunk %d: bytes %d-%d", chunk.ID, chunk.Start, chunk.End)
-
-	if chunk.Status == ChunkCompleted {
-		return nil
-	}
-
-	// Marcar como activo
-	chunk.mu.Lock()
-	chunk.Status = ChunkActive
-	chunk.mu.Unlock()
-
-	// Add retry loop with exponential backoff
-	var lastError error
-	retryCount := 0
-
-	for retryCount <= MaxChunkRetries {
-		if retryCount > 0 {
-			// Calculate backoff with exponential increase capped at MaxRetryDelay
-			delay := time.Duration(min(InitialRetryDelay<<uint(retryCount-1), MaxRetryDelay)) * time.Second
-			log.Printf("Retrying chunk %d (attempt %d/%d) after %v delay",
-				chunk.ID, retryCount, MaxChunkRetries, delay)
-
-			// Send retry info to client
-			if safeConn != nil {
-				safeConn.SendJSON(map[string]interface{}{
-					"type": "chunk_retry",
-					"url":  d.URL,
-					"chunk": ChunkProgress{
-						ID:     chunk.ID,
-						Start:  chunk.Start,
-						End:    chunk.End,
-						Status: "retrying",
-					},
-					"retry":       retryCount,
-					"max_retries": MaxChunkRetries,
-					"delay":       delay.Seconds(),
-				})
-			}
-
-			time.Sleep(delay)
-		}
+// Rondas de re-descarga de chunks que no pasan la validación antes del merge
+const maxChunkValidationRounds = 2
 
-		// Check if the download has been paused or canceled
-		select {
-		case <-chunk.cancelCtx:
-			chunk.mu.Lock()
-			if chunk.Status == ChunkActive {
-				chunk.Status = ChunkPaused
-			}
-			chunk.mu.Unlock()
+// revalidateChunks comprueba el tamaño en disco de los chunks antes del merge
+// y vuelve a descargar los que no cuadran, avisando con
+// chunk_validation_failed. Una pausa durante la re-descarga no es un error
+func revalidateChunks(safeConn *SafeConn, download *ChunkedDownload, client *http.Client) error {
+	for round := 0; round < maxChunkValidationRounds; round++ {
+		invalid := download.InvalidChunkFiles()
+		if len(invalid) == 0 {
 			return nil
-		default:
-			if d.Paused {
-				chunk.mu.Lock()
-				if chunk.Status == ChunkActive {
-					chunk.Status = ChunkPaused
-				}
-				chunk.mu.Unlock()
-				return nil
-			}
 		}
 
-		// Try the download using our new timeout method
-		err := d.tryDownloadChunkWithTimeout(client, chunk, safeConn)
-		if err == nil {
-			// Success!
-			return nil
+		ids := make([]int, 0, len(invalid))
+		for _, chunk := range invalid {
+			ids = append(ids, chunk.ID)
 		}
+		log.Printf("Chunks %v of %s failed size validation, downloading them again", ids, download.URL)
+		publishEvent(safeConn, map[string]interface{}{
+			"type":        "chunk_validation_failed",
+			"download_id": download.ID,
+			"chunks":      ids,
+			"message":     fmt.Sprintf("%d chunk(s) did not match their expected size and will be downloaded again", len(ids)),
+		})
 
-		// Log the error and retry
-		lastError = err
-		log.Printf("Chunk %d download failed (attempt %d/%d): %v",
-			chunk.ID, retryCount+1, MaxChunkRetries+1, err)
-
-		// Increment retry count and continue
-		retryCount++
-	}
-
-	// If we get here, all retries failed
-	chunk.mu.Lock()
-	chunk.Status = ChunkFailed
-	chunk.Error = lastError.Error()
-	chunk.mu.Unlock()
-
-	return fmt.Errorf("chunk %d failed after %d retries: %v",
-		chunk.ID, MaxChunkRetries, lastError)
-}
-
-// tryDownloadChunkWithTimeout handles downloading a chunk with timeout detection
-func (d *ChunkedDownload) tryDownloadChunkWithTimeout(client *http.Client, chunk *Chunk, safeConn *SafeConn) error {
-	// Crear o abrir archivo para el chunk
-	file, err := os.OpenFile(chunk.Path, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open chunk file: %v", err)
-	}
-	defer file.Close()
-
-	// Establecer posición inicial
-	if chunk.Progress > 0 {
-		if _, err := file.Seek(chunk.Progress, 0); err != nil {
-			return fmt.Errorf("failed to seek in chunk file: %v", err)
-		}
-	}
-
-	// Crear request con rango
-	req, err := http.NewRequest("GET", d.URL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
-	}
-
-	// Establecer rango de bytes para este chunk
-	rangeStart := chunk.Start + chunk.Progress
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, chunk.End))
-
-	// Añadir User-Agent para evitar bloqueos/limitaciones
-	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.93 Safari/537.36")
-
-	// Add context with timeout to detect stuck downloads
-	ctx, cancel := context.WithTimeout(context.Background(), DownloadTimeout*time.Second)
-	defer cancel()
-	req = req.WithContext(ctx)
-
-	// Iniciar descarga
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to start download: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned status code %d", resp.StatusCode)
-	}
-
-	// Verificar si el servidor soporta rangos
-	if resp.StatusCode != http.StatusPartialContent {
-		// Some servers don't return 206 but still honor range - try to continue
-		log.Printf("Warning: Server didn't respond with 206 Partial Content, but trying to continue")
-	}
-
-	// Add progress monitoring with timeout detection
-	startTime := time.Now()
-	lastProgressTime := time.Now()
-	lastProgress := chunk.Progress
-	updateInterval := 100 * time.Millisecond
-	buffer := make([]byte, 512*1024)
-	lastUpdate := time.Now() // Define lastUpdate here to fix the undefined variable error
-
-	// Create a channel for the download goroutine
-	downloadDone := make(chan error, 1)
-
-	// Start the download in a separate goroutine
-	go func() {
-		for {
-			// Check if download has been canceled or paused
-			select {
-			case <-chunk.cancelCtx:
-				downloadDone <- nil
-				return
-			default:
-				if d.Paused {
-					downloadDone <- nil
-					return
-				}
-			}
-
-			// Read data with timeout
-			n, err := resp.Body.Read(buffer)
-			if n > 0 {
-				// Write to file
-				_, writeErr := file.Write(buffer[:n])
-				if writeErr != nil {
-					downloadDone <- fmt.Errorf("write error: %v", writeErr)
-					return
-				}
-
-				// Update progress
-				chunk.mu.Lock()
-				chunk.Progress += int64(n)
-				currentProgress := chunk.Progress
-				chunk.mu.Unlock()
-
-				lastProgressTime = time.Now() // Update progress time
-
-				// Send progress update at interval
-				now := time.Now()
-				if now.Sub(lastUpdate) >= updateInterval {
-					elapsed := now.Sub(startTime).Seconds()
-					if elapsed > 0 {
-						speed := float64(currentProgress-lastProgress) / now.Sub(lastUpdate).Seconds()
-
-						// Report progress with speed
-						if safeConn != nil {
-							d.mu.RLock()
-							safeConn.SendJSON(map[string]interface{}{
-								"type": "chunk_progress",
-								"url":  d.URL,
-								"chunk": ChunkProgress{
-									ID:       chunk.ID,
-									Start:    chunk.Start,
-									End:      chunk.End,
-									Progress: currentProgress,
-									Status:   chunk.Status,
-									Speed:    speed,
-								},
-							})
-
-							// Also report overall progress
-							downloaded, total := d.GetProgress()
-							safeConn.SendJSON(map[string]interface{}{
-								"type":          "progress",
-								"url":           d.URL,
-								"bytesReceived": downloaded,
-								"totalBytes":    total,
-								"speed":         speed,
-							})
-							d.mu.RUnlock()
-						}
-
-						lastUpdate = now
-						lastProgress = currentProgress
-					}
-				}
-			}
-
-			if err != nil {
-				if err == io.EOF {
-					// Successfully completed
-					chunk.markCompleted()
-
-					// Report stats
-					elapsed := time.Since(startTime)
-					totalBytes := chunk.End - chunk.Start + 1
-					avgSpeed := float64(totalBytes) / elapsed.Seconds()
-
-					log.Printf("Chunk %d completed in %.2fs (%.2f MB/s)",
-						chunk.ID, elapsed.Seconds(), avgSpeed/(1024*1024))
-
-					// Send final notification
-					if safeConn != nil {
-						safeConn.SendJSON(map[string]interface{}{
-							"type": "chunk_progress",
-							"url":  d.URL,
-							"chunk": ChunkProgress{
-								ID:        chunk.ID,
-								Start:     chunk.Start,
-								End:       chunk.End,
-								Progress:  totalBytes,
-								Status:    ChunkCompleted,
-								Speed:     0,
-								Completed: chunk.End + 1,
-							},
-						})
-					}
-
-					downloadDone <- nil
-					return
-				}
-
-				// Other error - signal failure
-				downloadDone <- err
-				return
+		for _, chunk := range invalid {
+			if err := download.DownloadChunk(client, chunk, safeConn); err != nil {
+				return fmt.Errorf("failed to re-download chunk %d: %v", chunk.ID, err)
 			}
-
-			// Check if download is stuck (no progress for a while)
-			if time.Since(lastProgressTime) > StuckProgressTimeout*time.Second {
-				downloadDone <- fmt.Errorf("download stuck - no progress for %d seconds", StuckProgressTimeout)
-				return
+			if download.IsPaused() {
+				return nil
 			}
 		}
-	}()
+	}
 
-	// Wait for download completion or timeout
-	select {
-	case err := <-downloadDone:
-		return err
-	case <-ctx.Done():
-		// Timeout occurred
-		return fmt.Errorf("download timeout after %d seconds", DownloadTimeout)
+	if invalid := download.InvalidChunkFiles(); len(invalid) > 0 {
+		return fmt.Errorf("%d chunk(s) still do not match their expected size", len(invalid))
 	}
+	return nil
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startPreparing arranca una descarga por chunks cuyo HEAD se queda colgado
+// hasta que se llama a la función devuelta, para poder pausarla o cancelarla
+// en plena preparación
+func startPreparing(t *testing.T, safeConn *SafeConn, id string) (release func(), done <-chan struct{}) {
+	t.Helper()
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	headStarted := make(chan struct{})
+	unblock := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			close(headStarted)
+			<-unblock
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	opts := DownloadOptions{DownloadDir: t.TempDir(), TempDir: t.TempDir(), FastMode: true}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		startChunkedDownload(safeConn, id, server.URL+"/file.bin", opts)
+	}()
+	t.Cleanup(func() {
+		if download, ok := registry.Get(id); ok {
+			download.Cleanup()
+		}
+		registry.Remove(id)
+	})
+
+	select {
+	case <-headStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HEAD request never arrived")
+	}
+	return func() { close(unblock) }, finished
+}
+
+// countMessages cuenta los mensajes de un tipo
+func countMessages(messages []map[string]interface{}, typ string) int {
+	n := 0
+	for _, msg := range messages {
+		if msg["type"] == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPauseDuringPreparation(t *testing.T) {
+	safeConn, client := wsPair(t)
+	id := "test-pause-preparing"
+	release, done := startPreparing(t, safeConn, id)
+
+	pauseChunkedDownload(safeConn, id)
+	release()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("preparation did not stop after the pause")
+	}
+
+	download, ok := registry.Get(id)
+	if !ok {
+		t.Fatal("download paused during preparation is not registered")
+	}
+	if paused, _ := registry.IsPaused(id); !paused {
+		t.Error("registry.IsPaused = false, want true")
+	}
+	if status := download.CurrentStatus(); status != StatusPaused {
+		t.Errorf("status = %s, want %s", status, StatusPaused)
+	}
+	if downloaded, _ := download.GetProgress(); downloaded != 0 {
+		t.Errorf("downloaded %d bytes, want none before resume", downloaded)
+	}
+	if n := countMessages(readMessages(t, client, 200*time.Millisecond), "pause_confirmed"); n != 1 {
+		t.Errorf("got %d pause_confirmed, want 1", n)
+	}
+}
+
+func TestCancelDuringPreparation(t *testing.T) {
+	safeConn, client := wsPair(t)
+	id := "test-cancel-preparing"
+	release, done := startPreparing(t, safeConn, id)
+
+	cancelChunkedDownload(safeConn, id)
+	release()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("preparation did not stop after the cancel")
+	}
+
+	if _, tracked := registry.IsPaused(id); tracked {
+		t.Error("download canceled during preparation is still tracked")
+	}
+	if n := countMessages(readMessages(t, client, 200*time.Millisecond), "cancel_confirmed"); n != 1 {
+		t.Errorf("got %d cancel_confirmed, want 1", n)
+	}
+}
+
+// waitMessage lee mensajes hasta recibir uno del tipo typ
+func waitMessage(t *testing.T, conn *websocket.Conn, typ string) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg["type"] == typ {
+			return msg
+		}
+	}
+}
+
+// Una descarga de una sola conexión deja de escribir antes de confirmar la
+// pausa
+func TestPauseSingleStreamStopsWriting(t *testing.T) {
+	// Sin Accept-Ranges: un trozo cada pocos milisegundos hasta que el
+	// cliente corta
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(64*1024*1024))
+		if r.Method == http.MethodHead {
+			return
+		}
+		piece := bytes.Repeat([]byte("x"), 1024)
+		for {
+			if _, err := w.Write(piece); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}))
+	defer server.Close()
+
+	safeConn, client := wsPair(t)
+	id := "test-pause-single"
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stream.bin")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleDownload(safeConn, id, server.URL+"/stream.bin", DownloadOptions{DownloadDir: dir, Filename: "stream.bin"})
+	}()
+	defer func() {
+		registry.Remove(id)
+		<-done
+	}()
+
+	waitMessage(t, client, "progress")
+	pauseChunkedDownload(safeConn, id)
+	waitMessage(t, client, "pause_confirmed")
+
+	if paused, _ := registry.IsPaused(id); !paused {
+		t.Fatal("registry.IsPaused = false after pause_confirmed")
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if after.Size() != before.Size() {
+		t.Errorf("file grew from %d to %d bytes after pause_confirmed", before.Size(), after.Size())
+	}
+}
+
+func TestPauseUntrackedDownload(t *testing.T) {
+	safeConn, client := wsPair(t)
+
+	pauseChunkedDownload(safeConn, "test-pause-untracked")
+
+	messages := readMessages(t, client, 200*time.Millisecond)
+	if n := countMessages(messages, "pause_confirmed"); n != 0 {
+		t.Errorf("got %d pause_confirmed for an untracked download, want 0", n)
+	}
+	for _, msg := range messages {
+		if msg["type"] == "error" && msg["error_code"] != ErrorCodeNotFound {
+			t.Errorf("error_code = %v, want %s", msg["error_code"], ErrorCodeNotFound)
+		}
+	}
+	if countMessages(messages, "error") != 1 {
+		t.Errorf("got %d errors, want 1", countMessages(messages, "error"))
+	}
+}
+
+// El paso a una sola conexión (registry.Track) no retira una pausa pedida
+// durante la preparación
+func TestTrackKeepsPauseFromPreparation(t *testing.T) {
+	id := "test-track-keeps-pause"
+	registry.Prepare(id, "http://example.com/file.bin")
+	t.Cleanup(func() { registry.Remove(id) })
+
+	if !registry.PauseIfPreparing(id) {
+		t.Fatal("PauseIfPreparing = false for a preparing download")
+	}
+	registry.Track(id, "http://example.com/file.bin")
+
+	if paused, _ := registry.IsPaused(id); !paused {
+		t.Error("Track cleared the pause requested during preparation")
+	}
+	if registry.PauseIfPreparing(id) {
+		t.Error("PauseIfPreparing = true after Track ended the preparation")
+	}
+}
+
+// Sin soporte de rangos la descarga pasa a una sola conexión, que también
+// tiene que comprobar expected_checksum
+func TestExpectedChecksumWithoutRangeSupport(t *testing.T) {
+	data := bytes.Repeat([]byte("catchme"), 4096)
+	sum := sha256.Sum256(data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method != http.MethodHead {
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantType string
+		wantFile bool
+	}{
+		{"match", hex.EncodeToString(sum[:]), "checksum_verified", true},
+		{"mismatch", strings.Repeat("0", 64), "error", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			safeConn, client := wsPair(t)
+			id := "test-checksum-stream-" + tt.name
+			dir := t.TempDir()
+			opts := DownloadOptions{
+				DownloadDir:       dir,
+				TempDir:           t.TempDir(),
+				Filename:          "file.bin",
+				FastMode:          true,
+				ExpectedChecksum:  tt.checksum,
+				ChecksumAlgorithm: "sha256",
+			}
+			startChunkedDownload(safeConn, id, server.URL+"/file.bin", opts)
+
+			messages := readMessages(t, client, 200*time.Millisecond)
+			var gotType bool
+			for _, msg := range messages {
+				if msg["type"] == tt.wantType {
+					gotType = true
+				}
+				if msg["type"] == "error" && msg["error_code"] != ErrorCodeChecksumMismatch {
+					t.Errorf("error_code = %v, want %s", msg["error_code"], ErrorCodeChecksumMismatch)
+				}
+			}
+			if !gotType {
+				t.Errorf("no %s message", tt.wantType)
+			}
+			if n := countMessages(messages, "download_complete"); tt.wantFile != (n == 1) {
+				t.Errorf("got %d download_complete, want file = %t", n, tt.wantFile)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "file.bin")); tt.wantFile != (err == nil) {
+				t.Errorf("file exists = %t, want %t", err == nil, tt.wantFile)
+			}
+		})
+	}
+}
+
+// quietLog descarta el log durante un benchmark
+func quietLog(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// Con el buffer del pool calcular un checksum no reserva sus 8MB cada vez
+func BenchmarkCalculateChecksum(b *testing.B) {
+	quietLog(b)
+	path := filepath.Join(b.TempDir(), "file.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("catchme"), 1<<20/7), 0o644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := calculateChecksum(path, DefaultChecksumAlgorithm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tiempo que se conserva el id de una descarga después de salir del registro,
+// para que los últimos eventos (estado final, checksum) sigan llevando su URL
+const downloadIDRetention = time.Minute
+
+// downloadRef es lo que identifica a una descarga fuera de su id: la URL y
+// el destino pedido (ver downloadDestination)
+type downloadRef struct {
+	url  string
+	dest string
+}
+
+// downloadIDMap asocia cada descarga con su URL y su destino. El id, asignado
+// al aceptar start_download, es la clave del registro, la cola y el resto del
+// estado por descarga: la misma URL puede bajarse más de una vez y no
+// identifica nada
+type downloadIDMap struct {
+	mu   sync.Mutex
+	refs map[string]downloadRef
+}
+
+var downloadIDs = &downloadIDMap{refs: make(map[string]downloadRef)}
+
+// Assign crea un id nuevo para una descarga de url en dest
+func (m *downloadIDMap) Assign(url, dest string) string {
+	id := newDownloadID()
+	m.Bind(id, url, dest)
+	return id
+}
+
+// Bind asocia un id ya existente (trabajo REST, manifiesto) con su URL y su
+// destino
+func (m *downloadIDMap) Bind(id, url, dest string) {
+	m.mu.Lock()
+	m.refs[id] = downloadRef{url: url, dest: dest}
+	m.mu.Unlock()
+}
+
+// URL devuelve la URL de la descarga, o "" si el id no se conoce
+func (m *downloadIDMap) URL(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refs[id].url
+}
+
+// Destination devuelve el destino pedido para la descarga
+func (m *downloadIDMap) Destination(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refs[id].dest
+}
+
+// Expire olvida el id y su historial de velocidad pasado downloadIDRetention
+func (m *downloadIDMap) Expire(id string) {
+	time.AfterFunc(downloadIDRetention, func() {
+		m.mu.Lock()
+		delete(m.refs, id)
+		m.mu.Unlock()
+		forgetSpeedHistory(id)
+	})
+}
+
+// downloadDestination identifica dónde se guardará una descarga: el
+// directorio resuelto y el nombre pedido. Sin nombre queda solo el
+// directorio, porque el nombre se deduce de la respuesta del servidor
+func downloadDestination(dir, filename string) string {
+	if resolved, err := resolveDownloadDir(dir); err == nil {
+		dir = resolved
+	}
+	return filepath.Join(dir, filename)
+}
+
+// findDownloads devuelve los ids de las descargas de url registradas o en
+// cola
+func findDownloads(url string) []string {
+	var ids []string
+	for _, entry := range registry.Entries() {
+		if entry.URL == url {
+			ids = append(ids, entry.ID)
+		}
+	}
+	for _, id := range downloadSlots.Waiting() {
+		if downloadIDs.URL(id) == url {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// findDuplicate devuelve el id de una descarga registrada o en cola de la
+// misma url hacia el mismo destino, o "" si no hay ninguna. La misma URL
+// hacia otro destino es una descarga distinta
+func findDuplicate(url, dest string) string {
+	for _, id := range findDownloads(url) {
+		if downloadIDs.Destination(id) == dest {
+			return id
+		}
+	}
+	return ""
+}
+
+// findChunkedDuplicate devuelve el id de otra descarga por chunks de url que
+// guarda en el mismo archivo. Complementa a findDuplicate cuando el nombre no
+// se conocía al aceptar la descarga
+func findChunkedDuplicate(id, url, dir, filename string) string {
+	for _, entry := range registry.Entries() {
+		if entry.ID == id || entry.URL != url || entry.Download == nil {
+			continue
+		}
+		entry.Download.RLock()
+		same := entry.Download.DownloadDir == dir && entry.Download.Filename == filename
+		entry.Download.RUnlock()
+		if same {
+			return entry.ID
+		}
+	}
+	return ""
+}
+
+// errDownloadNotFound indica que ninguna descarga corresponde al mensaje
+var errDownloadNotFound = errors.New("no download found")
+
+// resolveDownload obtiene la descarga a la que se refiere un mensaje: por
+// download_id o, para clientes que solo conocen la URL, por url si hay una
+// sola descarga de esa URL
+func resolveDownload(msg map[string]interface{}) (string, error) {
+	if id, _ := msg["download_id"].(string); id != "" {
+		if downloadIDs.URL(id) == "" {
+			return "", errDownloadNotFound
+		}
+		return id, nil
+	}
+
+	url, _ := msg["url"].(string)
+	ids := findDownloads(url)
+	switch len(ids) {
+	case 0:
+		return "", errDownloadNotFound
+	case 1:
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%d downloads of this URL are in progress, send its download_id", len(ids))
+	}
+}
+
+// resolveCommand resuelve la descarga de un comando. Si no se encuentra envía
+// notFound como error (nada si está vacío); si la URL es ambigua pide el id
+func resolveCommand(safeConn *SafeConn, msg map[string]interface{}, notFound string) (string, bool) {
+	id, err := resolveDownload(msg)
+	if err == nil {
+		return id, true
+	}
+	url, _ := msg["url"].(string)
+	if err != errDownloadNotFound {
+		sendURLError(safeConn, url, ErrorCodeInvalidRequest, err.Error())
+	} else if notFound != "" {
+		sendURLError(safeConn, url, ErrorCodeNotFound, notFound)
+	}
+	return "", false
+}
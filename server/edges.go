@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Número de fallos seguidos de un chunk tras los que se cambia de nodo
+// (--rotate-edges). Con 0 se deja que el sistema elija la IP en cada conexión
+var edgeRotationThreshold = 0
+
+// newChunkClient crea el cliente HTTP de los chunks de una descarga, con las
+// conexiones fijadas a su pool de nodos si la rotación está activada
+func newChunkClient(d *ChunkedDownload, maxConnsPerHost int) *http.Client {
+	d.RLock()
+	client := newDownloadClient(maxConnsPerHost, d.HTTPProtocol, d.Proxy)
+	d.RUnlock()
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = d.WrapDial(transport.DialContext)
+	return client
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+
+	"catchme/server/download"
+)
+
+// El motor de descarga por chunks vive en catchme/server/download. Estos
+// alias mantienen los nombres de siempre en el servidor, donde muchas
+// funciones llaman download a su *ChunkedDownload
+type (
+	ChunkedDownload  = download.ChunkedDownload
+	Chunk            = download.Chunk
+	ChunkProgress    = download.ChunkProgress
+	ChunkStatus      = download.ChunkStatus
+	DownloadStatus   = download.DownloadStatus
+	ByteRange        = download.ByteRange
+	Credentials      = download.Credentials
+	RetryConfig      = download.RetryConfig
+	RetryStrategy    = download.RetryStrategy
+	RateLimiter      = download.RateLimiter
+	ProgressReporter = download.ProgressReporter
+)
+
+const (
+	ChunkPending   = download.ChunkPending
+	ChunkActive    = download.ChunkActive
+	ChunkCompleted = download.ChunkCompleted
+	ChunkFailed    = download.ChunkFailed
+	ChunkPaused    = download.ChunkPaused
+
+	StatusQueued            = download.StatusQueued
+	StatusStarting          = download.StatusStarting
+	StatusDownloading       = download.StatusDownloading
+	StatusPaused            = download.StatusPaused
+	StatusCompleted         = download.StatusCompleted
+	StatusFailed            = download.StatusFailed
+	StatusFailedRecoverable = download.StatusFailedRecoverable
+	StatusCanceled          = download.StatusCanceled
+
+	RetryFixed       = download.RetryFixed
+	RetryLinear      = download.RetryLinear
+	RetryExponential = download.RetryExponential
+
+	DefaultChecksumAlgorithm = download.DefaultChecksumAlgorithm
+)
+
+var (
+	errDiskWrite     = download.ErrDiskWrite
+	errRangeIgnored  = download.ErrRangeIgnored
+	errRemoteChanged = download.ErrRemoteChanged
+)
+
+// newChunkedDownload crea una descarga por chunks con la configuración del
+// servidor: TempDir bajo tempBaseDir() y la concurrencia por defecto
+func newChunkedDownload(url, filename string, size int64, chunkSize int64) *ChunkedDownload {
+	d := download.NewChunkedDownload(url, filename, size, chunkSize)
+	d.TempDir = filepath.Join(tempBaseDir(), filename)
+	d.MaxConcurrentChunks = MaxConcurrentChunks
+	configureDownload(d)
+	return d
+}
+
+// configureDownload aplica a una descarga nueva o restaurada las opciones de
+// línea de comandos que no se persisten: merge, reintentos, User-Agent y
+// límite global. La rotación de nodos se activa una vez conocida la URL de
+// los chunks (RotateEdges)
+func configureDownload(d *ChunkedDownload) {
+	d.MergeConcurrency = mergeConcurrency
+	d.Retry = retryConfig
+	d.UserAgentFor = userAgentFor
+	d.SharedLimiter = globalRateLimiter
+}
+
+// applyCredentials pone el User-Agent de la petición (ver userAgentFor) y las
+// credenciales de la descarga
+func applyCredentials(req *http.Request, c Credentials) {
+	req.Header.Set("User-Agent", userAgentFor(c.UserAgent, req.URL.String()))
+	c.Apply(req)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Códigos de error del campo error_code de los mensajes error, junto al
+// texto para mostrar. Esta es la lista completa: los clientes ramifican por
+// estos valores, así que un código nuevo se añade aquí
+const (
+	ErrorCodeHeadFailed        = "head_failed"         // No se pudo obtener la información del archivo
+	ErrorCodeNoRangeSupport    = "no_range_support"    // Se pidieron rangos y el servidor no los admite
+	ErrorCodeUnknownSize       = "unknown_size"        // El servidor no indica el tamaño
+	ErrorCodeTimeout           = "timeout"             // El servidor dejó de responder
+	ErrorCodeNetwork           = "network_error"       // La conexión falló durante la transferencia
+	ErrorCodeDownloadFailed    = "download_failed"     // La transferencia no pudo completarse
+	ErrorCodeChecksumMismatch  = "checksum_mismatch"   // El archivo no coincide con expected_checksum
+	ErrorCodeChecksumFailed    = "checksum_failed"     // No se pudo calcular el checksum
+	ErrorCodeMergeFailed       = "merge_failed"        // No se pudieron unir los chunks
+	ErrorCodeInvalidRequest    = "invalid_request"     // Mensaje u opciones no válidos
+	ErrorCodeNotFound          = "download_not_found"  // No hay descarga con ese id o URL
+	ErrorCodeAlreadyInProgress = "already_in_progress" // Ya se está descargando al mismo destino
+	ErrorCodeInternal          = "internal_error"      // Fallo inesperado del servidor
+
+	ErrorCodeInvalidURL          = "invalid_url"             // La URL no es una URL http(s) válida
+	ErrorCodeNotAFile            = "not_a_file"              // La URL no apunta a un archivo descargable
+	ErrorCodeContentTypeMismatch = "content_type_mismatch"   // El tipo de contenido no es el esperado
+	ErrorCodeRemoteChanged       = "remote_file_changed"     // El archivo remoto cambió; hay que empezar de nuevo
+	ErrorCodeVersionMismatch     = "version_mismatch"        // El cliente habla un protocolo más nuevo o inválido
+	ErrorCodeNotWritable         = "directory_not_writable"  // No se puede escribir en el destino o el temporal
+	ErrorCodeFileTooLarge        = "file_too_large"          // El archivo supera max_file_size
+	ErrorCodeInsufficientSpace   = "insufficient_disk_space" // No hay espacio para el archivo
+	ErrorCodeDiskError           = "disk_error"              // Fallo de escritura en disco
+	ErrorCodeDiskFull            = "disk_full"               // El disco se llenó durante la descarga
+)
+
+// networkErrorCode clasifica un error de red: timeout si el servidor dejó de
+// responder y fallback en cualquier otro caso
+func networkErrorCode(err error, fallback string) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorCodeTimeout
+	}
+	return fallback
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// speedSampleInterval es el mínimo entre muestras de speedHistory, para
+	// que los progress de varios chunks no llenen el historial en un instante
+	speedSampleInterval = time.Second
+	// speedSampleGap descarta la muestra si hubo un hueco mayor (pausa)
+	speedSampleGap = 5 * time.Second
+)
+
+// speedSample es el último punto medido de una descarga
+type speedSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// lastSpeedSample se protege con speedMutex, igual que speedHistory
+var lastSpeedSample = make(map[string]speedSample)
+
+// recordSpeedSample añade a speedHistory la velocidad global de la descarga
+// desde la última muestra. Funciona igual con una conexión que con chunks,
+// porque solo mira los bytes totales recibidos. Las descargas sin id
+// no llevan historial
+func recordSpeedSample(id string, bytesReceived int64) {
+	if id == "" {
+		return
+	}
+	now := time.Now()
+
+	speedMutex.Lock()
+	last, exists := lastSpeedSample[id]
+	elapsed := now.Sub(last.at)
+	if exists && elapsed < speedSampleInterval && bytesReceived >= last.bytes {
+		speedMutex.Unlock()
+		return
+	}
+	lastSpeedSample[id] = speedSample{at: now, bytes: bytesReceived}
+	speedMutex.Unlock()
+
+	// Tras una pausa o un reinicio la diferencia no es una velocidad real
+	if !exists || elapsed > speedSampleGap || bytesReceived < last.bytes {
+		return
+	}
+	updateSpeedHistory(id, float64(bytesReceived-last.bytes)/elapsed.Seconds())
+}
+
+// estimateETA calcula los segundos restantes con la media de speedHistory en
+// lugar de la velocidad instantánea. Devuelve 0 si terminó y -1 si no se
+// puede estimar (pausada, atascada o tamaño desconocido)
+func estimateETA(id string, bytesReceived, totalBytes int64, status DownloadStatus) int64 {
+	if status == StatusCompleted {
+		return 0
+	}
+	if status == StatusPaused || status == StatusFailedRecoverable || status.IsTerminal() || totalBytes <= 0 {
+		return -1
+	}
+
+	speed := getPreviousSpeed(id)
+	if speed <= 0 {
+		return -1
+	}
+	remaining := totalBytes - bytesReceived
+	if remaining <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(remaining) / speed))
+}
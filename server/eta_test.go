@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestEstimateETA(t *testing.T) {
+	const id = "eta-test"
+
+	tests := []struct {
+		name     string
+		speeds   []float64 // Historial de velocidades
+		received int64
+		total    int64
+		status   DownloadStatus
+		want     int64
+	}{
+		{"completed", nil, 100, 100, StatusCompleted, 0},
+		{"paused", []float64{1000}, 0, 100, StatusPaused, -1},
+		{"failed", []float64{1000}, 0, 100, StatusFailed, -1},
+		{"recoverable failure", []float64{1000}, 0, 100, StatusFailedRecoverable, -1},
+		{"unknown size", []float64{1000}, 50, 0, StatusDownloading, -1},
+		{"no speed yet", nil, 0, 100, StatusDownloading, -1},
+		{"exact", []float64{1000}, 0, 5000, StatusDownloading, 5},
+		{"rounds up", []float64{1000}, 0, 5001, StatusDownloading, 6},
+		{"averages last five samples", []float64{9999, 500, 500, 1500, 1500, 1000}, 0, 10000, StatusDownloading, 10},
+		{"nothing left", []float64{1000}, 100, 100, StatusDownloading, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forgetSpeedHistory(id)
+			defer forgetSpeedHistory(id)
+			for _, speed := range tt.speeds {
+				updateSpeedHistory(id, speed)
+			}
+
+			if got := estimateETA(id, tt.received, tt.total, tt.status); got != tt.want {
+				t.Errorf("estimateETA(%d, %d, %s) = %d, want %d", tt.received, tt.total, tt.status, got, tt.want)
+			}
+		})
+	}
+}
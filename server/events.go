@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseEvent es un evento ya serializado listo para enviarse por SSE
+type sseEvent struct {
+	eventType string
+	url       string
+	id        string
+	data      []byte
+}
+
+// eventHub reparte los eventos de descarga entre los clientes SSE suscritos
+type eventHub struct {
+	mu          sync.RWMutex
+	subscribers map[chan sseEvent]string // canal -> URL o id filtrado ("" = todas)
+}
+
+// Hub global de eventos de descarga
+var events = &eventHub{subscribers: make(map[chan sseEvent]string)}
+
+// Subscribe registra un nuevo oyente, opcionalmente filtrado por URL o por id
+// de descarga
+func (h *eventHub) Subscribe(filter string) chan sseEvent {
+	ch := make(chan sseEvent, 256)
+	h.mu.Lock()
+	h.subscribers[ch] = filter
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe elimina un oyente
+func (h *eventHub) Unsubscribe(ch chan sseEvent) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+// Publish envía el evento a los oyentes interesados. Un oyente lento pierde
+// eventos en lugar de frenar la descarga
+func (h *eventHub) Publish(event map[string]interface{}) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding event: %v", err)
+		return
+	}
+	eventType, _ := event["type"].(string)
+	url, _ := event["url"].(string)
+	id, _ := event["download_id"].(string)
+	evt := sseEvent{eventType: eventType, url: url, id: id, data: data}
+
+	for ch, filter := range h.subscribers {
+		if filter != "" && filter != url && filter != id {
+			continue
+		}
+		select {
+		case ch <- evt:
+		default:
+			log.Printf("SSE subscriber too slow, dropping %s event", eventType)
+		}
+	}
+}
+
+// publishEvent envía un evento de descarga al cliente WebSocket que la inició
+// (si lo hay), a los WebSocket suscritos a la descarga y a los clientes SSE.
+// Los eventos de una descarga llevan su download_id y aquí se completa la
+// URL. Solo se devuelve el error del cliente que inició la descarga
+func publishEvent(safeConn *SafeConn, event map[string]interface{}) error {
+	id, hasID := event["download_id"].(string)
+	if hasID {
+		// Un evento con id vacío no es de ninguna descarga (p.ej. el
+		// version_mismatch de hello): solo lo recibe la conexión que lo causó
+		if id == "" {
+			if safeConn == nil {
+				return nil
+			}
+			return safeConn.SendJSON(event)
+		}
+		if _, exists := event["url"]; !exists {
+			event["url"] = downloadIDs.URL(id)
+		}
+	}
+
+	events.Publish(event)
+
+	for _, watcher := range watchers.Of(id) {
+		if watcher == safeConn {
+			continue
+		}
+		if err := watcher.SendJSON(event); err != nil {
+			log.Printf("Error sending event to subscriber: %v", err)
+		}
+	}
+
+	if safeConn == nil {
+		return nil
+	}
+	return safeConn.SendJSON(event)
+}
+
+// handleEvents expone los eventos de descarga como Server-Sent Events en
+// GET /events, con filtro opcional ?url= o ?download_id=. Es de solo lectura:
+// las descargas se siguen iniciando por WebSocket
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := r.URL.Query().Get("download_id")
+	if filter == "" {
+		filter = r.URL.Query().Get("url")
+	}
+	ch := events.Subscribe(filter)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	log.Printf("SSE client connected from %s (filter: %q)", r.RemoteAddr, filter)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	// Comentarios periódicos para que los proxies no cierren la conexión
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("SSE client disconnected: %s", r.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case evt := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.eventType, evt.data)
+			flusher.Flush()
+		}
+	}
+}
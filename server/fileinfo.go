@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusError es una respuesta HTTP de error al pedir información del archivo
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("server returned status code %d", e.code)
+}
+
+// retryable indica si merece la pena repetir la petición: errores del
+// servidor, timeouts y límites de peticiones
+func (e statusError) retryable() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// fetchFileInfo obtiene las cabeceras del archivo con HEAD, reintentando con
+// la misma espera que los chunks. Si HEAD no funciona (muchas CDN lo rechazan)
+// pide el primer byte con GET y toma el tamaño de Content-Range. La respuesta
+// devuelta tiene el cuerpo ya cerrado. Si HEAD responde sin Content-Length
+// también se prueba el GET, y solo se queda sin tamaño si fallan los dos
+func fetchFileInfo(safeConn *SafeConn, id string, client *http.Client, url string, creds Credentials) (*http.Response, error) {
+	resp, headErr := retryFileInfo(safeConn, id, client, url, http.MethodHead, creds)
+	if headErr == nil {
+		if resp.ContentLength > 0 {
+			return resp, nil
+		}
+		log.Printf("HEAD %s returned no size, trying a ranged GET", url)
+		ranged, err := retryFileInfo(safeConn, id, client, url, http.MethodGet, creds)
+		if err != nil || ranged.ContentLength <= 0 {
+			return resp, nil
+		}
+		sendMessage(safeConn, "log", id, fmt.Sprintf("Got file size from a ranged GET: %d bytes", ranged.ContentLength))
+		return ranged, nil
+	}
+
+	log.Printf("HEAD %s failed (%v), trying a ranged GET", url, headErr)
+	resp, err := retryFileInfo(safeConn, id, client, url, http.MethodGet, creds)
+	if err != nil {
+		return nil, fmt.Errorf("%v (HEAD: %v)", err, headErr)
+	}
+	sendMessage(safeConn, "log", id, "Server rejected HEAD, using a ranged GET for file info")
+	return resp, nil
+}
+
+// retryFileInfo repite fileInfoRequest hasta retryConfig.HeadRetries veces
+// mientras el error sea recuperable, con la espera de retryConfig entre
+// intentos. Cada
+// intento fallido se avisa al cliente con un log
+func retryFileInfo(safeConn *SafeConn, id string, client *http.Client, url, method string, creds Credentials) (*http.Response, error) {
+	retry := retryConfig
+	attempts := retry.HeadRetries + 1
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := retry.Delay(attempt)
+			log.Printf("Retrying %s %s in %v (attempt %d/%d): %v", method, url, delay, attempt+1, attempts, lastErr)
+			sendMessage(safeConn, "log", id, fmt.Sprintf("%s attempt %d/%d failed (%v), retrying in %v...",
+				method, attempt, attempts, lastErr, delay))
+			time.Sleep(delay)
+		}
+
+		resp, err := fileInfoRequest(client, url, method, creds)
+		var status statusError
+		if errors.As(err, &status) && status.code == http.StatusForbidden && markBrowserOnly(url, creds.UserAgent) {
+			// Algunos sitios rechazan lo que no parece un navegador
+			sendMessage(safeConn, "log", id, "Server rejected the CatchMe User-Agent, retrying with a browser User-Agent")
+			resp, err = fileInfoRequest(client, url, method, creds)
+		}
+		if err == nil {
+			// Tras una redirección los chunks van al host final: también
+			// necesita el User-Agent de navegador
+			if isBrowserOnly(url) && resp.Request != nil {
+				markBrowserOnly(resp.Request.URL.String(), creds.UserAgent)
+			}
+			return resp, nil
+		}
+		lastErr = err
+
+		if errors.As(err, &status) && !status.retryable() {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// fileInfoRequest hace un HEAD o un GET del primer byte. Con 206 el tamaño
+// total sale de Content-Range y el propio 206 confirma que hay rangos
+func fileInfoRequest(client *http.Client, url, method string, creds Credentials) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	applyCredentials(req, creds)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, statusError{code: resp.StatusCode}
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		resp.ContentLength = contentRangeTotal(resp.Header.Get("Content-Range"))
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+	return resp, nil
+}
+
+// contentRangeTotal extrae el tamaño total de "bytes 0-0/12345" (-1 si se
+// desconoce)
+func contentRangeTotal(header string) int64 {
+	slash := strings.LastIndex(header, "/")
+	if slash < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(header[slash+1:]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+// handleGetInfo responde a get_info con lo que el servidor remoto dice del
+// archivo (el mismo HEAD con reintentos que precede a una descarga) sin crear
+// archivos ni registrar nada. chunked indica si start_download con las mismas
+// opciones usaría chunks
+func handleGetInfo(safeConn *SafeConn, msg map[string]interface{}) {
+	raw, _ := msg["url"].(string)
+	url, err := normalizeDownloadURL(raw)
+	if err != nil {
+		sendURLError(safeConn, raw, ErrorCodeInvalidURL, err.Error())
+		return
+	}
+	opts, err := parseDownloadOptions(msg)
+	if err != nil {
+		sendURLError(safeConn, url, ErrorCodeInvalidRequest, fmt.Sprintf("Invalid download options: %v", err))
+		return
+	}
+
+	// Sin id los avisos de reintento solo quedan en el log del servidor
+	client := &http.Client{Timeout: 30 * time.Second, Transport: newDownloadTransport(10, opts.httpProtocol(), opts.Proxy)}
+	resp, err := fetchFileInfo(nil, "", client, url, opts.Credentials)
+	if err != nil {
+		sendURLError(safeConn, url, networkErrorCode(err, ErrorCodeHeadFailed), fmt.Sprintf("Failed to get file info: %v", err))
+		return
+	}
+
+	resolvedURL := url
+	if resp.Request != nil {
+		resolvedURL = resp.Request.URL.String()
+	}
+	acceptRanges := resp.Header.Get("Accept-Ranges") == "bytes"
+	if resp.Header.Get("Content-Disposition") == "" {
+		if disposition := probeContentDisposition(client, resolvedURL, opts.Credentials); disposition != "" {
+			resp.Header.Set("Content-Disposition", disposition)
+		}
+	}
+
+	filename := opts.Filename
+	if filename == "" {
+		filename, err = downloadFilename(url, resp)
+		if err != nil {
+			sendURLError(safeConn, url, ErrorCodeNotAFile, err.Error())
+			return
+		}
+	}
+
+	// Igual que start_download: chunks si se piden (o hay rangos) y el
+	// servidor acepta rangos sobre un tamaño conocido
+	useChunks, _ := msg["use_chunks"].(bool)
+	chunked := (useChunks || len(opts.Ranges) > 0) && acceptRanges && resp.ContentLength > 0
+
+	info := map[string]interface{}{
+		"type":          "file_info",
+		"url":           url,
+		"filename":      filename,
+		"size":          resp.ContentLength,
+		"accept_ranges": acceptRanges,
+		"content_type":  resp.Header.Get("Content-Type"),
+		"etag":          resp.Header.Get("ETag"),
+		"last_modified": resp.Header.Get("Last-Modified"),
+		"protocol":      resp.Proto,
+		"chunked":       chunked,
+	}
+	if resolvedURL != url {
+		info["resolved_url"] = resolvedURL
+	}
+	safeConn.SendJSON(info)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// downloadFilename valida que la respuesta HEAD corresponde a un archivo y
+// devuelve el nombre con el que se guardará. El nombre de Content-Disposition
+// tiene prioridad sobre el de la URL. Sin él se rechazan URLs sin nombre (la
+// raíz del host o terminadas en "/") y páginas HTML sin extensión, que casi
+// siempre son listados de directorio
+func downloadFilename(rawURL string, resp *http.Response) (string, error) {
+	if resp != nil {
+		if name := dispositionFilename(resp.Header.Get("Content-Disposition")); name != "" {
+			return name, nil
+		}
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %v", err)
+	}
+	if strings.HasSuffix(parsed.Path, "/") || path.Base(parsed.Path) == "." || path.Base(parsed.Path) == "/" {
+		return "", fmt.Errorf("URL does not name a file (empty file name); it looks like a directory")
+	}
+
+	// Una redirección a ".../" indica un directorio aunque la URL original no
+	// terminara en barra
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil &&
+		strings.HasSuffix(resp.Request.URL.Path, "/") {
+		return "", fmt.Errorf("URL redirects to a directory (%s)", resp.Request.URL.Path)
+	}
+
+	filename := filepath.Base(rawURL)
+	// Tras una redirección (mirror -> CDN) el nombre sale de la URL final
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil && resp.Request.URL.String() != rawURL {
+		if base := path.Base(resp.Request.URL.Path); base != "." && base != "/" {
+			filename = base
+		}
+	}
+	if resp != nil && isHTMLListing(resp, filename) {
+		return "", fmt.Errorf("server returned an HTML page instead of a file; it looks like a directory listing")
+	}
+	return filename, nil
+}
+
+// sanitizeFilename valida el nombre de archivo elegido por el cliente. Solo se
+// aceptan nombres simples: con separadores o ".." podría salir del directorio
+// de descargas
+func sanitizeFilename(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid filename %q", name)
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("filename %q must be a plain file name without path separators", name)
+	}
+	return name, nil
+}
+
+// isHTMLListing detecta respuestas HTML sin extensión ni Content-Disposition
+// de adjunto
+func isHTMLListing(resp *http.Response, filename string) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" {
+		return false
+	}
+	if disposition, _, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && disposition == "attachment" {
+		return false
+	}
+	return filepath.Ext(filename) == ""
+}
+
+// dispositionFilename extrae filename*/filename de una cabecera
+// Content-Disposition (mime decodifica filename* según RFC 5987). El nombre se
+// reduce a su último componente para que no pueda salir del directorio
+func dispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+
+	name := strings.TrimSpace(params["filename"])
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = path.Base(name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return ""
+	}
+	return name
+}
+
+// probeContentDisposition pide el primer byte con GET para leer
+// Content-Disposition cuando el servidor no lo envía en la respuesta HEAD
+func probeContentDisposition(client *http.Client, rawURL string, creds Credentials) string {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	applyCredentials(req, creds)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Content-Disposition")
+}
+
+// uniqueDestPath devuelve destPath si no existe o, si ya hay un archivo con
+// ese nombre, la primera variante libre "nombre (1).ext", "nombre (2).ext"...
+func uniqueDestPath(destPath string) string {
+	if _, err := os.Lstat(destPath); os.IsNotExist(err) {
+		return destPath
+	}
+
+	dir, name := filepath.Split(destPath)
+	ext := filepath.Ext(name)
+	// Mantener juntas las extensiones dobles habituales (archivo.tar.gz)
+	if inner := filepath.Ext(strings.TrimSuffix(name, ext)); inner == ".tar" {
+		ext = inner + ext
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	for n := 1; ; n++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// destinationPath elige la ruta final de la descarga. Sin Overwrite evita
+// pisar archivos existentes numerando el nombre, salvo que haya un merge
+// interrumpido hacia un destino concreto, que se retoma tal cual
+func destinationPath(d *ChunkedDownload) string {
+	d.RLock()
+	destPath := filepath.Join(d.DownloadDir, d.Filename)
+	overwrite := d.Overwrite
+	d.RUnlock()
+
+	if overwrite {
+		return destPath
+	}
+	if saved := d.PendingMergeDest(); saved != "" && filepath.Dir(saved) == filepath.Dir(destPath) {
+		return saved
+	}
+	return uniqueDestPath(destPath)
+}
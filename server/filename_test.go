@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"video.mp4", "video.mp4", false},
+		{"  report final.pdf  ", "report final.pdf", false},
+		{".hidden", ".hidden", false},
+		{"archive..tar.gz", "archive..tar.gz", false},
+		{"", "", true},
+		{"   ", "", true},
+		{".", "", true},
+		{"..", "", true},
+		{"../passwd", "", true},
+		{"dir/file.txt", "", true},
+		{`dir\file.txt`, "", true},
+		{"/etc/passwd", "", true},
+		{"file\x00.txt", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFilename(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sanitizeFilename(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
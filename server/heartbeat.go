@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Intervalo de los ping del servidor a cada cliente WebSocket
+	wsPingInterval = 30 * time.Second
+	// Sin pong ni mensajes durante este tiempo el cliente se da por muerto
+	wsPongWait = 75 * time.Second
+)
+
+// Ping envía un ping de control. Comparte el mutex de escritura con SendJSON
+func (sc *SafeConn) Ping() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+}
+
+// Own anota que la conexión inició o reanudó la descarga id
+func (sc *SafeConn) Own(id string) {
+	sc.ownedMu.Lock()
+	if sc.owned == nil {
+		sc.owned = make(map[string]struct{})
+	}
+	sc.owned[id] = struct{}{}
+	sc.ownedMu.Unlock()
+}
+
+// OwnedDownloads devuelve los ids de las descargas iniciadas o reanudadas por
+// la conexión
+func (sc *SafeConn) OwnedDownloads() []string {
+	sc.ownedMu.Lock()
+	defer sc.ownedMu.Unlock()
+
+	ids := make([]string, 0, len(sc.owned))
+	for id := range sc.owned {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// startHeartbeat fija el plazo de lectura, lo amplía con cada pong y envía
+// pings periódicos hasta que se cierre done. Si el cliente deja de responder
+// la lectura en curso falla con un timeout (ver isHeartbeatTimeout)
+func startHeartbeat(safeConn *SafeConn, done <-chan struct{}) {
+	conn := safeConn.conn
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := safeConn.Ping(); err != nil {
+					log.Printf("Ping to %s failed: %v", conn.RemoteAddr(), err)
+					// Desbloquear la lectura para que handleWS termine
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// isHeartbeatTimeout indica si la lectura falló porque el cliente no
+// respondió a los ping a tiempo
+func isHeartbeatTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// pauseOwnedDownloads pausa las descargas de un cliente que dejó de responder,
+// para que no sigan consumiendo recursos sin nadie al otro lado. Se reanudan
+// con resume_download al volver a conectar
+func pauseOwnedDownloads(safeConn *SafeConn) {
+	for _, id := range safeConn.OwnedDownloads() {
+		if !registry.IsActive(id) {
+			continue
+		}
+		log.Printf("Pausing %s: client stopped answering pings", downloadIDs.URL(id))
+		pauseChunkedDownload(nil, id)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Rotación de los logs del servidor: al superar logMaxSize el archivo pasa a
+// ser <nombre>.1 (y los anteriores se desplazan) conservando logMaxFiles
+// archivos antiguos. Configurables con --log-max-size (MB) y --log-max-files
+var (
+	logMaxSize  int64 = 50 * 1024 * 1024
+	logMaxFiles       = 5
+)
+
+// rotatingFile es un io.Writer sobre un archivo de log que rota por tamaño
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+// openRotatingFile abre (o crea) el log en path con los límites actuales
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: logMaxSize, maxFiles: logMaxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open abre el archivo en modo append y toma su tamaño actual
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write escribe p rotando antes si no cabe. Una línea nunca se parte entre
+// dos archivos
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Seguir escribiendo en el archivo actual antes que perder logs
+			fmt.Fprintf(os.Stderr, "Log rotation failed for %s: %v\n", r.path, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate desplaza path.N-1 → path.N, ..., path → path.1 y abre uno nuevo.
+// Con maxFiles 0 el archivo actual simplemente se vacía
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	if r.maxFiles > 0 {
+		os.Remove(r.backupPath(r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			os.Rename(r.backupPath(i), r.backupPath(i+1))
+		}
+		if err := os.Rename(r.path, r.backupPath(1)); err != nil && !os.IsNotExist(err) {
+			r.open()
+			return err
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		r.open()
+		return err
+	}
+	return r.open()
+}
+
+// backupPath es la ruta de la copia número n
+func (r *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// Close cierra el archivo; las escrituras posteriores fallan
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
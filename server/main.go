@@ -6,24 +6,38 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv" // Agregar esta línea
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"catchme/server/download"
 	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: allowedOrigin,
 }
 
 // Mutex para sincronizar escrituras al websocket
 type SafeConn struct {
 	conn *websocket.Conn
 	mu   sync.Mutex
+
+	// Descargas iniciadas o reanudadas desde esta conexión (ver heartbeat.go)
+	owned   map[string]struct{}
+	ownedMu sync.Mutex
+
+	// Identificador de la conexión en los logs estructurados
+	requestID string
 }
 
 // SendJSON envía un mensaje JSON de forma segura
@@ -40,103 +54,173 @@ func (sc *SafeConn) SendText(message string) error {
 	return sc.conn.WriteMessage(websocket.TextMessage, []byte(message))
 }
 
-func handleDownload(safeConn *SafeConn, url string) {
+// Close envía un close frame con el código indicado y cierra la conexión
+func (sc *SafeConn) Close(code int, reason string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	err := sc.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	sc.conn.Close()
+	return err
+}
+
+func handleDownload(safeConn *SafeConn, id, url string, opts DownloadOptions) {
 	// Marcamos la URL como activa
-	markDownloadActive(url)
-	defer markDownloadInactive(url) // Asegurarnos de que se elimine al finalizar
+	registry.Track(id, url)
+	defer registry.Remove(id) // Asegurarnos de que se elimine al finalizar
+
+	limiter, _ := registry.Limiter(id)
+	limiter.SetRate(opts.MaxRate)
+	cancelLimiter := make(chan struct{})
+	defer close(cancelLimiter)
 
 	log.Printf("Starting/Resuming download: %s", url)
 
-	client := &http.Client{
-		Timeout: 0, // Sin timeout global
-		Transport: &http.Transport{
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   15 * time.Second,
-			ResponseHeaderTimeout: 15 * time.Second,
-			ExpectContinueTimeout: 5 * time.Second,
-			DisableCompression:    true,
-			MaxConnsPerHost:       10,
-			DisableKeepAlives:     false,
-			ForceAttemptHTTP2:     true,
-		},
+	// Comprobar el directorio de destino antes de tocar la red
+	downloadDir, err := resolveDownloadDir(opts.DownloadDir)
+	if err == nil {
+		err = ensureWritableDir(downloadDir)
 	}
+	if err != nil {
+		log.Printf("Invalid download directory for %s: %v", url, err)
+		sendError(safeConn, id, ErrorCodeNotWritable, err.Error())
+		return
+	}
+
+	client := newDownloadClient(10, opts.httpProtocol(), opts.Proxy)
 
 	// Verificar el tamaño del archivo
-	head, err := client.Head(url)
+	head, err := fetchFileInfo(safeConn, id, client, url, opts.Credentials)
 	if err != nil {
 		log.Printf("Error getting file info: %v", err)
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Error checking file: %v", err))
+		sendError(safeConn, id, networkErrorCode(err, ErrorCodeHeadFailed), fmt.Sprintf("Error checking file: %v", err))
 		return
 	}
 	totalSize := head.ContentLength
 
-	// Intentar la descarga con retries
-	var resp *http.Response
+	filename := opts.Filename
+	if filename == "" {
+		filename, err = downloadFilename(url, head)
+		if err != nil {
+			log.Printf("Rejecting %s: %v", url, err)
+			sendError(safeConn, id, ErrorCodeNotAFile, err.Error())
+			return
+		}
+	}
+	if !checkContentType(safeConn, id, filename, opts.ExpectedContentType, head.Header.Get("Content-Type"), "") {
+		return
+	}
+
+	// Si el servidor acepta rangos, los reintentos continúan desde el último
+	// byte escrito en lugar de empezar de cero
+	acceptsRanges := head.Header.Get("Accept-Ranges") == "bytes"
+
+	// Intentar la descarga con retries. Los intentos se comparten entre la
+	// conexión inicial y las reconexiones tras un corte. Solo valen 200 (el
+	// archivo desde el principio) o, al continuar desde offset, 206: una
+	// página de error nunca llega a escribirse en el archivo
 	maxRetries := 15 // Aumentado de 10 a 15
+	retry := retryConfig
+	attempt := 0
+	connect := func(offset int64) (*http.Response, error) {
+		var lastErr error
+		for ; attempt < maxRetries; attempt++ {
+			if attempt > 0 {
+				delay := retry.Delay(attempt)
+				log.Printf("Retry attempt %d/%d after %v delay", attempt+1, maxRetries, delay)
+				sendMessage(safeConn, "log", id, fmt.Sprintf("Reconnecting... (attempt %d/%d)", attempt+1, maxRetries))
+				time.Sleep(delay)
+			}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			delay := time.Duration(attempt) * time.Second
-			log.Printf("Retry attempt %d/%d after %v delay", attempt+1, maxRetries, delay)
-			sendMessage(safeConn, "log", url, fmt.Sprintf("Reconnecting... (attempt %d/%d)", attempt+1, maxRetries))
-			time.Sleep(delay)
+			req, _ := http.NewRequest("GET", url, nil)
+			applyCredentials(req, opts.Credentials)
+			if offset > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			}
+			resp, err := client.Do(req)
+			if err == nil {
+				if resp.StatusCode == http.StatusOK || (offset > 0 && resp.StatusCode == http.StatusPartialContent) {
+					attempt++
+					return resp, nil
+				}
+				resp.Body.Close()
+				err = statusError{code: resp.StatusCode}
+			}
+			lastErr = err
+			log.Printf("Download attempt %d failed: %v", attempt+1, err)
 		}
-
-		req, _ := http.NewRequest("GET", url, nil)
-		resp, err = client.Do(req)
-		if err == nil {
-			break
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no retries left")
 		}
-		log.Printf("Download attempt %d failed: %v", attempt+1, err)
+		return nil, lastErr
 	}
 
+	resp, err := connect(0)
 	if err != nil {
 		log.Printf("All download attempts failed for %s: %v", url, err)
-		sendMessage(safeConn, "error", url, "All download attempts failed")
+		sendError(safeConn, id, networkErrorCode(err, ErrorCodeDownloadFailed), "All download attempts failed")
+		notifyDownloadResult(filename, false, "All download attempts failed")
+		fireStreamWebhook(opts, id, url, filename, "", totalSize, "All download attempts failed")
 		return
 	}
-	defer resp.Body.Close()
+	// resp cambia en cada reconexión
+	defer func() { resp.Body.Close() }()
 
-	filename := filepath.Base(url)
-
-	sendMessage(safeConn, "log", url, fmt.Sprintf("File size: %d bytes", totalSize))
+	// Algunos servidores solo envían Content-Disposition en la respuesta GET
+	if name := dispositionFilename(resp.Header.Get("Content-Disposition")); name != "" && opts.Filename == "" {
+		filename = name
+	}
 
-	// Asegurar que el directorio de descargas existe
-	home, err := os.UserHomeDir()
-	if err != nil {
-		log.Printf("Error getting home directory: %v", err)
-		sendMessage(safeConn, "error", url, "Could not determine download location")
-		return
+	sendMessage(safeConn, "log", id, fmt.Sprintf("File size: %d bytes", totalSize))
+	if totalSize > 0 {
+		if err := checkFileSize(totalSize, opts.MaxFileSize); err != nil {
+			sendError(safeConn, id, ErrorCodeFileTooLarge, err.Error())
+			return
+		}
+		if err := ensureFreeSpace(downloadDir, totalSize); err != nil {
+			sendError(safeConn, id, ErrorCodeInsufficientSpace, err.Error())
+			return
+		}
 	}
 
-	downloadDir := filepath.Join(home, "Downloads")
 	savePath := filepath.Join(downloadDir, filename)
+	if !opts.Overwrite {
+		// No pisar un archivo existente: numerar el nombre
+		savePath = uniqueDestPath(savePath)
+		filename = filepath.Base(savePath)
+	}
 
 	// Crear el directorio de descargas si no existe
-	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+	if err := makeDownloadDir(downloadDir); err != nil {
 		log.Printf("Error creating download directory: %v", err)
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Error creating directory: %v", err))
+		sendError(safeConn, id, diskErrorCode(err), fmt.Sprintf("Error creating directory: %v", err))
 		return
 	}
 
 	// Iniciar la descarga real
-	sendMessage(safeConn, "log", url, "Starting download...")
+	sendMessage(safeConn, "log", id, "Starting download...")
+	logEvent(safeConn, slog.LevelInfo, "download_started", "url", url, "download_id", id, "path", savePath,
+		"bytes", totalSize, "chunked", false)
 
-	// Buffer más grande para mejor rendimiento
-	buffer := make([]byte, 256*1024) // 256KB buffer
+	// Buffer del pool compartido con los chunks (--read-buffer)
+	bufPtr := download.GetReadBuffer()
+	defer download.PutReadBuffer(bufPtr)
+	buffer := *bufPtr
 	file, err := os.Create(savePath)
 	if err != nil {
 		log.Printf("Error creating file: %v", err)
-		sendMessage(safeConn, "error", url, fmt.Sprintf("Error creating file: %v", err))
+		sendError(safeConn, id, diskErrorCode(err), fmt.Sprintf("Error creating file: %v", err))
 		return
 	}
 	defer file.Close()
 
-	// Control de progreso mejorado
-	downloaded := int64(0) // Reset downloaded counter
+	// Control de progreso mejorado. downloaded también lo lee el ticker de
+	// progreso, y una reconexión sin rangos lo vuelve a poner a 0
+	var downloaded atomic.Int64
+	connectedAt := int64(0) // Bytes escritos al abrir la conexión actual
 	lastUpdate := time.Now()
 	startTime := time.Now()
+	meter := &download.SpeedMeter{}
 
 	// Control de progreso más frecuente
 	reportTicker := time.NewTicker(100 * time.Millisecond)
@@ -145,51 +229,66 @@ func handleDownload(safeConn *SafeConn, url string) {
 	// Ticker modificado para verificar cancellation
 	go func() {
 		for range reportTicker.C {
-			if !isDownloadActive(url) {
+			paused, tracked := registry.IsPaused(id)
+			if !tracked {
 				return // Salir del goroutine si se ha cancelado
 			}
+			if paused {
+				continue
+			}
 
-			if downloaded > 0 {
-				speed := float64(downloaded) / time.Since(startTime).Seconds()
-				sendProgress(safeConn, url, downloaded, totalSize, speed)
+			if current := downloaded.Load(); current > 0 {
+				sendProgress(safeConn, id, current, totalSize, meter.Observe(current))
 			}
 		}
 	}()
 
-	for {
-		// Verificar si la descarga ha sido cancelada o pausada
-		if !isDownloadActive(url) {
-			// Verificar si está pausada
-			activeDownloadsMux.Lock()
-			state, exists := activeDownloadsState[url]
-			activeDownloadsMux.Unlock()
-
-			if exists && state.paused {
-				log.Printf("Download paused during transfer: %s", url)
-				// No salir del bucle pero esperar
-				time.Sleep(500 * time.Millisecond)
-				continue
+	// resumed espera mientras la descarga esté pausada. Devuelve false si se
+	// canceló
+	resumed := func() bool {
+		for !registry.IsActive(id) {
+			if paused, tracked := registry.IsPaused(id); !tracked || !paused {
+				log.Printf("Download cancelled during transfer: %s", url)
+				sendProgress(safeConn, id, downloaded.Load(), totalSize, 0, StatusCanceled)
+				return false
 			}
+			log.Printf("Download paused during transfer: %s", url)
+			time.Sleep(500 * time.Millisecond)
+		}
+		return true
+	}
 
-			// Si no está pausada, entonces fue cancelada
-			log.Printf("Download cancelled during transfer: %s", url)
+	for {
+		if !resumed() {
 			return
 		}
 
 		n, err := resp.Body.Read(buffer)
 		if n > 0 {
-			_, writeErr := file.Write(buffer[:n])
+			// La escritura no se solapa con una pausa: lo leído mientras se
+			// pausaba se escribe al reanudar
+			var writeErr error
+			for !registry.RunIfActive(id, func() { _, writeErr = file.Write(buffer[:n]) }) {
+				if !resumed() {
+					return
+				}
+			}
 			if writeErr != nil {
 				log.Printf("Write error: %v", writeErr)
-				sendMessage(safeConn, "error", url, fmt.Sprintf("Write error: %v", writeErr))
+				sendError(safeConn, id, ErrorCodeDiskError, fmt.Sprintf("Write error: %v", writeErr))
+				sendProgress(safeConn, id, downloaded.Load(), totalSize, 0, StatusFailed)
+				notifyDownloadResult(filename, false, fmt.Sprintf("Write error: %v", writeErr))
+				fireStreamWebhook(opts, id, url, filename, "", totalSize, fmt.Sprintf("Write error: %v", writeErr))
 				return
 			}
-			downloaded += int64(n)
+			current := downloaded.Add(int64(n))
+
+			// Respetar los límites de ancho de banda (global y de la descarga)
+			waitForBandwidth(limiter, n, cancelLimiter)
 
 			// Actualizar progreso cada 100ms
 			if time.Since(lastUpdate) >= 100*time.Millisecond {
-				speed := float64(downloaded) / time.Since(startTime).Seconds()
-				sendProgress(safeConn, url, downloaded, totalSize, speed)
+				sendProgress(safeConn, id, current, totalSize, meter.Observe(current))
 				lastUpdate = time.Now()
 			}
 		}
@@ -199,52 +298,194 @@ func handleDownload(safeConn *SafeConn, url string) {
 				break
 			}
 			log.Printf("Read error: %v", err)
-			sendMessage(safeConn, "error", url, fmt.Sprintf("Read error: %v", err))
+			resp.Body.Close()
+
+			// Una conexión que avanzó no gasta el presupuesto de reintentos
+			if downloaded.Load() > connectedAt {
+				attempt = 1
+			}
+
+			offset := int64(0)
+			if acceptsRanges {
+				offset = downloaded.Load()
+			}
+			if resp, err = connect(offset); err == nil {
+				if resp.StatusCode == http.StatusPartialContent {
+					log.Printf("Resuming %s from byte %d", url, offset)
+				} else {
+					// Sin 206 el servidor envía el archivo entero: empezar de cero
+					log.Printf("Restarting %s from byte 0", url)
+					downloaded.Store(0)
+					if err = file.Truncate(0); err == nil {
+						_, err = file.Seek(0, io.SeekStart)
+					}
+				}
+				connectedAt = downloaded.Load()
+				if err == nil {
+					continue
+				}
+				resp.Body.Close()
+			}
+			// Para que el defer no cierre un resp nulo
+			resp = &http.Response{Body: http.NoBody}
+
+			sendError(safeConn, id, networkErrorCode(err, ErrorCodeNetwork), fmt.Sprintf("Read error: %v", err))
+			sendProgress(safeConn, id, downloaded.Load(), totalSize, 0, StatusFailed)
+			notifyDownloadResult(filename, false, fmt.Sprintf("Read error: %v", err))
+			fireStreamWebhook(opts, id, url, filename, "", totalSize, fmt.Sprintf("Read error: %v", err))
 			return
 		}
 	}
 
 	// Verificación final
-	if totalSize > 0 && downloaded != totalSize {
-		log.Printf("Incomplete download: %d of %d bytes", downloaded, totalSize)
-		sendMessage(safeConn, "error", url, "Incomplete download")
+	total := downloaded.Load()
+	if totalSize > 0 && total != totalSize {
+		log.Printf("Incomplete download: %d of %d bytes", total, totalSize)
+		sendError(safeConn, id, ErrorCodeDownloadFailed, "Incomplete download")
+		sendProgress(safeConn, id, total, totalSize, 0, StatusFailed)
+		notifyDownloadResult(filename, false, "Incomplete download")
+		fireStreamWebhook(opts, id, url, filename, "", totalSize, "Incomplete download")
 		return
 	}
 
+	file.Close()
+
+	// El checksum esperado se comprueba antes de dar la descarga por buena
+	if opts.ExpectedChecksum != "" {
+		sendMessage(safeConn, "log", id, "🔐 Verifying expected checksum...")
+		actual, code, err := checkFileChecksum(savePath, opts.ChecksumAlgorithm, opts.ExpectedChecksum, "")
+		if err != nil {
+			log.Printf("Checksum verification failed for %s: %v", url, err)
+			sendError(safeConn, id, code, err.Error())
+			sendProgress(safeConn, id, total, totalSize, 0, StatusFailed)
+			notifyDownloadResult(filename, false, err.Error())
+			fireStreamWebhook(opts, id, url, filename, "", totalSize, err.Error())
+			return
+		}
+		publishChecksumVerified(safeConn, id, opts.ChecksumAlgorithm, actual)
+	}
+
 	log.Printf("Download completed: %s", filename)
-	sendProgress(safeConn, url, downloaded, totalSize, 0, "completed")
+	applyOwnership(savePath)
+	sendProgress(safeConn, id, total, totalSize, 0, StatusCompleted)
+	sendDownloadComplete(safeConn, id, savePath, total, startTime)
+	sendMessage(safeConn, "log", id, fmt.Sprintf("✅ Download completed successfully: %s", filename))
+	notifyDownloadResult(filename, true, savePath)
+	fireStreamWebhook(opts, id, url, filename, savePath, total, "")
 }
 
-// Función mejorada para enviar mensajes
-func sendMessage(safeConn *SafeConn, msgType, url, message string) {
+// Función mejorada para enviar mensajes de una descarga
+func sendMessage(safeConn *SafeConn, msgType, id, message string) {
+	data := map[string]interface{}{
+		"type":        msgType,
+		"download_id": id,
+		"message":     message,
+	}
+	if msgType == "error" {
+		logEvent(safeConn, slog.LevelError, "download_error", "url", downloadIDs.URL(id), "download_id", id, "message", message)
+	}
+
+	if err := publishEvent(safeConn, data); err != nil {
+		log.Printf("Error sending message to client: %v", err)
+	}
+}
+
+// sendURLMessage envía un mensaje sobre una URL que no corresponde a ninguna
+// descarga (URL inválida, descarga no encontrada)
+func sendURLMessage(safeConn *SafeConn, msgType, url, message string) {
 	data := map[string]interface{}{
 		"type":    msgType,
 		"url":     url,
 		"message": message,
 	}
+	if msgType == "error" {
+		logEvent(safeConn, slog.LevelError, "download_error", "url", url, "message", message)
+	}
 
-	if err := safeConn.SendJSON(data); err != nil {
+	if err := publishEvent(safeConn, data); err != nil {
 		log.Printf("Error sending message to client: %v", err)
 	}
 }
 
+// sendURLError es sendError para errores sobre una URL sin descarga asociada
+func sendURLError(safeConn *SafeConn, url, code, message string) {
+	data := map[string]interface{}{
+		"type":       "error",
+		"url":        url,
+		"message":    message,
+		"error_code": code,
+	}
+	logEvent(safeConn, slog.LevelError, "download_error", "url", url, "error_code", code, "message", message)
+
+	if err := publishEvent(safeConn, data); err != nil {
+		log.Printf("Error sending error to client: %v", err)
+	}
+}
+
+// sendError envía un error con un código legible por el cliente
+func sendError(safeConn *SafeConn, id, code, message string) {
+	data := map[string]interface{}{
+		"type":        "error",
+		"download_id": id,
+		"message":     message,
+		"error_code":  code,
+	}
+	logEvent(safeConn, slog.LevelError, "download_error", "url", downloadIDs.URL(id), "download_id", id,
+		"error_code", code, "message", message)
+
+	if err := publishEvent(safeConn, data); err != nil {
+		log.Printf("Error sending error to client: %v", err)
+	}
+}
+
+// sendDownloadComplete envía el evento download_complete con los datos finales
+// de la descarga, para que los clientes no dependan del mensaje de log
+func sendDownloadComplete(safeConn *SafeConn, id, savePath string, totalBytes int64, startedAt time.Time) {
+	elapsed := time.Since(startedAt).Seconds()
+	averageSpeed := 0.0
+	if elapsed > 0 {
+		averageSpeed = float64(totalBytes) / elapsed
+	}
+
+	data := map[string]interface{}{
+		"type":          "download_complete",
+		"download_id":   id,
+		"filename":      filepath.Base(savePath),
+		"save_path":     savePath,
+		"total_bytes":   totalBytes,
+		"elapsed":       elapsed,
+		"average_speed": averageSpeed,
+	}
+	logEvent(safeConn, slog.LevelInfo, "download_completed", "url", downloadIDs.URL(id), "download_id", id, "path", savePath,
+		"bytes", totalBytes, "elapsed", elapsed, "speed", averageSpeed)
+
+	if err := publishEvent(safeConn, data); err != nil {
+		log.Printf("Error sending completion to client: %v", err)
+	}
+}
+
 // Función mejorada para enviar progreso
-func sendProgress(safeConn *SafeConn, url string, bytesReceived, totalBytes int64, speed float64, status ...string) {
-	downloadStatus := "downloading"
+func sendProgress(safeConn *SafeConn, id string, bytesReceived, totalBytes int64, speed float64, status ...DownloadStatus) {
+	downloadStatus := StatusDownloading
 	if len(status) > 0 {
 		downloadStatus = status[0]
 	}
+	if downloadStatus == StatusDownloading {
+		recordSpeedSample(id, bytesReceived)
+	}
 
 	data := map[string]interface{}{
 		"type":          "progress",
-		"url":           url,
+		"download_id":   id,
 		"bytesReceived": bytesReceived,
 		"totalBytes":    totalBytes,
 		"speed":         speed,
+		"avg_speed":     getPreviousSpeed(id),
 		"status":        downloadStatus,
+		"eta_seconds":   estimateETA(id, bytesReceived, totalBytes, downloadStatus),
 	}
 
-	if err := safeConn.SendJSON(data); err != nil {
+	if err := publishEvent(safeConn, data); err != nil {
 		log.Printf("Error sending progress to client: %v", err)
 	}
 }
@@ -256,6 +497,45 @@ const (
 	ChunksSupported    = true // Actualizar a true
 )
 
+// serverInfo devuelve el mensaje server_info. Con withConfig incluye también
+// la configuración en uso, para get_server_info
+func serverInfo(withConfig bool) map[string]interface{} {
+	info := map[string]interface{}{
+		"type":             "server_info",
+		"implementation":   ImplementationInfo,
+		"features":         FeaturesSupported,
+		"chunks_supported": ChunksSupported,
+		"protocol_version": ProtocolVersion,
+	}
+	if !withConfig {
+		return info
+	}
+
+	algorithms := make([]string, 0, len(download.ChecksumAlgorithms))
+	for algo, h := range download.ChecksumAlgorithms {
+		if h.Available() {
+			algorithms = append(algorithms, algo)
+		}
+	}
+	sort.Strings(algorithms)
+
+	info["config"] = map[string]interface{}{
+		"max_concurrent_downloads": maxConcurrentDownloads, // 0 = sin límite
+		"max_concurrent_checksums": maxConcurrentChecksums,
+		"min_chunk_size":           MinChunkSize,
+		"max_chunk_size":           MaxChunkSize,
+		"checksum_algorithms":      algorithms,
+		"default_checksum":         DefaultChecksumAlgorithm,
+		"max_chunk_retries":        retryConfig.MaxRetries,
+		"head_retries":             retryConfig.HeadRetries,
+		"user_agent":               userAgentFor("", ""),
+		"tls_verify":               !tlsSkipVerify,
+		"auto_concurrency":         autoConcurrency,
+		"ui_delays":                !noUIDelays,
+	}
+	return info
+}
+
 func handleWS(w http.ResponseWriter, r *http.Request) {
 	// Mejorar el log con información de cliente
 	log.Printf("WebSocket connection request from %s", r.RemoteAddr)
@@ -267,27 +547,28 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Crear conexión segura con mutex
-	safeConn := &SafeConn{conn: conn}
+	safeConn := &SafeConn{conn: conn, requestID: newDownloadID()}
+	wsConnections.Add(safeConn)
 
-	// Configuración sin timeouts para evitar desconexiones
-	conn.SetReadDeadline(time.Time{})
+	// Ping periódico: un cliente que no responde se desconecta en lugar de
+	// mantener vivas sus descargas indefinidamente
+	heartbeatDone := make(chan struct{})
+	startHeartbeat(safeConn, heartbeatDone)
 
 	log.Printf("Client connected: %s", r.RemoteAddr)
+	logEvent(safeConn, slog.LevelInfo, "ws_connected", "remote", r.RemoteAddr)
 
 	// Enviar info al cliente sobre capacidades del servidor cuando se conecta
-	serverInfo := map[string]interface{}{
-		"type":             "server_info",
-		"implementation":   ImplementationInfo,
-		"features":         FeaturesSupported,
-		"chunks_supported": ChunksSupported,
-	}
-
-	safeConn.SendJSON(serverInfo)
+	safeConn.SendJSON(serverInfo(false))
 
 	// Cleanup al finalizar
 	defer func() {
+		close(heartbeatDone)
+		watchers.UnwatchAll(safeConn)
+		wsConnections.Remove(safeConn)
 		conn.Close()
 		log.Printf("Client disconnected: %s", r.RemoteAddr)
+		logEvent(safeConn, slog.LevelInfo, "ws_disconnected", "remote", r.RemoteAddr)
 	}()
 
 	// Manejar mensajes
@@ -295,7 +576,10 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			// Log más descriptivo sobre desconexiones
-			if websocket.IsUnexpectedCloseError(err) {
+			if isHeartbeatTimeout(err) {
+				log.Printf("Client %s stopped answering pings, closing connection", r.RemoteAddr)
+				pauseOwnedDownloads(safeConn)
+			} else if websocket.IsUnexpectedCloseError(err) {
 				log.Printf("Client %s disconnected: %v", r.RemoteAddr, err)
 			} else {
 				log.Printf("WebSocket error from %s: %v", r.RemoteAddr, err)
@@ -303,6 +587,9 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		// Cualquier mensaje también demuestra que el cliente sigue vivo
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
 		// Decodificar el mensaje
 		var msg map[string]interface{}
 		if err := json.Unmarshal(message, &msg); err != nil {
@@ -310,73 +597,148 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		if msg["type"] != "ping" {
+			logEvent(safeConn, slog.LevelInfo, "ws_message", "type", msg["type"], "url", msg["url"])
+		}
+
 		// Manejar tipos de mensajes
 		switch msg["type"] {
 		case "start_download":
-			if url, ok := msg["url"].(string); ok {
-				log.Printf("Download request for: %s", url)
+			// Validar la URL antes de cualquier petición de red
+			raw, _ := msg["url"].(string)
+			url, err := normalizeDownloadURL(raw)
+			if err != nil {
+				log.Printf("Invalid download request: %v", err)
+				sendURLError(safeConn, raw, ErrorCodeInvalidURL, err.Error())
+				continue
+			}
+			log.Printf("Download request for: %s", url)
 
-				// Remove Ubuntu-specific checks
-				if isDownloadActive(url) {
-					log.Printf("URL already being downloaded: %s", url)
-					sendMessage(safeConn, "error", url, "This URL is already being downloaded")
-				} else {
-					useChunks, _ := msg["use_chunks"].(bool)
-					if useChunks {
-						go handleChunkedDownload(safeConn, url)
-					} else {
-						go handleDownload(safeConn, url)
-					}
-				}
-			} else {
-				log.Printf("Invalid download request, missing URL")
+			opts, err := parseDownloadOptions(msg)
+			if err != nil {
+				sendURLError(safeConn, url, ErrorCodeInvalidRequest, fmt.Sprintf("Invalid download options: %v", err))
+				continue
 			}
-		case "cancel_download":
-			if url, ok := msg["url"].(string); ok {
-				log.Printf("Canceling download for: %s", url)
 
-				// Intentar cancelar descarga por chunks primero
-				if isDownloadActive(url) {
-					// Los nombres de función deben coincidir exactamente
-					handleCancelChunkedDownload(safeConn, url)
-				} else {
-					// Marcar como inactivo el método tradicional
-					markDownloadInactive(url)
+			// La misma URL puede bajarse a la vez hacia destinos distintos;
+			// solo se rechaza si va al mismo sitio
+			dest := downloadDestination(opts.DownloadDir, opts.Filename)
+			if findDuplicate(url, dest) != "" {
+				log.Printf("URL already being downloaded to %s: %s", dest, url)
+				sendURLError(safeConn, url, ErrorCodeAlreadyInProgress, "This URL is already being downloaded to the same destination")
+				continue
+			}
 
-					// Enviar confirmación al cliente
-					sendMessage(safeConn, "log", url, "Download canceled by user")
-					sendMessage(safeConn, "cancel_confirmed", url, "Download canceled successfully")
-				}
+			// Confirmar antes de arrancar, para que download_accepted llegue
+			// antes que cualquier otro evento de la descarga
+			id := downloadIDs.Assign(url, dest)
+			publishEvent(safeConn, map[string]interface{}{
+				"type":        "download_accepted",
+				"download_id": id,
+			})
+
+			// Los rangos explícitos solo se pueden atender por chunks
+			useChunks, _ := msg["use_chunks"].(bool)
+			start := func() { handleDownload(safeConn, id, url, opts) }
+			if useChunks || len(opts.Ranges) > 0 {
+				start = func() { handleChunkedDownload(safeConn, id, url, opts) }
+			}
+
+			// Arrancar ya o esperar en la cola si se alcanzó --max-downloads
+			if err := downloadSlots.Submit(id, safeConn, start); err != nil {
+				sendError(safeConn, id, ErrorCodeAlreadyInProgress, err.Error())
+			} else {
+				safeConn.Own(id)
+			}
+		case "cancel_download":
+			url, _ := msg["url"].(string)
+			id, err := resolveDownload(msg)
+			switch {
+			case err == nil:
+				cancelDownload(safeConn, id)
+			case err == errDownloadNotFound:
+				// Confirmar igualmente para mantener la UI consistente
+				sendURLMessage(safeConn, "log", url, "No active download found to cancel")
+				sendURLMessage(safeConn, "cancel_confirmed", url, "Download already cancelled")
+			default:
+				sendURLError(safeConn, url, ErrorCodeInvalidRequest, err.Error())
 			}
 		case "pause_download":
-			if url, ok := msg["url"].(string); ok {
-				log.Printf("Pause request received for: %s", url)
+			if id, ok := resolveCommand(safeConn, msg, "No active download found to pause"); ok {
+				log.Printf("Pause request received for: %s", downloadIDs.URL(id))
 
 				// Pausar descarga
-				if isDownloadActive(url) {
-					handlePauseChunkedDownload(safeConn, url)
+				if registry.IsActive(id) {
+					handlePauseChunkedDownload(safeConn, id)
 				} else {
-					sendMessage(safeConn, "error", url, "No active download found to pause")
+					sendError(safeConn, id, ErrorCodeNotFound, "No active download found to pause")
 				}
-			} else {
-				log.Printf("Invalid pause request: missing URL")
 			}
 		case "resume_download":
-			if url, ok := msg["url"].(string); ok {
-				log.Printf("Resume request received for: %s", url)
+			if id, ok := resolveCommand(safeConn, msg, "No download found to resume"); ok {
+				log.Printf("Resume request received for: %s", downloadIDs.URL(id))
+				applyResumeOptions(id, msg)
 
 				// Reanudar descarga
-				handleResumeChunkedDownload(safeConn, url)
-			} else {
-				log.Printf("Invalid resume request: missing URL")
+				safeConn.Own(id)
+				handleResumeChunkedDownload(safeConn, id)
+			}
+		case "retry_download":
+			if id, ok := resolveCommand(safeConn, msg, "No download found to retry"); ok {
+				log.Printf("Retry request received for: %s", downloadIDs.URL(id))
+				applyResumeOptions(id, msg)
+				handleRetryDownload(safeConn, id)
+			}
+		case "pause_all":
+			handlePauseAll(safeConn)
+		case "resume_all":
+			handleResumeAll(safeConn)
+		case "cancel_all":
+			handleCancelAll(safeConn)
+		case "pause_chunk", "resume_chunk":
+			handleChunkCommand(safeConn, msg)
+		case "list_active":
+			handleListActive(safeConn)
+		case "subscribe":
+			if id, ok := resolveCommand(safeConn, msg, "No download found to subscribe to"); ok {
+				handleSubscribe(safeConn, id)
+			}
+		case "unsubscribe":
+			if id, ok := resolveCommand(safeConn, msg, ""); ok {
+				handleUnsubscribe(safeConn, id)
 			}
+		case "set_rate":
+			handleSetRate(safeConn, msg)
+		case "is_paused":
+			handleIsPaused(safeConn, msg)
 		case "calculate_checksum":
 			if url, ok := msg["url"].(string); ok {
 				if filename, ok := msg["filename"].(string); ok {
 					log.Printf("Checksum calculation request for: %s", filename)
-					handleCalculateChecksum(safeConn, url, filename)
+					// Un archivo ya descargado no tiene descarga registrada:
+					// el resultado va con un id propio
+					id, err := resolveDownload(msg)
+					if err != nil {
+						id = downloadIDs.Assign(url, "")
+					}
+					override, _ := msg["download_dir"].(string)
+					dir, err := resolveDownloadDir(override)
+					if err != nil {
+						sendError(safeConn, id, ErrorCodeInvalidRequest, err.Error())
+						continue
+					}
+					algo, _ := msg["algorithm"].(string)
+					handleCalculateChecksum(safeConn, id, dir, filename, algo, nil)
 				}
 			}
+		case "hello":
+			handleHello(safeConn, msg)
+		case "get_info":
+			// Solo HEAD: puede tardar con reintentos, no bloquear el bucle
+			go handleGetInfo(safeConn, msg)
+		case "get_server_info":
+			// Lo mismo que se envía al conectar, más la configuración en uso
+			safeConn.SendJSON(serverInfo(true))
 		case "ping":
 			safeConn.SendJSON(map[string]string{"type": "pong"})
 		default:
@@ -385,16 +747,113 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// cancelDownload cancela una descarga por chunks o, si no lo es, deja de
+// rastrearla (descargas de una sola conexión y en cola)
+func cancelDownload(safeConn *SafeConn, id string) {
+	log.Printf("Canceling download for: %s", downloadIDs.URL(id))
+
+	// Intentar cancelar descarga por chunks primero
+	if registry.IsActive(id) {
+		// Los nombres de función deben coincidir exactamente
+		handleCancelChunkedDownload(safeConn, id)
+	} else {
+		// Marcar como inactivo el método tradicional
+		registry.Remove(id)
+
+		// Enviar confirmación al cliente
+		sendMessage(safeConn, "log", id, "Download canceled by user")
+		sendMessage(safeConn, "cancel_confirmed", id, "Download canceled successfully")
+	}
+}
+
+// handleSetRate cambia en caliente el límite de ancho de banda de una descarga
+// (max_rate en bytes/s, 0 para quitarlo)
+func handleSetRate(safeConn *SafeConn, msg map[string]interface{}) {
+	url, _ := msg["url"].(string)
+	rate, ok := msg["max_rate"].(float64)
+	if !ok || rate < 0 {
+		sendURLError(safeConn, url, ErrorCodeInvalidRequest, "set_rate requires a non-negative max_rate in bytes per second")
+		return
+	}
+
+	id, ok := resolveCommand(safeConn, msg, "No active download found to throttle")
+	if !ok {
+		return
+	}
+	limiter, exists := registry.Limiter(id)
+	if !exists {
+		sendError(safeConn, id, ErrorCodeNotFound, "No active download found to throttle")
+		return
+	}
+
+	limiter.SetRate(int64(rate))
+	log.Printf("Rate limit for %s set to %d bytes/s", downloadIDs.URL(id), int64(rate))
+	safeConn.SendJSON(map[string]interface{}{
+		"type":        "rate_updated",
+		"url":         downloadIDs.URL(id),
+		"download_id": id,
+		"max_rate":    int64(rate),
+		"global_rate": globalRateLimiter.Rate(),
+	})
+}
+
+// handleIsPaused responde con el estado de pausa de una descarga, o de todas
+// las descargas rastreadas si el mensaje no incluye URL ni download_id
+func handleIsPaused(safeConn *SafeConn, msg map[string]interface{}) {
+	url, _ := msg["url"].(string)
+	if id, _ := msg["download_id"].(string); url != "" || id != "" {
+		id, err := resolveDownload(msg)
+		if err != nil && err != errDownloadNotFound {
+			sendURLError(safeConn, url, ErrorCodeInvalidRequest, err.Error())
+			return
+		}
+		paused, tracked := registry.IsPaused(id)
+		if tracked {
+			url = downloadIDs.URL(id)
+		}
+		safeConn.SendJSON(map[string]interface{}{
+			"type":        "pause_state",
+			"url":         url,
+			"download_id": id,
+			"paused":      paused,
+			"tracked":     tracked,
+		})
+		return
+	}
+
+	entries := registry.Entries()
+	downloads := make([]map[string]interface{}, 0, len(entries))
+	allPaused := len(entries) > 0
+	for _, entry := range entries {
+		downloads = append(downloads, map[string]interface{}{
+			"url":         entry.URL,
+			"download_id": entry.ID,
+			"paused":      entry.Paused,
+		})
+		allPaused = allPaused && entry.Paused
+	}
+
+	safeConn.SendJSON(map[string]interface{}{
+		"type":       "pause_state",
+		"downloads":  downloads,
+		"all_paused": allPaused,
+	})
+}
+
 func parseCommandLineArgs() (bool, int) {
 	runAsService := false
 	port := 8080
 
-	// Verificar si hay argumentos para ejecutar como servicio
-	args := os.Args[1:]
+	// Verificar si hay argumentos para ejecutar como servicio. Las opciones
+	// de --config van delante de las de la línea de comandos
+	args := commandLineArgs()
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "--service", "-s":
 			runAsService = true
+		case "--config":
+			// Ya aplicado por commandLineArgs
+			i++
 		case "--port", "-p":
 			if i+1 < len(args) {
 				if p, err := strconv.Atoi(args[i+1]); err == nil {
@@ -402,6 +861,222 @@ func parseCommandLineArgs() (bool, int) {
 					i++ // Saltar el siguiente argumento
 				}
 			}
+		case "--max-checksums":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+					maxConcurrentChecksums = n
+					i++
+				} else {
+					log.Printf("Invalid --max-checksums value: %s", args[i+1])
+				}
+			}
+		case "--tcp-rcvbuf":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+					tcpReceiveBuffer = n
+					i++
+				} else {
+					log.Printf("Invalid --tcp-rcvbuf value: %s", args[i+1])
+				}
+			}
+		case "--rotate-edges":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 0 {
+					edgeRotationThreshold = n
+					i++
+				} else {
+					log.Printf("Invalid --rotate-edges value: %s", args[i+1])
+				}
+			}
+		case "--download-dir":
+			if i+1 < len(args) {
+				downloadDirectory = args[i+1]
+				i++
+			}
+		case "--temp-dir":
+			if i+1 < len(args) {
+				if dir, err := resolveDownloadDir(args[i+1]); err == nil {
+					tempDirectory = dir
+					i++
+				} else {
+					log.Printf("Invalid --temp-dir value: %v", err)
+				}
+			}
+		case "--max-downloads":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 0 {
+					maxConcurrentDownloads = n
+					i++
+				} else {
+					log.Printf("Invalid --max-downloads value: %s", args[i+1])
+				}
+			}
+		case "--direct-write":
+			directWrite = true
+		case "--auto-concurrency":
+			autoConcurrency = true
+		case "--individual-chunk-init":
+			individualChunkInit = true
+		case "--no-ui-delays":
+			noUIDelays = true
+		case "--read-buffer":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 4*1024 {
+					download.ReadBufferSize = n
+					i++
+				} else {
+					log.Printf("Invalid --read-buffer value (minimum 4096 bytes): %s", args[i+1])
+				}
+			}
+		case "--retry-strategy":
+			if i+1 < len(args) {
+				if strategy, err := download.ParseRetryStrategy(args[i+1]); err == nil {
+					retryConfig.Strategy = strategy
+					i++
+				} else {
+					log.Printf("Invalid --retry-strategy: %v", err)
+				}
+			}
+		case "--retry-base", "--retry-max":
+			if i+1 < len(args) {
+				if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+					if args[i] == "--retry-base" {
+						retryConfig.BaseDelay = d
+					} else {
+						retryConfig.MaxDelay = d
+					}
+					i++
+				} else {
+					log.Printf("Invalid %s value (expected a duration like 2s): %s", args[i], args[i+1])
+				}
+			}
+		case "--max-retries":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 0 {
+					retryConfig.MaxRetries = n
+					i++
+				} else {
+					log.Printf("Invalid --max-retries value (expected a non-negative integer): %s", args[i+1])
+				}
+			}
+		case "--user-agent":
+			if i+1 < len(args) {
+				userAgent = args[i+1]
+				i++
+			}
+		case "--head-retries":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 0 {
+					retryConfig.HeadRetries = n
+					i++
+				} else {
+					log.Printf("Invalid --head-retries value (expected a non-negative integer): %s", args[i+1])
+				}
+			}
+		case "--chunk-timeout", "--stuck-timeout":
+			if i+1 < len(args) {
+				if d, err := time.ParseDuration(args[i+1]); err == nil && d > 0 {
+					if args[i] == "--chunk-timeout" {
+						retryConfig.ChunkTimeout = d
+					} else {
+						retryConfig.StuckTimeout = d
+					}
+					i++
+				} else {
+					log.Printf("Invalid %s value (expected a duration like 90s): %s", args[i], args[i+1])
+				}
+			}
+		case "--retry-jitter":
+			retryConfig.Jitter = true
+		case "--max-rate":
+			if i+1 < len(args) {
+				if n, err := strconv.ParseInt(args[i+1], 10, 64); err == nil && n >= 0 {
+					globalRateLimiter.SetRate(n)
+					i++
+				} else {
+					log.Printf("Invalid --max-rate value (bytes per second): %s", args[i+1])
+				}
+			}
+		case "--http1":
+			forceHTTP1 = true
+		case "--insecure-skip-verify":
+			tlsSkipVerify = true
+			warnInsecureTLS()
+		case "--ca-cert":
+			if i+1 < len(args) {
+				if err := loadCACert(args[i+1]); err == nil {
+					i++
+				} else {
+					log.Printf("Invalid --ca-cert value: %v", err)
+				}
+			}
+		case "--proxy":
+			if i+1 < len(args) {
+				if _, err := parseProxyURL(args[i+1]); err == nil {
+					defaultProxy = args[i+1]
+					i++
+				} else {
+					log.Printf("Invalid --proxy value: %v", err)
+				}
+			}
+		case "--log-format":
+			if i+1 < len(args) {
+				if format, err := parseLogFormat(args[i+1]); err == nil {
+					logFormat = format
+					i++
+				} else {
+					log.Printf("Invalid --log-format value: %v", err)
+				}
+			}
+		case "--log-format=text", "--log-format=json":
+			logFormat = strings.TrimPrefix(args[i], "--log-format=")
+		case "--log-max-size":
+			if i+1 < len(args) {
+				if mb, err := strconv.ParseInt(args[i+1], 10, 64); err == nil && mb > 0 {
+					logMaxSize = mb * 1024 * 1024
+					i++
+				} else {
+					log.Printf("Invalid --log-max-size value (megabytes): %s", args[i+1])
+				}
+			}
+		case "--log-max-files":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n >= 0 {
+					logMaxFiles = n
+					i++
+				} else {
+					log.Printf("Invalid --log-max-files value: %s", args[i+1])
+				}
+			}
+		case "--webhook-url":
+			if i+1 < len(args) {
+				if err := parseWebhookURL(args[i+1]); err == nil {
+					webhookURL = args[i+1]
+					i++
+				} else {
+					log.Printf("Invalid --webhook-url value: %v", err)
+				}
+			}
+		case "--chown":
+			if i+1 < len(args) {
+				if uid, gid, err := parseChownSpec(args[i+1]); err == nil {
+					chownUID, chownGID = uid, gid
+					i++
+				} else {
+					log.Printf("Invalid --chown value: %v", err)
+				}
+			}
+		case "--notify":
+			notifyEnabled = true
+		case "--merge-concurrency":
+			if i+1 < len(args) {
+				if n, err := strconv.Atoi(args[i+1]); err == nil && n > 0 {
+					mergeConcurrency = n
+					i++
+				} else {
+					log.Printf("Invalid --merge-concurrency value: %s", args[i+1])
+				}
+			}
 		}
 	}
 
@@ -429,14 +1104,32 @@ func main() {
 	}
 
 	// Configurar logging a archivo
-	logFile, err := os.OpenFile("logs/server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	logFile, err := openRotatingFile(filepath.Join("logs", "server.log"))
 	if err != nil {
 		log.Printf("Failed to open log file: %v", err)
+		setupLogging(os.Stderr)
 	} else {
-		log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+		setupLogging(io.MultiWriter(os.Stdout, logFile))
 	}
 
-	http.HandleFunc("/ws", handleWS)
-	log.Printf("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// Medias de velocidad por servidor de ejecuciones anteriores
+	loadSpeedHints()
+
+	// Recuperar descargas interrumpidas por un reinicio anterior
+	restorePersistedDownloads()
+
+	// Apagado ordenado: pausar descargas y conservar sus chunks para reanudar
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received signal: %v", sig)
+		shutdownServer()
+	}()
+
+	if err := startHTTPServer(fmt.Sprintf(":%d", port)); err != nil {
+		log.Fatal(err)
+	}
+	// ListenAndServe vuelve en cuanto empieza el apagado; esperar a que termine
+	shutdownServer()
 }
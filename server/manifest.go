@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"catchme/server/download"
+)
+
+// loadManifest restaura una descarga pausada de tempDir (ver
+// download.LoadManifest) con la configuración actual del servidor
+func loadManifest(tempDir string) (*ChunkedDownload, error) {
+	d, err := download.LoadManifest(tempDir)
+	if err != nil {
+		return nil, err
+	}
+	if base := filepath.Dir(tempDir); base != tempBaseDir() {
+		d.TempBase = base
+	}
+	configureDownload(d)
+	d.RotateEdges(edgeRotationThreshold)
+	return d, nil
+}
+
+// restorePersistedDownloads busca manifiestos de descargas sin terminar en el
+// directorio temporal y las registra como pausadas, listas para resume_download
+func restorePersistedDownloads() {
+	restored := 0
+	for _, root := range knownTempRoots() {
+		restored += restoreFromTempRoot(root)
+	}
+
+	if restored > 0 {
+		log.Printf("Restored %d interrupted download(s); send resume_download to continue", restored)
+	}
+}
+
+// restoreFromTempRoot restaura las descargas con manifiesto bajo una raíz
+// temporal y devuelve cuántas registró
+func restoreFromTempRoot(root string) int {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not scan %s for interrupted downloads: %v", root, err)
+		}
+		return 0
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		tempDir := filepath.Join(root, entry.Name())
+		download, err := loadManifest(tempDir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Skipping interrupted download in %s: %v", tempDir, err)
+			}
+			continue
+		}
+
+		dest := filepath.Join(download.DownloadDir, download.Filename)
+		if findDuplicate(download.URL, dest) != "" {
+			log.Printf("Skipping duplicate interrupted download for %s", download.URL)
+			continue
+		}
+		// Los manifiestos anteriores a los ids reciben uno nuevo
+		if download.ID == "" {
+			download.ID = newDownloadID()
+		}
+		downloadIDs.Bind(download.ID, download.URL, dest)
+		registry.Register(download.ID, download)
+		registry.SetPaused(download.ID, true)
+
+		log.Printf("Restored interrupted download %s (%d chunks)", download.URL, len(download.Chunks))
+		restored++
+	}
+	return restored
+}
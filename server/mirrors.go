@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// checkMirrors comprueba que los mirrors sirven el mismo archivo que la URL
+// principal. Un tamaño distinto casi seguro es otro archivo y hace fallar la
+// descarga; los mirrors que no responden o no aceptan rangos se descartan.
+// Las credenciales solo son de la URL principal y no se envían a los mirrors
+func checkMirrors(safeConn *SafeConn, id string, client *http.Client, url string, mirrors []string, size int64) ([]string, error) {
+	usable := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		resp, err := fileInfoRequest(client, mirror, http.MethodHead, Credentials{})
+		if err != nil || resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+			resp, err = fileInfoRequest(client, mirror, http.MethodGet, Credentials{})
+		}
+		if err != nil {
+			log.Printf("Skipping mirror %s: %v", mirror, err)
+			sendMessage(safeConn, "log", id, fmt.Sprintf("Skipping mirror %s: %v", mirror, err))
+			continue
+		}
+		if resp.ContentLength != size {
+			return nil, fmt.Errorf("mirror %s reports %d bytes but %s has %d: they are likely different files",
+				mirror, resp.ContentLength, url, size)
+		}
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			log.Printf("Skipping mirror %s: no range support", mirror)
+			sendMessage(safeConn, "log", id, fmt.Sprintf("Skipping mirror %s: it doesn't support range requests", mirror))
+			continue
+		}
+		usable = append(usable, mirror)
+	}
+	return usable, nil
+}
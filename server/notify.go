@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Notificaciones de escritorio al terminar una descarga (--notify)
+var notifyEnabled = false
+
+// notifyDownloadResult lanza una notificación del sistema con el resultado de
+// una descarga. No bloquea y solo registra un aviso si no hay notificador
+func notifyDownloadResult(filename string, success bool, detail string) {
+	if !notifyEnabled {
+		return
+	}
+
+	title := "CatchMe: download completed"
+	if !success {
+		title = "CatchMe: download failed"
+	}
+	body := filename
+	if detail != "" {
+		body = fmt.Sprintf("%s\n%s", filename, detail)
+	}
+
+	go func() {
+		if err := sendDesktopNotification(title, body); err != nil {
+			log.Printf("Desktop notification not sent: %v", err)
+		}
+	}()
+}
+
+// sendDesktopNotification invoca el notificador nativo de cada plataforma
+func sendDesktopNotification(title, body string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s",
+			appleScriptString(body), appleScriptString(title))
+		cmd = exec.Command("osascript", "-e", script)
+	case "windows":
+		script := fmt.Sprintf(`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$texts = $template.GetElementsByTagName('text')
+$texts.Item(0).AppendChild($template.CreateTextNode(%s)) | Out-Null
+$texts.Item(1).AppendChild($template.CreateTextNode(%s)) | Out-Null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('CatchMe').Show([Windows.UI.Notifications.ToastNotification]::new($template))`,
+			powerShellString(title), powerShellString(body))
+		cmd = exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		cmd = exec.Command("notify-send", "--app-name=CatchMe", title, body)
+	}
+
+	// Degradar sin error ruidoso si el notificador no está instalado
+	if _, err := exec.LookPath(cmd.Path); err != nil {
+		return fmt.Errorf("notifier %q not available: %v", cmd.Args[0], err)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v (%s)", cmd.Args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// appleScriptString escapa un texto como literal de AppleScript
+func appleScriptString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// powerShellString escapa un texto como literal de PowerShell entre comillas simples
+func powerShellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"catchme/server/download"
+)
+
+// DownloadOptions agrupa los campos opcionales del mensaje start_download
+type DownloadOptions struct {
+	// Rangos concretos a descargar. Vacío descarga el archivo completo; con
+	// rangos el resultado es un archivo disperso con huecos fuera de ellos
+	Ranges []ByteRange
+
+	// Límite de ancho de banda de esta descarga en bytes/s (0 = sin límite).
+	// Se combina con el límite global: la tasa efectiva es el mínimo
+	MaxRate int64
+
+	// Desactivar HTTP/2 para que cada chunk abra su propia conexión TCP.
+	// Equivale a Protocol "http1"
+	ForceHTTP1 bool
+
+	// Protocolo HTTP de esta descarga: "" (auto), "http1" o "http2"
+	Protocol string
+
+	// Directorio de destino de esta descarga (vacío usa --download-dir o
+	// ~/Downloads)
+	DownloadDir string
+
+	// Nombre del archivo final. Vacío usa Content-Disposition o la URL
+	Filename string
+
+	// URLs alternativas del mismo archivo (mirrors)
+	Mirrors []string
+
+	// Raíz de los archivos temporales de esta descarga (vacío usa --temp-dir
+	// o el directorio temporal del sistema)
+	TempDir string
+
+	// Credenciales HTTP (username/password o auth_token)
+	Credentials Credentials
+
+	// Proxy de esta descarga (http://, https:// o socks5://). Vacío usa
+	// --proxy o las variables de entorno
+	Proxy string
+
+	// URL que recibe un POST al terminar la descarga. Vacío usa --webhook-url
+	Webhook string
+
+	// Checksum esperado del archivo final (hex) y su algoritmo. Si no
+	// coincide la descarga falla y el archivo se borra
+	ExpectedChecksum  string
+	ChecksumAlgorithm string
+
+	// Content-Type esperado ("application/zip", "video/*"). Si el servidor
+	// devuelve otro la descarga se rechaza
+	ExpectedContentType string
+
+	// Sobrescribir un archivo existente en lugar de numerar el nuevo
+	Overwrite bool
+
+	// Escribir los chunks directamente en el archivo final, sin merge
+	DirectWrite bool
+
+	// Omitir las pausas para la UI en esta descarga (como --no-ui-delays)
+	FastMode bool
+
+	// Tamaño máximo aceptado en bytes (0 = sin límite)
+	MaxFileSize int64
+
+	// Tamaño de chunk y chunks en paralelo (0 = valores por defecto)
+	ChunkSize           int64
+	MaxConcurrentChunks int
+}
+
+// httpProtocol devuelve el protocolo pedido, teniendo en cuenta ForceHTTP1
+func (o DownloadOptions) httpProtocol() string {
+	if o.ForceHTTP1 {
+		return HTTPProtocolHTTP1
+	}
+	return o.Protocol
+}
+
+// parseDownloadOptions extrae las opciones de un mensaje start_download
+func parseDownloadOptions(msg map[string]interface{}) (DownloadOptions, error) {
+	var opts DownloadOptions
+
+	if raw, ok := msg["ranges"]; ok && raw != nil {
+		ranges, err := parseByteRanges(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Ranges = ranges
+	}
+
+	opts.ForceHTTP1, _ = msg["force_http1"].(bool)
+	if raw, ok := msg["protocol"]; ok && raw != nil {
+		name, _ := raw.(string)
+		protocol, err := parseHTTPProtocol(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.Protocol = protocol
+	}
+	if opts.ForceHTTP1 && opts.Protocol == HTTPProtocolHTTP2 {
+		return opts, fmt.Errorf("force_http1 conflicts with protocol http2")
+	}
+	opts.DownloadDir, _ = msg["download_dir"].(string)
+	if name, _ := msg["filename"].(string); name != "" {
+		filename, err := sanitizeFilename(name)
+		if err != nil {
+			return opts, err
+		}
+		opts.Filename = filename
+	}
+	opts.TempDir, _ = msg["temp_dir"].(string)
+	opts.Overwrite, _ = msg["overwrite"].(bool)
+	opts.DirectWrite, _ = msg["direct_write"].(bool)
+	opts.FastMode, _ = msg["fast_mode"].(bool)
+	if expected, _ := msg["expected_content_type"].(string); expected != "" {
+		if _, _, err := mime.ParseMediaType(expected); err != nil || !strings.Contains(expected, "/") {
+			return opts, fmt.Errorf("expected_content_type must be a media type like application/zip or video/*")
+		}
+		opts.ExpectedContentType = expected
+	}
+	opts.Credentials.Username, _ = msg["username"].(string)
+	opts.Credentials.Password, _ = msg["password"].(string)
+	opts.Credentials.Token, _ = msg["auth_token"].(string)
+	if agent, _ := msg["user_agent"].(string); agent != "" {
+		if strings.ContainsAny(agent, "\r\n") {
+			return opts, fmt.Errorf("invalid user_agent")
+		}
+		opts.Credentials.UserAgent = agent
+	}
+	if raw, ok := msg["headers"]; ok && raw != nil {
+		headers, err := parseHeaders(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Credentials.Headers = headers
+	}
+	if raw, ok := msg["cookies"]; ok && raw != nil {
+		cookies, err := parseCookies(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Credentials.Cookies = cookies
+	}
+
+	if proxy, _ := msg["proxy"].(string); proxy != "" {
+		if _, err := parseProxyURL(proxy); err != nil {
+			return opts, err
+		}
+		opts.Proxy = proxy
+	}
+
+	if raw, ok := msg["mirrors"]; ok && raw != nil {
+		items, ok := raw.([]interface{})
+		if !ok {
+			return opts, fmt.Errorf("mirrors must be an array of URLs")
+		}
+		for _, item := range items {
+			mirror, _ := item.(string)
+			normalized, err := normalizeDownloadURL(mirror)
+			if err != nil {
+				return opts, fmt.Errorf("invalid mirror: %v", err)
+			}
+			opts.Mirrors = append(opts.Mirrors, normalized)
+		}
+	}
+
+	if webhook, _ := msg["webhook"].(string); webhook != "" {
+		if err := parseWebhookURL(webhook); err != nil {
+			return opts, err
+		}
+		opts.Webhook = webhook
+	}
+
+	if expected, _ := msg["expected_checksum"].(string); expected != "" {
+		algo, _ := msg["algorithm"].(string)
+		if algo == "" {
+			algo = DefaultChecksumAlgorithm
+		}
+		h, err := download.ChecksumHash(algo)
+		if err != nil {
+			return opts, err
+		}
+		expected = strings.ToLower(strings.TrimSpace(expected))
+		if _, err := hex.DecodeString(expected); err != nil || len(expected) != h.Size()*2 {
+			return opts, fmt.Errorf("expected_checksum must be a %d-character hex %s digest", h.Size()*2, h)
+		}
+		opts.ExpectedChecksum = expected
+		opts.ChecksumAlgorithm = strings.ToLower(algo)
+	}
+
+	// max_speed_bps es un alias de max_rate
+	for _, field := range []string{"max_rate", "max_speed_bps"} {
+		raw, ok := msg[field]
+		if !ok || raw == nil {
+			continue
+		}
+		rate, ok := raw.(float64)
+		if !ok || rate < 0 {
+			return opts, fmt.Errorf("%s must be a non-negative number of bytes per second", field)
+		}
+		if opts.MaxRate != 0 && opts.MaxRate != int64(rate) {
+			return opts, fmt.Errorf("max_rate and max_speed_bps disagree")
+		}
+		opts.MaxRate = int64(rate)
+	}
+
+	if raw, ok := msg["max_file_size"]; ok && raw != nil {
+		size, ok := raw.(float64)
+		if !ok || size < 0 {
+			return opts, fmt.Errorf("max_file_size must be a non-negative number of bytes")
+		}
+		opts.MaxFileSize = int64(size)
+	}
+
+	if raw, ok := msg["chunk_size"]; ok && raw != nil {
+		size, ok := raw.(float64)
+		if !ok || size != float64(int64(size)) || int64(size) < MinChunkSize || int64(size) > MaxChunkSize {
+			return opts, fmt.Errorf("chunk_size must be an integer between %d and %d bytes", MinChunkSize, MaxChunkSize)
+		}
+		opts.ChunkSize = int64(size)
+	}
+
+	if raw, ok := msg["max_concurrent_chunks"]; ok && raw != nil {
+		n, ok := raw.(float64)
+		if !ok || n != float64(int(n)) || n < 1 || n > MaxChunkWorkers {
+			return opts, fmt.Errorf("max_concurrent_chunks must be an integer between 1 and %d", MaxChunkWorkers)
+		}
+		opts.MaxConcurrentChunks = int(n)
+	}
+
+	return opts, nil
+}
+
+// parseByteRanges convierte el campo ranges ([{"start":0,"end":99}, ...])
+func parseByteRanges(raw interface{}) ([]ByteRange, error) {
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("ranges must be an array of {start, end} objects")
+	}
+
+	ranges := make([]ByteRange, 0, len(items))
+	for i, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("range %d must be an object with start and end", i)
+		}
+		start, okStart := obj["start"].(float64)
+		end, okEnd := obj["end"].(float64)
+		if !okStart || !okEnd {
+			return nil, fmt.Errorf("range %d is missing numeric start/end", i)
+		}
+		ranges = append(ranges, ByteRange{Start: int64(start), End: int64(end)})
+	}
+	return ranges, nil
+}
+
+// normalizeRanges ordena los rangos y comprueba que estén dentro del archivo y
+// no se solapen, para que cada byte se cuente una sola vez en el progreso
+func normalizeRanges(ranges []ByteRange, size int64) ([]ByteRange, error) {
+	sorted := append([]ByteRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	for i, r := range sorted {
+		if r.Start < 0 || r.End < r.Start {
+			return nil, fmt.Errorf("invalid range %d-%d", r.Start, r.End)
+		}
+		if r.End >= size {
+			return nil, fmt.Errorf("range %d-%d exceeds file size %d", r.Start, r.End, size)
+		}
+		if i > 0 && r.Start <= sorted[i-1].End {
+			return nil, fmt.Errorf("range %d-%d overlaps %d-%d",
+				r.Start, r.End, sorted[i-1].Start, sorted[i-1].End)
+		}
+	}
+	return sorted, nil
+}
+
+// Cabeceras que controla el propio servidor: cambiarlas rompería los rangos
+// de los chunks o la petición misma
+var reservedHeaders = map[string]bool{
+	"Range":             true,
+	"If-Range":          true,
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Transfer-Encoding": true,
+}
+
+// parseHeaders valida el campo headers de start_download: un objeto de
+// nombre a valor, sin cabeceras reservadas ni saltos de línea
+func parseHeaders(raw interface{}) (map[string]string, error) {
+	fields, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("headers must be an object of header names to values")
+	}
+	headers := make(map[string]string, len(fields))
+	for name, rawValue := range fields {
+		value, ok := rawValue.(string)
+		if !ok {
+			return nil, fmt.Errorf("header %q must have a string value", name)
+		}
+		if name == "" || strings.ContainsAny(name, " :\r\n\t") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if reservedHeaders[name] {
+			return nil, fmt.Errorf("header %s cannot be overridden", name)
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// parseCookies acepta el campo cookies como cadena ("a=1; b=2") o como
+// objeto de nombre a valor, y lo devuelve como valor de la cabecera Cookie
+func parseCookies(raw interface{}) (string, error) {
+	switch cookies := raw.(type) {
+	case string:
+		if strings.ContainsAny(cookies, "\r\n") {
+			return "", fmt.Errorf("invalid cookies")
+		}
+		return strings.TrimSpace(cookies), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(cookies))
+		for name := range cookies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			value, ok := cookies[name].(string)
+			if !ok || name == "" || strings.ContainsAny(name, "=; \r\n") || strings.ContainsAny(value, "; \r\n") {
+				return "", fmt.Errorf("invalid cookie %q", name)
+			}
+			pairs = append(pairs, name+"="+value)
+		}
+		return strings.Join(pairs, "; "), nil
+	default:
+		return "", fmt.Errorf("cookies must be a string or an object of cookie names to values")
+	}
+}
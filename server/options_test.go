@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDownloadOptions(t *testing.T) {
+	sha256Hex := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name    string
+		msg     map[string]interface{}
+		want    DownloadOptions
+		wantErr string
+	}{
+		{
+			name: "empty message",
+			msg:  map[string]interface{}{},
+			want: DownloadOptions{},
+		},
+		{
+			name: "ranges",
+			msg: map[string]interface{}{"ranges": []interface{}{
+				map[string]interface{}{"start": float64(0), "end": float64(99)},
+				map[string]interface{}{"start": float64(200), "end": float64(299)},
+			}},
+			want: DownloadOptions{Ranges: []ByteRange{{Start: 0, End: 99}, {Start: 200, End: 299}}},
+		},
+		{
+			name:    "range without end",
+			msg:     map[string]interface{}{"ranges": []interface{}{map[string]interface{}{"start": float64(0)}}},
+			wantErr: "missing numeric start/end",
+		},
+		{
+			name:    "ranges not an array",
+			msg:     map[string]interface{}{"ranges": "0-99"},
+			wantErr: "ranges must be an array",
+		},
+		{
+			name: "protocol and filename",
+			msg:  map[string]interface{}{"protocol": "HTTP1", "filename": " video.mp4 "},
+			want: DownloadOptions{Protocol: HTTPProtocolHTTP1, Filename: "video.mp4"},
+		},
+		{
+			name:    "unknown protocol",
+			msg:     map[string]interface{}{"protocol": "gopher"},
+			wantErr: "unknown protocol",
+		},
+		{
+			name:    "force_http1 conflicts with http2",
+			msg:     map[string]interface{}{"force_http1": true, "protocol": "http2"},
+			wantErr: "force_http1 conflicts",
+		},
+		{
+			name:    "filename with path",
+			msg:     map[string]interface{}{"filename": "../etc/passwd"},
+			wantErr: "without path separators",
+		},
+		{
+			name: "expected checksum is normalized",
+			msg:  map[string]interface{}{"expected_checksum": " " + strings.ToUpper(sha256Hex) + " "},
+			want: DownloadOptions{ExpectedChecksum: sha256Hex, ChecksumAlgorithm: "sha256"},
+		},
+		{
+			name:    "checksum with wrong length",
+			msg:     map[string]interface{}{"expected_checksum": "abcd"},
+			wantErr: "64-character hex",
+		},
+		{
+			name: "max_speed_bps alias",
+			msg:  map[string]interface{}{"max_speed_bps": float64(1024)},
+			want: DownloadOptions{MaxRate: 1024},
+		},
+		{
+			name:    "max_rate and alias disagree",
+			msg:     map[string]interface{}{"max_rate": float64(1024), "max_speed_bps": float64(2048)},
+			wantErr: "disagree",
+		},
+		{
+			name:    "negative max_file_size",
+			msg:     map[string]interface{}{"max_file_size": float64(-1)},
+			wantErr: "max_file_size must be",
+		},
+		{
+			name:    "chunk_size below minimum",
+			msg:     map[string]interface{}{"chunk_size": float64(MinChunkSize - 1)},
+			wantErr: "chunk_size must be",
+		},
+		{
+			name: "chunk size and concurrency",
+			msg:  map[string]interface{}{"chunk_size": float64(MinChunkSize), "max_concurrent_chunks": float64(2)},
+			want: DownloadOptions{ChunkSize: MinChunkSize, MaxConcurrentChunks: 2},
+		},
+		{
+			name:    "header injection in user_agent",
+			msg:     map[string]interface{}{"user_agent": "curl\r\nX-Evil: 1"},
+			wantErr: "invalid user_agent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDownloadOptions(tt.msg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseDownloadOptions() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDownloadOptions() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDownloadOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// allowedOrigin indica si una petición viene de un origen en el que se puede
+// confiar. Sin cabecera Origin no la envía un navegador (curl, scripts, la
+// app de escritorio) y se acepta; con ella solo se aceptan páginas servidas
+// por este mismo servidor o desde la máquina local. Así una web cualquiera no
+// puede abrir /ws ni iniciar descargas en el servidor del usuario
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return isLoopbackHost(u.Hostname())
+}
+
+// isLoopbackHost indica si host es localhost o una dirección de loopback
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isJSONRequest indica si el cuerpo se declara application/json. Los
+// navegadores no pueden enviar este tipo entre orígenes sin una petición
+// preflight, que el servidor no autoriza
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
@@ -0,0 +1,56 @@
+package main
+
+import "time"
+
+// Intervalo del progreso de latido de las descargas por chunks
+const progressHeartbeatInterval = 2 * time.Second
+
+// startProgressHeartbeat publica cada progressHeartbeatInterval el progreso
+// total de la descarga, aparte de las actualizaciones de cada lectura, que
+// dejan de llegar si todos los chunks se atascan. stalled es true si no llegó
+// ningún byte desde el latido anterior, para que el cliente distinga una
+// descarga atascada de una muerta. Devuelve la función que lo detiene
+func startProgressHeartbeat(safeConn *SafeConn, download *ChunkedDownload) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressHeartbeatInterval)
+		defer ticker.Stop()
+
+		last, _ := download.GetProgress()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			status := download.CurrentStatus()
+			if download.IsPaused() || status.IsTerminal() {
+				continue
+			}
+			downloaded, total := download.GetProgress()
+			stalled := downloaded == last
+			last = downloaded
+
+			speed := download.Speed()
+			if stalled {
+				speed = 0
+			}
+			event := map[string]interface{}{
+				"type":          "progress",
+				"download_id":   download.ID,
+				"bytesReceived": downloaded,
+				"totalBytes":    total,
+				"speed":         speed,
+				"avg_speed":     getPreviousSpeed(download.ID),
+				"status":        status,
+				"eta_seconds":   estimateETA(download.ID, downloaded, total, status),
+				"heartbeat":     true,
+				"stalled":       stalled,
+			}
+			addConcurrency(event, download)
+			publishEvent(safeConn, event)
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// ProtocolVersion es la versión del protocolo WebSocket. Se incrementa cuando
+// cambian mensajes existentes de forma incompatible; los mensajes nuevos que
+// un cliente antiguo puede ignorar no la cambian
+const ProtocolVersion = 1
+
+// handleHello atiende el mensaje hello con el que el cliente anuncia su
+// versión del protocolo. Si es más nueva que la del servidor se avisa con un
+// error, pero la conexión sigue funcionando con los mensajes de esta versión
+func handleHello(safeConn *SafeConn, msg map[string]interface{}) {
+	version := ProtocolVersion
+	if raw, exists := msg["protocol_version"]; exists {
+		v, ok := raw.(float64)
+		if !ok || v != float64(int(v)) || v < 1 {
+			sendError(safeConn, "", ErrorCodeVersionMismatch, fmt.Sprintf("Invalid protocol_version %v, expected a positive integer", raw))
+			return
+		}
+		version = int(v)
+	}
+
+	if version > ProtocolVersion {
+		log.Printf("Client speaks protocol %d, server supports up to %d", version, ProtocolVersion)
+		sendError(safeConn, "", ErrorCodeVersionMismatch, fmt.Sprintf(
+			"Client protocol version %d is newer than the server's (%d); only version %d messages will be understood",
+			version, ProtocolVersion, ProtocolVersion))
+	}
+	safeConn.SendJSON(serverInfo(false))
+}
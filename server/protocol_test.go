@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair abre una conexión WebSocket contra un servidor de prueba y devuelve
+// el SafeConn del lado del servidor y la conexión del cliente
+func wsPair(t *testing.T) (*SafeConn, *websocket.Conn) {
+	t.Helper()
+	serverConn := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConn <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := <-serverConn
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return &SafeConn{conn: conn}, client
+}
+
+// readMessages lee mensajes hasta que pasa wait sin recibir ninguno
+func readMessages(t *testing.T, conn *websocket.Conn, wait time.Duration) []map[string]interface{} {
+	t.Helper()
+	var messages []map[string]interface{}
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return messages
+		}
+		messages = append(messages, msg)
+	}
+}
+
+func TestHandleHelloVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    interface{} // nil = sin protocol_version
+		wantError  bool
+		wantServer bool // server_info tras el hello
+	}{
+		{"no version", nil, false, true},
+		{"same version", float64(ProtocolVersion), false, true},
+		{"zero version", float64(0), true, false},
+		{"newer version", float64(ProtocolVersion + 1), true, true},
+		{"fractional version", 1.5, true, false},
+		{"string version", "2", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			safeConn, client := wsPair(t)
+
+			msg := map[string]interface{}{"type": "hello"}
+			if tt.version != nil {
+				msg["protocol_version"] = tt.version
+			}
+			handleHello(safeConn, msg)
+
+			var gotError, gotServer bool
+			for _, m := range readMessages(t, client, 200*time.Millisecond) {
+				switch m["type"] {
+				case "error":
+					gotError = true
+					if m["error_code"] != ErrorCodeVersionMismatch {
+						t.Errorf("error_code = %v, want %s", m["error_code"], ErrorCodeVersionMismatch)
+					}
+				case "server_info":
+					gotServer = true
+					if m["protocol_version"] != float64(ProtocolVersion) {
+						t.Errorf("server_info protocol_version = %v, want %d", m["protocol_version"], ProtocolVersion)
+					}
+				}
+			}
+			if gotError != tt.wantError {
+				t.Errorf("version_mismatch error sent = %v, want %v", gotError, tt.wantError)
+			}
+			if gotServer != tt.wantServer {
+				t.Errorf("server_info sent = %v, want %v", gotServer, tt.wantServer)
+			}
+		})
+	}
+}
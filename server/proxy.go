@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Proxy de todas las descargas (--proxy). Vacío usa las variables de entorno
+// HTTP_PROXY, HTTPS_PROXY y NO_PROXY
+var defaultProxy = ""
+
+// parseProxyURL valida una URL de proxy. Se admiten http, https y socks5
+// (socks5h resuelve los nombres en el proxy); net/http los soporta todos
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", raw)
+	}
+	return u, nil
+}
+
+// proxyFunc devuelve la función Proxy del transport de una descarga: el proxy
+// propio de la descarga, si no el de --proxy, y si no el del entorno
+func proxyFunc(override string) func(*http.Request) (*url.URL, error) {
+	raw := override
+	if raw == "" {
+		raw = defaultProxy
+	}
+	if raw == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	proxyURL, err := parseProxyURL(raw)
+	if err != nil {
+		// No conectar directamente a espaldas del usuario
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(proxyURL)
+}
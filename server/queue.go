@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Número máximo de descargas simultáneas (--max-downloads). Con 0 no hay
+// límite. Las que superan el límite esperan en una cola FIFO
+var maxConcurrentDownloads = 0
+
+// queuedDownload es una descarga esperando un hueco
+type queuedDownload struct {
+	id       string
+	safeConn *SafeConn
+	start    func()
+}
+
+// downloadQueue limita las descargas en curso. Cada descarga en marcha ocupa
+// un hueco hasta que sale del registro o se pausa. Se indexa por id
+type downloadQueue struct {
+	mu      sync.Mutex
+	running map[string]bool
+	waiting []*queuedDownload
+	closed  bool // Apagando: no arrancar más descargas de la cola
+	held    bool // pause_all: no arrancar más descargas de la cola
+}
+
+var downloadSlots = &downloadQueue{running: make(map[string]bool)}
+
+// Submit arranca la descarga si hay hueco o la pone a la cola. Devuelve
+// error si la descarga ya está en marcha o esperando
+func (q *downloadQueue) Submit(id string, safeConn *SafeConn, start func()) error {
+	q.mu.Lock()
+	if q.running[id] {
+		q.mu.Unlock()
+		return fmt.Errorf("this download is already running")
+	}
+	for _, item := range q.waiting {
+		if item.id == id {
+			q.mu.Unlock()
+			return fmt.Errorf("this download is already queued")
+		}
+	}
+
+	if maxConcurrentDownloads <= 0 || len(q.running) < maxConcurrentDownloads {
+		q.running[id] = true
+		q.mu.Unlock()
+		go start()
+		return nil
+	}
+
+	q.waiting = append(q.waiting, &queuedDownload{id: id, safeConn: safeConn, start: start})
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	log.Printf("Download queued at position %d: %s", position, downloadIDs.URL(id))
+	sendMessage(safeConn, "queued", id,
+		fmt.Sprintf("Waiting for a free download slot (position %d)", position))
+	sendQueuePosition(safeConn, id, position)
+	return nil
+}
+
+// Release libera el hueco de la descarga (o la saca de la cola) y arranca la
+// siguiente en espera
+func (q *downloadQueue) Release(id string) {
+	q.mu.Lock()
+	if !q.running[id] {
+		// Una descarga cancelada mientras esperaba sale de la cola
+		for i, item := range q.waiting {
+			if item.id == id {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				remaining := append([]*queuedDownload(nil), q.waiting[i:]...)
+				q.mu.Unlock()
+				notifyQueuePositions(remaining, i+1)
+				return
+			}
+		}
+		q.mu.Unlock()
+		return
+	}
+	delete(q.running, id)
+
+	var next *queuedDownload
+	if !q.closed && !q.held && len(q.waiting) > 0 && (maxConcurrentDownloads <= 0 || len(q.running) < maxConcurrentDownloads) {
+		next = q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running[next.id] = true
+	}
+	remaining := append([]*queuedDownload(nil), q.waiting...)
+	q.mu.Unlock()
+
+	if next != nil {
+		log.Printf("Starting queued download: %s", downloadIDs.URL(next.id))
+		go next.start()
+		notifyQueuePositions(remaining, 1)
+	}
+}
+
+// IsRunning indica si la descarga ocupa un hueco
+func (q *downloadQueue) IsRunning(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running[id]
+}
+
+// Close impide que arranquen más descargas de la cola (apagado)
+func (q *downloadQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+}
+
+// SetHeld detiene o vuelve a permitir el arranque de descargas de la cola al
+// liberarse huecos. Al soltarla arrancan todas las que quepan
+func (q *downloadQueue) SetHeld(held bool) {
+	q.mu.Lock()
+	q.held = held
+	var started []*queuedDownload
+	for !held && !q.closed && len(q.waiting) > 0 && (maxConcurrentDownloads <= 0 || len(q.running) < maxConcurrentDownloads) {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running[next.id] = true
+		started = append(started, next)
+	}
+	remaining := append([]*queuedDownload(nil), q.waiting...)
+	q.mu.Unlock()
+
+	for _, next := range started {
+		log.Printf("Starting queued download: %s", downloadIDs.URL(next.id))
+		go next.start()
+	}
+	if len(started) > 0 {
+		notifyQueuePositions(remaining, 1)
+	}
+}
+
+// Waiting devuelve los ids de las descargas que esperan un hueco, en orden
+func (q *downloadQueue) Waiting() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make([]string, 0, len(q.waiting))
+	for _, item := range q.waiting {
+		ids = append(ids, item.id)
+	}
+	return ids
+}
+
+// IsQueued indica si la descarga espera un hueco
+func (q *downloadQueue) IsQueued(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, item := range q.waiting {
+		if item.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyQueuePositions informa a las descargas en espera de su nueva
+// posición; items empieza en la posición first
+func notifyQueuePositions(items []*queuedDownload, first int) {
+	for i, item := range items {
+		sendQueuePosition(item.safeConn, item.id, first+i)
+	}
+}
+
+// sendQueuePosition envía un progreso con estado queued y la posición en la
+// cola (1 = la siguiente en arrancar)
+func sendQueuePosition(safeConn *SafeConn, id string, position int) {
+	data := map[string]interface{}{
+		"type":           "progress",
+		"download_id":    id,
+		"bytesReceived":  0,
+		"totalBytes":     0,
+		"speed":          0,
+		"status":         StatusQueued,
+		"eta_seconds":    -1,
+		"queue_position": position,
+	}
+
+	if err := publishEvent(safeConn, data); err != nil {
+		log.Printf("Error sending queue position to client: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import "catchme/server/download"
+
+// Límite global de ancho de banda para todas las descargas (--max-rate). Las
+// descargas por chunks lo reciben como SharedLimiter
+var globalRateLimiter = download.NewRateLimiter(0)
+
+// waitForBandwidth aplica el límite global y el de la descarga a una descarga
+// de una sola conexión. Esperar en ambos hace que la tasa efectiva sea el
+// mínimo de los dos
+func waitForBandwidth(limiter *download.RateLimiter, n int, cancel <-chan struct{}) bool {
+	if !globalRateLimiter.Wait(n, cancel) {
+		return false
+	}
+	return limiter.Wait(n, cancel)
+}
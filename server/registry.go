@@ -0,0 +1,325 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"catchme/server/download"
+)
+
+// downloadEntry agrupa los flags de seguimiento de una descarga y, si es por
+// chunks, el ChunkedDownload asociado
+type downloadEntry struct {
+	url       string
+	active    bool
+	paused    bool
+	preparing bool // Descarga por chunks que aún no ha lanzado sus workers
+	download  *ChunkedDownload
+	limiter   *RateLimiter // Límite de ancho de banda propio de la descarga
+	// Secuencia de finalización de download (ver BeginFinish): empezó y no
+	// se puede volver a lanzar, y si falló de forma recuperable
+	finishing    bool
+	finishFailed bool
+}
+
+// newDownloadEntry crea la entrada de una descarga activa, sin límite de
+// ancho de banda propio
+func newDownloadEntry(url string) *downloadEntry {
+	return &downloadEntry{url: url, active: true, limiter: download.NewRateLimiter(0)}
+}
+
+// DownloadRegistry es la única fuente de verdad sobre las descargas en curso.
+// Estado y objeto de descarga viven bajo el mismo mutex, de modo que ninguna
+// consulta puede observarlos en desacuerdo. Las entradas se indexan por el id
+// de la descarga (ver downloadid.go)
+type DownloadRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]*downloadEntry
+}
+
+// NewDownloadRegistry crea un registro vacío
+func NewDownloadRegistry() *DownloadRegistry {
+	return &DownloadRegistry{
+		entries: make(map[string]*downloadEntry),
+	}
+}
+
+// Registro global de descargas activas
+var registry = NewDownloadRegistry()
+
+// Track marca una descarga como activa aunque todavía no tenga descarga por
+// chunks asociada (descargas de una sola conexión). Una pausa pedida durante
+// la preparación se conserva
+func (r *DownloadRegistry) Track(id, url string) {
+	r.track(id, url, false)
+}
+
+// Prepare marca como activa una descarga por chunks que se está preparando.
+// Hasta EndPreparing una pausa solo se anota (ver PauseIfPreparing)
+func (r *DownloadRegistry) Prepare(id, url string) {
+	r.track(id, url, true)
+}
+
+func (r *DownloadRegistry) track(id, url string, preparing bool) {
+	r.mu.Lock()
+	entry, exists := r.entries[id]
+	if !exists {
+		entry = newDownloadEntry(url)
+		r.entries[id] = entry
+	}
+	entry.active = true
+	entry.preparing = preparing
+	paused := entry.paused
+	r.mu.Unlock()
+
+	log.Printf("Download tracked: %s [%s] (active=%t, paused=%t)", url, id, true, paused)
+}
+
+// PauseIfPreparing anota una pausa si la descarga aún se está preparando.
+// Devuelve false si no lo está, y entonces no cambia nada
+func (r *DownloadRegistry) PauseIfPreparing(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.entries[id]
+	if !exists || !entry.preparing {
+		return false
+	}
+	entry.paused = true
+	if entry.download != nil {
+		entry.download.SetPaused(true)
+	}
+	return true
+}
+
+// EndPreparing marca el final de la preparación y devuelve, en el mismo paso,
+// el estado con el que termina: una pausa anotada hasta aquí la tiene que
+// atender quien llama y las siguientes siguen el camino normal
+func (r *DownloadRegistry) EndPreparing(id string) (paused bool, tracked bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.entries[id]
+	if !exists {
+		return false, false
+	}
+	entry.preparing = false
+	return entry.paused, true
+}
+
+// Register asocia una descarga por chunks al id. Devuelve false si ya hay
+// otra descarga por chunks registrada con el mismo id
+func (r *DownloadRegistry) Register(id string, download *ChunkedDownload) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.entries[id]
+	if !exists {
+		entry = newDownloadEntry(download.URL)
+		r.entries[id] = entry
+	}
+	if entry.download != nil && entry.download != download {
+		return false
+	}
+
+	// La descarga comparte el limitador de la entrada para que set_rate la
+	// afecte aunque se haya enviado durante la preparación
+	download.Lock()
+	download.Limiter = entry.limiter
+	download.Unlock()
+	// Pausa pedida durante la preparación (ver holdPreparedDownload)
+	if entry.paused {
+		download.SetPaused(true)
+	}
+
+	if entry.download != download {
+		entry.finishing, entry.finishFailed = false, false
+	}
+	entry.download = download
+	entry.active = true
+	return true
+}
+
+// Limiter devuelve el limitador de ancho de banda propio de la descarga
+func (r *DownloadRegistry) Limiter(id string) (*RateLimiter, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, exists := r.entries[id]
+	if !exists {
+		return nil, false
+	}
+	return entry.limiter, true
+}
+
+// Get devuelve la descarga por chunks registrada con el id
+func (r *DownloadRegistry) Get(id string) (*ChunkedDownload, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, exists := r.entries[id]
+	if !exists || entry.download == nil {
+		return nil, false
+	}
+	return entry.download, true
+}
+
+// SetPaused actualiza el flag de pausa del registro y de la descarga en un
+// solo paso. Devuelve false si la descarga no está registrada
+func (r *DownloadRegistry) SetPaused(id string, paused bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.entries[id]
+	if !exists {
+		return false
+	}
+
+	entry.active = true
+	entry.paused = paused
+	if entry.download != nil {
+		entry.download.SetPaused(paused)
+	}
+	return true
+}
+
+// IsActive indica si la descarga está en curso (registrada y no pausada)
+func (r *DownloadRegistry) IsActive(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, exists := r.entries[id]
+	return exists && entry.active && !entry.paused
+}
+
+// RunIfActive ejecuta fn si la descarga está en curso, sin que SetPaused pueda
+// pausarla mientras tanto: cuando SetPaused vuelve, ninguna escritura de una
+// descarga de una sola conexión sigue en marcha. fn no puede usar el registro.
+// Devuelve false si no se ejecutó
+func (r *DownloadRegistry) RunIfActive(id string, fn func()) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, exists := r.entries[id]
+	if !exists || !entry.active || entry.paused {
+		return false
+	}
+	fn()
+	return true
+}
+
+// IsPaused devuelve el estado de pausa de la descarga y si está registrada
+func (r *DownloadRegistry) IsPaused(id string) (paused bool, tracked bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, exists := r.entries[id]
+	if !exists {
+		return false, false
+	}
+	return entry.paused, true
+}
+
+// RegistryEntry es una copia del estado de una descarga registrada
+type RegistryEntry struct {
+	ID       string
+	URL      string
+	Paused   bool
+	Download *ChunkedDownload // nil para descargas de una sola conexión
+}
+
+// Entries devuelve una copia de todas las entradas, ordenadas por URL
+func (r *DownloadRegistry) Entries() []RegistryEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entries := make([]RegistryEntry, 0, len(r.entries))
+	for id, entry := range r.entries {
+		entries = append(entries, RegistryEntry{ID: id, URL: entry.url, Paused: entry.paused, Download: entry.download})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].URL != entries[j].URL {
+			return entries[i].URL < entries[j].URL
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries
+}
+
+// ChunkedDownloads devuelve las descargas por chunks registradas
+func (r *DownloadRegistry) ChunkedDownloads() []*ChunkedDownload {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	downloads := make([]*ChunkedDownload, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if entry.download != nil {
+			downloads = append(downloads, entry.download)
+		}
+	}
+	return downloads
+}
+
+// BeginFinish reserva la secuencia de finalización de la descarga por chunks.
+// Devuelve false si no está registrada o si ya empezó y no ha fallado de
+// forma recuperable desde el último RearmFinish
+func (r *DownloadRegistry) BeginFinish(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, exists := r.entries[id]
+	if !exists || entry.finishing {
+		return false
+	}
+	entry.finishing = true
+	return true
+}
+
+// FailFinish marca que la finalización en curso falló de forma recuperable.
+// Se llama antes de dejar la descarga en pausa, así que una reanudación
+// siempre la ve
+func (r *DownloadRegistry) FailFinish(id string) {
+	r.mu.Lock()
+	if entry, exists := r.entries[id]; exists {
+		entry.finishFailed = true
+	}
+	r.mu.Unlock()
+}
+
+// RearmFinish permite que una reanudación repita la finalización si la
+// anterior terminó con un fallo recuperable
+func (r *DownloadRegistry) RearmFinish(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, exists := r.entries[id]; exists && entry.finishFailed {
+		entry.finishFailed = false
+		entry.finishing = false
+	}
+}
+
+// Detach desasocia la descarga por chunks del id pero la sigue rastreando
+// (cambio a descarga de una sola conexión)
+func (r *DownloadRegistry) Detach(id string) {
+	r.mu.Lock()
+	if entry, exists := r.entries[id]; exists {
+		entry.download = nil
+	}
+	r.mu.Unlock()
+}
+
+// Remove deja de rastrear la descarga y libera su hueco en la cola
+func (r *DownloadRegistry) Remove(id string) {
+	r.mu.Lock()
+	entry, exists := r.entries[id]
+	delete(r.entries, id)
+	r.mu.Unlock()
+
+	downloadSlots.Release(id)
+	if exists {
+		log.Printf("Download untracked: %s [%s]", entry.url, id)
+		rememberSpeedHint(entry.url, getPreviousSpeed(id))
+	}
+	downloadIDs.Expire(id)
+}
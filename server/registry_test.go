@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRegistryFinishRearm(t *testing.T) {
+	r := NewDownloadRegistry()
+	r.Register("d1", newChunkedDownload("http://example.com/file", "file", 1024, 256))
+
+	if !r.BeginFinish("d1") {
+		t.Fatal("first BeginFinish = false, want true")
+	}
+	if r.BeginFinish("d1") {
+		t.Fatal("BeginFinish while finishing = true, want false")
+	}
+
+	// Sin fallo recuperable RearmFinish no reabre la finalización
+	r.RearmFinish("d1")
+	if r.BeginFinish("d1") {
+		t.Fatal("BeginFinish after rearm without failure = true, want false")
+	}
+
+	r.FailFinish("d1")
+	r.RearmFinish("d1")
+	if !r.BeginFinish("d1") {
+		t.Fatal("BeginFinish after failure and rearm = false, want true")
+	}
+
+	if r.BeginFinish("unknown") {
+		t.Error("BeginFinish of an unregistered download = true, want false")
+	}
+}
+
+// Con go test -race detecta una reanudación que rearma la finalización
+// mientras otra la intenta lanzar
+func TestRegistryFinishConcurrentRearm(t *testing.T) {
+	r := NewDownloadRegistry()
+	r.Register("d1", newChunkedDownload("http://example.com/file", "file", 1024, 256))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if r.BeginFinish("d1") {
+					r.FailFinish("d1")
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				r.RearmFinish("d1")
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// handleRemoteChanged descarta los chunks de una descarga cuyo archivo
+// remoto cambió y pide al cliente que la vuelva a empezar
+func handleRemoteChanged(safeConn *SafeConn, download *ChunkedDownload) {
+	url := download.URL
+	log.Printf("Remote file changed for %s, discarding %d chunks", url, len(download.Chunks))
+
+	reportFinalStatus(safeConn, download, StatusFailed)
+	if err := download.Cleanup(); err != nil {
+		log.Printf("Warning: Failed to clean temporary files: %v", err)
+	}
+
+	msg := fmt.Sprintf("%v: the downloaded data was discarded, restart the download", errRemoteChanged)
+	sendError(safeConn, download.ID, ErrorCodeRemoteChanged, msg)
+	notifyDownloadFailed(download, msg)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"time"
+)
+
+// SafeConn es el ProgressReporter del motor de descarga en el servidor:
+// publica sus eventos por WebSocket, SSE y suscriptores
+var _ ProgressReporter = (*SafeConn)(nil)
+
+// ChunkProgress publica el evento chunk_progress
+func (sc *SafeConn) ChunkProgress(id string, chunk ChunkProgress) {
+	if err := publishEvent(sc, map[string]interface{}{
+		"type":        "chunk_progress",
+		"download_id": id,
+		"chunk":       chunk,
+	}); err != nil {
+		log.Printf("Error sending chunk progress to client: %v", err)
+	}
+}
+
+// ChunkRetry publica el evento chunk_retry
+func (sc *SafeConn) ChunkRetry(id string, chunk ChunkProgress, retry, maxRetries int, delay time.Duration) {
+	if err := publishEvent(sc, map[string]interface{}{
+		"type":        "chunk_retry",
+		"download_id": id,
+		"chunk":       chunk,
+		"retry":       retry,
+		"max_retries": maxRetries,
+		"delay":       delay.Seconds(),
+	}); err != nil {
+		log.Printf("Error sending chunk retry to client: %v", err)
+	}
+}
+
+// OverallProgress registra la muestra de velocidad (ver recordSpeedSample) y
+// publica el evento progress con la velocidad media, el ETA y, si es una
+// descarga por chunks, su concurrencia
+func (sc *SafeConn) OverallProgress(id string, downloaded, total int64, speed float64, status DownloadStatus) {
+	recordSpeedSample(id, downloaded)
+	event := map[string]interface{}{
+		"type":          "progress",
+		"download_id":   id,
+		"bytesReceived": downloaded,
+		"totalBytes":    total,
+		"speed":         speed,
+		"avg_speed":     getPreviousSpeed(id),
+		"status":        status,
+		"eta_seconds":   estimateETA(id, downloaded, total, status),
+	}
+	if download, ok := registry.Get(id); ok {
+		addConcurrency(event, download)
+	}
+	if err := publishEvent(sc, event); err != nil {
+		log.Printf("Error sending progress to client: %v", err)
+	}
+}
+
+// Log publica un mensaje de tipo log
+func (sc *SafeConn) Log(id, message string) {
+	sendMessage(sc, "log", id, message)
+}
+
+// Error publica un mensaje de tipo error de la transferencia
+func (sc *SafeConn) Error(id, message string) {
+	sendError(sc, id, ErrorCodeDownloadFailed, message)
+}
+
+// LogEvent registra los eventos estructurados del motor (ver logEvent)
+func (sc *SafeConn) LogEvent(level slog.Level, event string, attrs ...any) {
+	logEvent(sc, level, event, attrs...)
+}
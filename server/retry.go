@@ -0,0 +1,7 @@
+package main
+
+import "catchme/server/download"
+
+// Configuración de reintentos leída de la línea de comandos (ver
+// download.RetryConfig); las descargas nuevas parten de ella
+var retryConfig = download.DefaultRetryConfig()
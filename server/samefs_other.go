@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+// sameFilesystem no está soportado en esta plataforma
+func sameFilesystem(a, b string) (bool, error) {
+	return false, errors.New("filesystem comparison is not supported on this platform")
+}
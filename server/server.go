@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tiempo máximo para drenar las peticiones HTTP al apagar
+const ShutdownTimeout = 10 * time.Second
+
+var (
+	// Servidor HTTP activo (nil hasta startHTTPServer)
+	httpServer   *http.Server
+	httpServerMu sync.Mutex
+
+	// Contexto base de todas las peticiones; se cancela al apagar para que
+	// terminen los streams largos como /events
+	serverCtx, cancelServerCtx = context.WithCancel(context.Background())
+
+	// Conexiones WebSocket abiertas, para cerrarlas con un close frame
+	wsConnections = &connSet{conns: make(map[*SafeConn]struct{})}
+
+	shutdownOnce sync.Once
+)
+
+// connSet es el conjunto de conexiones WebSocket abiertas
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*SafeConn]struct{}
+}
+
+// Add registra una conexión
+func (s *connSet) Add(conn *SafeConn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+// Remove olvida una conexión
+func (s *connSet) Remove(conn *SafeConn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// CloseAll envía un close frame a todas las conexiones y las cierra
+func (s *connSet) CloseAll(code int, reason string) {
+	s.mu.Lock()
+	conns := make([]*SafeConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.Close(code, reason); err != nil {
+			log.Printf("Error closing WebSocket connection: %v", err)
+		}
+	}
+}
+
+// newHTTPServer crea el servidor HTTP con todas las rutas de CatchMe
+func newHTTPServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleWS)
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/downloads", handleDownloads)
+	mux.HandleFunc("/downloads/", handleDownloadStatus)
+	mux.HandleFunc("/start", handleStart)
+	mux.HandleFunc("/status", handleStatus)
+
+	return &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return serverCtx },
+	}
+}
+
+// startHTTPServer sirve HTTP y WebSocket en addr hasta que se llame a
+// stopHTTPServer. Devuelve nil tras un apagado ordenado
+func startHTTPServer(addr string) error {
+	server := newHTTPServer(addr)
+	httpServerMu.Lock()
+	httpServer = server
+	httpServerMu.Unlock()
+
+	log.Printf("Starting server on %s", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// stopHTTPServer deja de aceptar conexiones y espera a que terminen las
+// peticiones en curso
+func stopHTTPServer() {
+	httpServerMu.Lock()
+	server := httpServer
+	httpServerMu.Unlock()
+	if server == nil {
+		return
+	}
+
+	// Cancelar el contexto base para que los streams SSE terminen
+	cancelServerCtx()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+}
+
+// stopWebSocketServer cierra las conexiones WebSocket con un close frame.
+// http.Server.Shutdown no las cierra porque están secuestradas (hijacked)
+func stopWebSocketServer() {
+	wsConnections.CloseAll(websocket.CloseGoingAway, "server shutting down")
+}
+
+// pauseAllDownloads pausa las descargas por chunks en curso y guarda su
+// manifiesto. Los archivos temporales se conservan para reanudar después
+func pauseAllDownloads() {
+	for _, download := range registry.ChunkedDownloads() {
+		if paused, _ := registry.IsPaused(download.ID); paused || download.CurrentStatus().IsTerminal() {
+			if err := download.SaveManifest(); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			continue
+		}
+		pauseChunkedDownload(nil, download.ID)
+	}
+}
+
+// shutdownServer apaga el servidor de forma ordenada: pausa las descargas,
+// cierra los WebSocket y drena el servidor HTTP. Es seguro llamarla varias veces
+func shutdownServer() {
+	shutdownOnce.Do(func() {
+		log.Println("Shutting down: pausing downloads and closing connections...")
+		downloadSlots.Close()
+		pauseAllDownloads()
+		stopWebSocketServer()
+		stopHTTPServer()
+		log.Println("Shutdown complete")
+	})
+}
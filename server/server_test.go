@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"catchme/server/download"
+	"github.com/gorilla/websocket"
+)
+
+func TestParseCommandLineArgsPort(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		port int
+	}{
+		{"default", nil, 8080},
+		{"long flag", []string{"--port", "9191"}, 9191},
+		{"short flag", []string{"-p", "9292"}, 9292},
+		{"invalid value keeps default", []string{"--port", "abc"}, 8080},
+		{"missing value keeps default", []string{"--port"}, 8080},
+	}
+
+	saved := os.Args
+	defer func() { os.Args = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Args = append([]string{"catchme"}, tt.args...)
+			service, port := parseCommandLineArgs()
+			if service {
+				t.Errorf("runAsService = true, want false")
+			}
+			if port != tt.port {
+				t.Errorf("port = %d, want %d", port, tt.port)
+			}
+		})
+	}
+}
+
+// freePort devuelve un puerto TCP libre en loopback
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestServerUpgradesWebSocketOnPort(t *testing.T) {
+	port := freePort(t)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- startHTTPServer(addr) }()
+	defer stopHTTPServer()
+
+	// El servidor arranca en segundo plano: reintentar hasta que escuche
+	var conn *websocket.Conn
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, _, err = websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", addr), nil)
+		if err == nil {
+			break
+		}
+		select {
+		case serveErr := <-serveErr:
+			t.Fatalf("server stopped: %v", serveErr)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		t.Fatalf("dial /ws on port %d: %v", port, err)
+	}
+	defer conn.Close()
+
+	var info map[string]interface{}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&info); err != nil {
+		t.Fatalf("read server_info: %v", err)
+	}
+	if info["type"] != "server_info" {
+		t.Errorf("first message type = %v, want server_info", info["type"])
+	}
+}
+
+func TestParseCommandLineArgsRetryConfig(t *testing.T) {
+	savedArgs, savedRetry := os.Args, retryConfig
+	defer func() { os.Args, retryConfig = savedArgs, savedRetry }()
+
+	os.Args = []string{"catchme", "--max-retries", "9", "--chunk-timeout", "90s", "--stuck-timeout", "2m", "--retry-strategy", "linear"}
+	parseCommandLineArgs()
+
+	want := download.DefaultRetryConfig()
+	want.MaxRetries = 9
+	want.ChunkTimeout = 90 * time.Second
+	want.StuckTimeout = 2 * time.Minute
+	want.Strategy = RetryLinear
+
+	// Las descargas nuevas toman la configuración al crearse
+	download := newChunkedDownload("http://example.com/file", "file", 1024, 256)
+	if download.Retry != want {
+		t.Errorf("download.Retry = %+v, want %+v", download.Retry, want)
+	}
+}
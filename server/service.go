@@ -14,7 +14,8 @@ type ServiceManager struct {
 	isRunning      bool
 	shutdownSignal chan os.Signal
 	httpPort       int
-	logFile        *os.File
+	logFile        *rotatingFile
+	done           chan struct{} // Se cierra cuando Stop termina
 }
 
 // NewServiceManager crea un nuevo gestor de servicios
@@ -22,6 +23,7 @@ func NewServiceManager(httpPort int) *ServiceManager {
 	return &ServiceManager{
 		shutdownSignal: make(chan os.Signal, 1),
 		httpPort:       httpPort,
+		done:           make(chan struct{}),
 	}
 }
 
@@ -52,12 +54,12 @@ func (sm *ServiceManager) Setup() error {
 
 	// Configurar logging
 	logPath := filepath.Join(homeDir, ".catchme", "logs", "service.log")
-	sm.logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	sm.logFile, err = openRotatingFile(logPath)
 	if err != nil {
 		return fmt.Errorf("error opening log file: %v", err)
 	}
 
-	log.SetOutput(sm.logFile)
+	setupLogging(sm.logFile)
 	log.Println("CatchMe service initialized")
 
 	return nil
@@ -69,17 +71,16 @@ func (sm *ServiceManager) Start() error {
 		return fmt.Errorf("service already running")
 	}
 
-	// Iniciar el servidor HTTP en segundo plano
-	go func() {
-		if err := startHTTPServer(); err != nil {
-			log.Printf("HTTP server error: %v", err)
-		}
-	}()
+	// Medias de velocidad por servidor de ejecuciones anteriores
+	loadSpeedHints()
+
+	// Recuperar descargas interrumpidas por un reinicio anterior
+	restorePersistedDownloads()
 
-	// Iniciar WebSocket en segundo plano
+	// Iniciar el servidor HTTP (incluye el endpoint WebSocket /ws) en segundo plano
 	go func() {
-		if err := startWebSocketServer(); err != nil {
-			log.Printf("WebSocket server error: %v", err)
+		if err := startHTTPServer(fmt.Sprintf(":%d", sm.httpPort)); err != nil {
+			log.Printf("HTTP server error: %v", err)
 		}
 	}()
 
@@ -104,19 +105,16 @@ func (sm *ServiceManager) Stop() {
 
 	log.Println("Stopping CatchMe service...")
 
-	// Cerrar conexiones activas y detener servidores
-	stopHTTPServer()
-	stopWebSocketServer()
-
-	// Limpiar recursos temporales
-	cleanupTemporaryFiles()
+	// Pausar descargas, cerrar conexiones y detener el servidor. Los archivos
+	// temporales de los chunks se conservan para reanudar tras el reinicio
+	shutdownServer()
 
 	sm.isRunning = false
+	log.Println("CatchMe service stopped")
 	if sm.logFile != nil {
 		sm.logFile.Close()
 	}
-
-	log.Println("CatchMe service stopped")
+	close(sm.done)
 }
 
 // IsRunning devuelve si el servicio está en ejecución
@@ -124,30 +122,6 @@ func (sm *ServiceManager) IsRunning() bool {
 	return sm.isRunning
 }
 
-// Funciones auxiliares para el servidor
-// Remover el parámetro port no utilizado
-func startHTTPServer() error {
-	// Implementación del servidor HTTP
-	return nil
-}
-
-func stopHTTPServer() {
-	// Detener servidor HTTP
-}
-
-func startWebSocketServer() error {
-	// Implementación del servidor WebSocket
-	return nil
-}
-
-func stopWebSocketServer() {
-	// Detener servidor WebSocket
-}
-
-func cleanupTemporaryFiles() {
-	// Limpiar archivos temporales que ya no son necesarios
-}
-
 // RunAsService ejecuta la aplicación como un servicio
 func RunAsService(httpPort int) error {
 	service := NewServiceManager(httpPort)
@@ -160,6 +134,7 @@ func RunAsService(httpPort int) error {
 		return fmt.Errorf("service start failed: %v", err)
 	}
 
-	// Mantenerse en ejecución hasta recibir señal
-	select {}
+	// Mantenerse en ejecución hasta que termine el apagado
+	<-service.done
+	return nil
 }
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+// setReceiveBuffer no está soportado en esta plataforma
+func setReceiveBuffer(fd uintptr, size int) error {
+	return errors.New("SO_RCVBUF is not supported on this platform")
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// setReceiveBuffer ajusta SO_RCVBUF en un socket de Windows
+func setReceiveBuffer(fd uintptr, size int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Archivo de ~/.catchme con la velocidad media de cada servidor
+	speedHintsFile = "speed_history.json"
+	// Peso de la última descarga en la media de su servidor
+	speedHintAlpha = 0.5
+	// Servidores recordados como máximo; se olvidan primero los que llevan más
+	// tiempo sin descargas
+	maxSpeedHintHosts = 256
+)
+
+// speedHintEntry es la media móvil de velocidad de un servidor
+type speedHintEntry struct {
+	Speed   float64   `json:"speed"` // bytes/s
+	Updated time.Time `json:"updated"`
+}
+
+// speedHints guarda, por host, la velocidad media de las descargas anteriores
+// para elegir el tamaño de chunk desde el principio. Se conserva entre
+// reinicios en speedHintsFile
+var (
+	speedHints   = make(map[string]speedHintEntry)
+	speedHintsMu sync.Mutex
+)
+
+// speedHintsPath devuelve la ruta del archivo de medias, o "" sin home
+func speedHintsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".catchme", speedHintsFile)
+}
+
+// speedHintKey es la clave de un servidor: el host de la URL sin puerto
+func speedHintKey(rawURL string) string {
+	return strings.ToLower(urlHost(rawURL))
+}
+
+// loadSpeedHints carga las medias guardadas por ejecuciones anteriores. Un
+// archivo ausente o dañado solo significa empezar sin medias
+func loadSpeedHints() {
+	path := speedHintsPath()
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read speed history: %v", err)
+		return
+	}
+
+	hints := make(map[string]speedHintEntry)
+	if err := json.Unmarshal(data, &hints); err != nil {
+		log.Printf("Warning: ignoring invalid speed history %s: %v", path, err)
+		return
+	}
+	speedHintsMu.Lock()
+	speedHints = hints
+	trimSpeedHints()
+	speedHintsMu.Unlock()
+	log.Printf("Loaded speed history for %d hosts", len(hints))
+}
+
+// trimSpeedHints descarta los servidores menos recientes por encima de
+// maxSpeedHintHosts. Se llama con speedHintsMu tomado
+func trimSpeedHints() {
+	for len(speedHints) > maxSpeedHintHosts {
+		oldest := ""
+		for key, entry := range speedHints {
+			if oldest == "" || entry.Updated.Before(speedHints[oldest].Updated) {
+				oldest = key
+			}
+		}
+		delete(speedHints, oldest)
+	}
+}
+
+// saveSpeedHints escribe las medias con el mismo escribir y renombrar que los
+// manifiestos, para no dejar nunca el archivo a medias
+func saveSpeedHints() error {
+	path := speedHintsPath()
+	if path == "" {
+		return nil
+	}
+
+	speedHintsMu.Lock()
+	data, err := json.MarshalIndent(speedHints, "", "  ")
+	speedHintsMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// rememberSpeedHint incorpora la velocidad media de una descarga de url a la
+// media de su servidor y la guarda en disco
+func rememberSpeedHint(url string, speed float64) {
+	key := speedHintKey(url)
+	if speed <= 0 || key == "" {
+		return
+	}
+
+	speedHintsMu.Lock()
+	if entry, exists := speedHints[key]; exists && entry.Speed > 0 {
+		speed = speedHintAlpha*speed + (1-speedHintAlpha)*entry.Speed
+	}
+	speedHints[key] = speedHintEntry{Speed: speed, Updated: time.Now()}
+	trimSpeedHints()
+	speedHintsMu.Unlock()
+
+	if err := saveSpeedHints(); err != nil {
+		log.Printf("Warning: failed to save speed history: %v", err)
+	}
+}
+
+// speedHint devuelve la velocidad media del servidor de url, o 0
+func speedHint(url string) float64 {
+	speedHintsMu.Lock()
+	defer speedHintsMu.Unlock()
+	return speedHints[speedHintKey(url)].Speed
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directorio raíz de los archivos temporales (--temp-dir). Vacío usa el
+// directorio temporal del sistema, que en algunos equipos es un tmpfs pequeño
+var tempDirectory = ""
+
+// Archivo en tempBaseDir() con las raíces temporales propias de descargas
+// (temp_dir), para encontrar sus manifiestos al restaurar
+const tempRootsFile = "temp_roots"
+
+// tempBaseDir devuelve el directorio raíz donde se crean los TempDir de descarga
+func tempBaseDir() string {
+	base := tempDirectory
+	if base == "" {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "catchme")
+}
+
+// tempRoot devuelve la raíz bajo la que se crea el TempDir de la descarga: la
+// propia (TempBase) o la general
+func tempRoot(d *ChunkedDownload) string {
+	d.RLock()
+	defer d.RUnlock()
+	if d.TempBase != "" {
+		return d.TempBase
+	}
+	return tempBaseDir()
+}
+
+// resolveTempBase devuelve la raíz temporal de una descarga: la indicada en
+// el mensaje (temp_dir) o la general, y comprueba que se puede escribir en ella
+func resolveTempBase(override string) (string, error) {
+	base := tempBaseDir()
+	if override != "" {
+		dir, err := resolveDownloadDir(override)
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(dir, "catchme")
+	}
+
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", fmt.Errorf("cannot create temp directory %s: %v", base, err)
+	}
+	if err := probeWritable(base); err != nil {
+		return "", fmt.Errorf("temp directory %s is not writable: %v", base, err)
+	}
+	return base, nil
+}
+
+// warnIfCrossFilesystem avisa si los chunks y el archivo final están en
+// sistemas de archivos distintos: el merge tendrá que copiar todo el archivo
+// entre dispositivos y hará falta espacio en ambos
+func warnIfCrossFilesystem(safeConn *SafeConn, id, tempBase, downloadDir string) {
+	same, err := sameFilesystem(tempBase, downloadDir)
+	if err != nil {
+		log.Printf("Could not compare filesystems of %s and %s: %v", tempBase, downloadDir, err)
+		return
+	}
+	if !same {
+		sendMessage(safeConn, "log", id, fmt.Sprintf(
+			"⚠️ Temp directory %s is on a different filesystem than %s; merging will copy the whole file across filesystems",
+			tempBase, downloadDir))
+	}
+}
+
+// rememberTempRoot anota una raíz temporal distinta de la general para que
+// restorePersistedDownloads la revise tras un reinicio
+func rememberTempRoot(base string) {
+	if base == tempBaseDir() {
+		return
+	}
+	for _, known := range knownTempRoots() {
+		if known == base {
+			return
+		}
+	}
+
+	if err := os.MkdirAll(tempBaseDir(), 0755); err != nil {
+		log.Printf("Warning: could not record temp directory %s: %v", base, err)
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(tempBaseDir(), tempRootsFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Warning: could not record temp directory %s: %v", base, err)
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, base)
+}
+
+// knownTempRoots devuelve la raíz temporal general seguida de las anotadas
+// por rememberTempRoot
+func knownTempRoots() []string {
+	roots := []string{tempBaseDir()}
+
+	data, err := os.ReadFile(filepath.Join(tempBaseDir(), tempRootsFile))
+	if err != nil {
+		return roots
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && line != roots[0] {
+			roots = append(roots, line)
+		}
+	}
+	return roots
+}
+
+// tempDirInUse indica si alguna descarga registrada guarda ya sus chunks en
+// tempDir
+func tempDirInUse(tempDir string) bool {
+	for _, download := range registry.ChunkedDownloads() {
+		download.RLock()
+		used := download.TempDir == tempDir
+		download.RUnlock()
+		if used {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Verificación TLS de las descargas (--insecure-skip-verify, --ca-cert). Es
+// global a propósito: ninguna descarga puede relajarla por su cuenta
+var (
+	tlsSkipVerify = false
+	tlsRootCAs    *x509.CertPool // nil usa solo las raíces del sistema
+)
+
+// loadCACert añade los certificados PEM de path a las raíces del sistema,
+// para servidores internos con una CA propia
+func loadCACert(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	tlsRootCAs = pool
+	log.Printf("Trusting the CA certificates in %s for downloads", path)
+	return nil
+}
+
+// warnInsecureTLS avisa de que no se verifican los certificados, al arrancar
+// y en cada descarga
+func warnInsecureTLS() {
+	log.Printf("WARNING: TLS certificate verification is DISABLED (--insecure-skip-verify). " +
+		"Downloads can be intercepted or tampered with; use --ca-cert for self-signed servers instead")
+}
+
+// downloadTLSConfig devuelve la configuración TLS de los transports de
+// descarga, o nil si no hay nada que cambiar respecto al valor por defecto
+func downloadTLSConfig() *tls.Config {
+	if !tlsSkipVerify && tlsRootCAs == nil {
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify: tlsSkipVerify,
+		RootCAs:            tlsRootCAs,
+	}
+}
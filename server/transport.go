@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Tamaño del buffer de recepción TCP (SO_RCVBUF) en bytes (--tcp-rcvbuf).
+// Con 0 se deja el valor del sistema. Útil en enlaces con mucho ancho de banda
+// y latencia alta, donde el buffer por defecto limita cada conexión
+var tcpReceiveBuffer = 0
+
+// Forzar HTTP/1.1 en todas las descargas (--http1). Con HTTP/2 todos los chunks
+// se multiplexan sobre una sola conexión TCP, así que para tener conexiones
+// realmente paralelas hay que desactivarlo
+var forceHTTP1 = false
+
+// Protocolos HTTP que se pueden pedir por descarga con la opción protocol.
+// La cadena vacía (o "auto") negocia HTTP/2 por ALPN y respeta --http1
+const (
+	HTTPProtocolHTTP1 = "http1"
+	HTTPProtocolHTTP2 = "http2"
+)
+
+// parseHTTPProtocol valida la opción protocol de start_download
+func parseHTTPProtocol(raw string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "auto":
+		return "", nil
+	case HTTPProtocolHTTP1:
+		return HTTPProtocolHTTP1, nil
+	case HTTPProtocolHTTP2:
+		return HTTPProtocolHTTP2, nil
+	default:
+		return "", fmt.Errorf("unknown protocol %q (use auto, http1 or http2)", raw)
+	}
+}
+
+// newDialer crea el dialer compartido por todos los clientes de descarga
+func newDialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if tcpReceiveBuffer > 0 {
+		size := tcpReceiveBuffer
+		// Ajustar el socket antes de conectar para que la ventana TCP se negocie
+		// ya con el buffer ampliado
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setReceiveBuffer(fd, size)
+			}); err != nil {
+				return err
+			}
+			if sockErr != nil {
+				log.Printf("Could not set SO_RCVBUF=%d for %s: %v", size, address, sockErr)
+			}
+			return nil
+		}
+	}
+
+	return dialer
+}
+
+// newDownloadTransport crea el transport HTTP usado por las descargas. Con
+// protocol http1 (o --http1) se desactiva la negociación de HTTP/2 (ALPN) para
+// que cada chunk use su propia conexión; http2 la mantiene aunque se haya
+// pasado --http1. proxy sustituye a --proxy para esta descarga
+func newDownloadTransport(maxConnsPerHost int, protocol string, proxy string) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(proxy),
+		DialContext:           newDialer().DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+		ForceAttemptHTTP2:     true,
+		DisableKeepAlives:     false, // Asegurar que keep-alives esté habilitado
+		MaxConnsPerHost:       maxConnsPerHost,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		TLSClientConfig:       downloadTLSConfig(),
+	}
+
+	if protocol == HTTPProtocolHTTP1 || (forceHTTP1 && protocol != HTTPProtocolHTTP2) {
+		transport.ForceAttemptHTTP2 = false
+		// Un mapa vacío (no nil) impide que net/http active HTTP/2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport
+}
+
+// newDownloadClient crea un cliente HTTP sin timeout global para descargas
+func newDownloadClient(maxConnsPerHost int, protocol string, proxy string) *http.Client {
+	return &http.Client{
+		Timeout:   0, // Sin timeout global
+		Transport: newDownloadTransport(maxConnsPerHost, protocol, proxy),
+	}
+}
+
+// reportResolvedURL devuelve la URL final tras las redirecciones de resp y, si
+// difiere de la pedida, avisa al cliente de dónde vienen realmente los bytes
+func reportResolvedURL(safeConn *SafeConn, id string, resp *http.Response) string {
+	url := downloadIDs.URL(id)
+	if resp.Request == nil || resp.Request.URL == nil {
+		return url
+	}
+	resolved := resp.Request.URL.String()
+	if resolved == url {
+		return url
+	}
+
+	log.Printf("%s redirects to %s", url, resolved)
+	publishEvent(safeConn, map[string]interface{}{
+		"type":         "resolved_url",
+		"download_id":  id,
+		"resolved_url": resolved,
+		"message":      fmt.Sprintf("Downloading from %s", resolved),
+	})
+	return resolved
+}
+
+// reportProtocol informa al cliente del protocolo negociado con el servidor.
+// Con HTTP/2 los chunks comparten una conexión multiplexada, de modo que
+// MaxConnsPerHost no limita nada y el paralelismo depende del control de flujo
+// de HTTP/2 en lugar de usar varias conexiones TCP
+func reportProtocol(safeConn *SafeConn, id string, resp *http.Response) {
+	multiplexed := resp.ProtoMajor >= 2
+	guidance := "Each chunk uses its own TCP connection"
+	if multiplexed {
+		guidance = "All chunks share one multiplexed connection; set protocol http1 (or --http1) for truly parallel connections"
+	}
+
+	log.Printf("Negotiated %s with %s (multiplexed=%t)", resp.Proto, resp.Request.URL.Host, multiplexed)
+	publishEvent(safeConn, map[string]interface{}{
+		"type":        "protocol_info",
+		"download_id": id,
+		"protocol":    resp.Proto,
+		"multiplexed": multiplexed,
+		"guidance":    guidance,
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"strings"
+)
+
+// normalizeDownloadURL quita los espacios de alrededor y comprueba que la URL
+// sea http(s) con host antes de hacer ninguna petición. No reescribe el resto
+// de la URL: los clientes la usan como clave de los eventos
+func normalizeDownloadURL(raw string) (string, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return "", errors.New("missing URL")
+	}
+
+	parsed, err := neturl.Parse(trimmed)
+	if err != nil {
+		return "", fmt.Errorf("malformed URL: %v", err)
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+	case "":
+		return "", fmt.Errorf("URL %q has no scheme, expected http:// or https://", trimmed)
+	default:
+		return "", fmt.Errorf("unsupported URL scheme %q, expected http or https", parsed.Scheme)
+	}
+	if parsed.Hostname() == "" {
+		return "", fmt.Errorf("URL %q has no host", trimmed)
+	}
+	return trimmed, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// browserUserAgent se envía a los hosts que rechazan agentes que no son un
+// navegador (ver markBrowserOnly)
+const browserUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.93 Safari/537.36"
+
+// User-Agent de todas las descargas (--user-agent). Vacío usa el de CatchMe,
+// salvo en los hosts que lo rechazan
+var userAgent = ""
+
+// Hosts que respondieron 403 al User-Agent de CatchMe y aceptaron el de un
+// navegador. Se recuerdan mientras el servidor siga en marcha
+var (
+	browserHostsMu sync.Mutex
+	browserHosts   = map[string]bool{}
+)
+
+// defaultUserAgent devuelve el User-Agent propio, con la versión de
+// ImplementationInfo ("CatchMe/1.0.0")
+func defaultUserAgent() string {
+	name, version, found := strings.Cut(ImplementationInfo, " v")
+	if !found {
+		return ImplementationInfo
+	}
+	return name + "/" + version
+}
+
+// userAgentFor elige el User-Agent de una petición a rawURL: el de la
+// descarga, el de --user-agent, el de navegador si el host lo necesita o el
+// de CatchMe, en ese orden
+func userAgentFor(override, rawURL string) string {
+	switch {
+	case override != "":
+		return override
+	case userAgent != "":
+		return userAgent
+	case isBrowserOnly(rawURL):
+		return browserUserAgent
+	default:
+		return defaultUserAgent()
+	}
+}
+
+// isBrowserOnly indica si el host de rawURL necesita el User-Agent de navegador
+func isBrowserOnly(rawURL string) bool {
+	host := urlHost(rawURL)
+	browserHostsMu.Lock()
+	defer browserHostsMu.Unlock()
+	return browserHosts[host]
+}
+
+// markBrowserOnly pasa el host de rawURL al User-Agent de navegador tras un
+// 403. Devuelve false si no cambia nada: el User-Agent lo fijó el usuario (un
+// 403 entonces no es cosa nuestra) o el host ya estaba marcado
+func markBrowserOnly(rawURL, override string) bool {
+	if override != "" || userAgent != "" {
+		return false
+	}
+	host := urlHost(rawURL)
+	if host == "" {
+		return false
+	}
+
+	browserHostsMu.Lock()
+	defer browserHostsMu.Unlock()
+	if browserHosts[host] {
+		return false
+	}
+	browserHosts[host] = true
+	log.Printf("Using a browser User-Agent for %s", host)
+	return true
+}
+
+// urlHost devuelve el host (sin puerto) de rawURL, o "" si no es válida
+func urlHost(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// downloadWatchers guarda, por id, las conexiones WebSocket que siguen una
+// descarga además de la que la inició (otra pestaña, un cliente reconectado)
+type downloadWatchers struct {
+	mu   sync.Mutex
+	byID map[string]map[*SafeConn]struct{}
+}
+
+// Conexiones suscritas a cada descarga con subscribe
+var watchers = &downloadWatchers{byID: make(map[string]map[*SafeConn]struct{})}
+
+// Watch suscribe la conexión a los eventos de la descarga
+func (w *downloadWatchers) Watch(id string, conn *SafeConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	conns, exists := w.byID[id]
+	if !exists {
+		conns = make(map[*SafeConn]struct{})
+		w.byID[id] = conns
+	}
+	conns[conn] = struct{}{}
+}
+
+// Unwatch cancela la suscripción de la conexión a la descarga
+func (w *downloadWatchers) Unwatch(id string, conn *SafeConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.byID[id], conn)
+	if len(w.byID[id]) == 0 {
+		delete(w.byID, id)
+	}
+}
+
+// UnwatchAll elimina todas las suscripciones de una conexión cerrada
+func (w *downloadWatchers) UnwatchAll(conn *SafeConn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for id, conns := range w.byID {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(w.byID, id)
+		}
+	}
+}
+
+// Of devuelve las conexiones suscritas a la descarga
+func (w *downloadWatchers) Of(id string) []*SafeConn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	conns := make([]*SafeConn, 0, len(w.byID[id]))
+	for conn := range w.byID[id] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// sendDownloadSnapshot envía solo a safeConn el estado actual de una descarga:
+// la distribución de chunks, el progreso de cada uno y el progreso total.
+// Devuelve false si la descarga no está registrada
+func sendDownloadSnapshot(safeConn *SafeConn, id string) bool {
+	paused, tracked := registry.IsPaused(id)
+	if !tracked {
+		return false
+	}
+	url := downloadIDs.URL(id)
+
+	download, chunked := registry.Get(id)
+	if !chunked {
+		// Descarga de una sola conexión: el progreso llega con el siguiente
+		// mensaje progress
+		status := StatusDownloading
+		if paused {
+			status = StatusPaused
+		}
+		safeConn.SendJSON(map[string]interface{}{
+			"type":        "progress",
+			"url":         url,
+			"download_id": id,
+			"status":      status,
+		})
+		return true
+	}
+
+	// La misma secuencia que al empezar la descarga (ver sendChunksInit)
+	chunks := download.ChunkStates()
+	if individualChunkInit {
+		for _, chunk := range chunks {
+			safeConn.SendJSON(map[string]interface{}{
+				"type":        "chunk_init",
+				"url":         url,
+				"download_id": id,
+				"chunk":       chunk,
+			})
+		}
+	} else {
+		safeConn.SendJSON(map[string]interface{}{
+			"type":        "chunks_init",
+			"url":         url,
+			"download_id": id,
+			"chunks":      chunks,
+		})
+	}
+	for _, chunk := range chunks {
+		safeConn.SendJSON(map[string]interface{}{
+			"type":        "chunk_progress",
+			"url":         url,
+			"download_id": id,
+			"chunk":       chunk,
+		})
+	}
+
+	downloaded, total := download.GetProgress()
+	progress := map[string]interface{}{
+		"type":          "progress",
+		"url":           url,
+		"download_id":   id,
+		"bytesReceived": downloaded,
+		"totalBytes":    total,
+		"speed":         download.Speed(),
+		"avg_speed":     getPreviousSpeed(id),
+		"status":        download.CurrentStatus(),
+		"eta_seconds":   estimateETA(id, downloaded, total, download.CurrentStatus()),
+	}
+	addConcurrency(progress, download)
+	safeConn.SendJSON(progress)
+	return true
+}
+
+// handleSubscribe suscribe la conexión a una descarga en curso y le envía su
+// estado actual para que pueda mostrarla sin esperar al siguiente evento
+func handleSubscribe(safeConn *SafeConn, id string) {
+	watchers.Watch(id, safeConn)
+	log.Printf("Client subscribed to %s", downloadIDs.URL(id))
+	safeConn.SendJSON(map[string]interface{}{
+		"type":        "subscribed",
+		"url":         downloadIDs.URL(id),
+		"download_id": id,
+	})
+	sendDownloadSnapshot(safeConn, id)
+}
+
+// handleListActive responde a list_active con la lista de descargas
+// registradas seguida del estado completo de cada una, y suscribe la conexión
+// a todas para que un cliente reconectado reconstruya su vista sin reiniciar
+// nada
+func handleListActive(safeConn *SafeConn) {
+	entries := registry.Entries()
+
+	downloads := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		downloads = append(downloads, map[string]interface{}{
+			"url":         entry.URL,
+			"download_id": entry.ID,
+			"paused":      entry.Paused,
+			"chunked":     entry.Download != nil,
+		})
+	}
+	safeConn.SendJSON(map[string]interface{}{
+		"type":      "active_downloads",
+		"downloads": downloads,
+	})
+
+	for _, entry := range entries {
+		watchers.Watch(entry.ID, safeConn)
+		sendDownloadSnapshot(safeConn, entry.ID)
+	}
+}
+
+// handleUnsubscribe deja de enviar a la conexión los eventos de una descarga
+func handleUnsubscribe(safeConn *SafeConn, id string) {
+	watchers.Unwatch(id, safeConn)
+	safeConn.SendJSON(map[string]interface{}{
+		"type":        "unsubscribed",
+		"url":         downloadIDs.URL(id),
+		"download_id": id,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// URL a la que se envía un POST al terminar cada descarga (--webhook-url).
+// Vacío desactiva el webhook salvo que la descarga indique el suyo
+var webhookURL = ""
+
+const (
+	// Intentos de entrega del webhook y espera antes del primer reintento
+	// (se duplica en cada uno)
+	webhookAttempts  = 3
+	webhookBaseDelay = 2 * time.Second
+	webhookTimeout   = 10 * time.Second
+)
+
+// Estados enviados en el webhook
+const (
+	webhookStatusCompleted = "completed"
+	webhookStatusError     = "error"
+)
+
+// webhookPayload es el cuerpo JSON del webhook
+type webhookPayload struct {
+	ID        string `json:"download_id,omitempty"`
+	URL       string `json:"url"`
+	Filename  string `json:"filename"`
+	Path      string `json:"path,omitempty"`
+	Size      int64  `json:"size"`
+	Checksum  string `json:"checksum,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// parseWebhookURL valida la URL de un webhook (solo http y https)
+func parseWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q (use http or https)", raw)
+	}
+	return nil
+}
+
+// webhookTarget devuelve el webhook de una descarga o el de --webhook-url
+func webhookTarget(override string) string {
+	if override != "" {
+		return override
+	}
+	return webhookURL
+}
+
+// fireStreamWebhook envía el webhook de una descarga de una sola conexión
+func fireStreamWebhook(opts DownloadOptions, id, url, filename, path string, size int64, errMsg string) {
+	payload := webhookPayload{
+		ID:       id,
+		URL:      url,
+		Filename: filename,
+		Path:     path,
+		Size:     size,
+		Status:   webhookStatusCompleted,
+	}
+	if errMsg != "" {
+		payload.Status = webhookStatusError
+		payload.Error = errMsg
+	}
+	fireWebhook(webhookTarget(opts.Webhook), payload)
+}
+
+// fireWebhook envía el webhook en segundo plano. Los fallos solo se registran:
+// nunca afectan al resultado de la descarga. Si una descarga completada no
+// trae checksum se calcula aquí
+func fireWebhook(target string, payload webhookPayload) {
+	if target == "" {
+		return
+	}
+
+	go func() {
+		if payload.Status == webhookStatusCompleted && payload.Checksum == "" && payload.Path != "" {
+			checksum, err := calculateChecksum(payload.Path, DefaultChecksumAlgorithm)
+			if err != nil {
+				log.Printf("Webhook for %s sent without checksum: %v", payload.URL, err)
+			} else {
+				payload.Checksum = checksum
+				payload.Algorithm = DefaultChecksumAlgorithm
+			}
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Webhook payload for %s: %v", payload.URL, err)
+			return
+		}
+
+		client := &http.Client{Timeout: webhookTimeout}
+		delay := webhookBaseDelay
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = postWebhook(client, target, body); err == nil {
+				log.Printf("Webhook sent for %s (%s)", payload.URL, payload.Status)
+				return
+			}
+			log.Printf("Webhook attempt %d/%d for %s failed: %v", attempt, webhookAttempts, payload.URL, err)
+			if attempt < webhookAttempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+		log.Printf("Giving up on webhook for %s: %v", payload.URL, err)
+	}()
+}
+
+// postWebhook hace un único POST; cualquier respuesta que no sea 2xx es un fallo
+func postWebhook(client *http.Client, target string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", ImplementationInfo)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifyDownloadFailed avisa del fallo de una descarga por chunks con la
+// notificación de escritorio y el webhook
+func notifyDownloadFailed(download *ChunkedDownload, detail string) {
+	notifyDownloadResult(download.Filename, false, detail)
+	fireDownloadWebhook(download, "", "", detail)
+}
+
+// fireDownloadWebhook envía el webhook de una descarga por chunks. Sin
+// errMsg se informa como completada
+func fireDownloadWebhook(download *ChunkedDownload, path, checksum, errMsg string) {
+	status := webhookStatusCompleted
+	if errMsg != "" {
+		status = webhookStatusError
+	}
+
+	download.RLock()
+	target := webhookTarget(download.Webhook)
+	payload := webhookPayload{
+		ID:       download.ID,
+		URL:      download.URL,
+		Filename: download.Filename,
+		Path:     path,
+		Size:     download.Size,
+		Checksum: checksum,
+		Status:   status,
+		Error:    errMsg,
+	}
+	download.RUnlock()
+	if path != "" {
+		// El nombre guardado puede estar numerado
+		payload.Filename = filepath.Base(path)
+	}
+	if checksum != "" {
+		payload.Algorithm = DefaultChecksumAlgorithm
+	}
+	fireWebhook(target, payload)
+}